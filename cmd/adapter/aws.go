@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/sha1sum/aws_signing_client"
+)
+
+// awsCredentials returns the credentials used to sign Elasticsearch requests.
+// They are resolved by the SDK default chain, in order environment variables,
+// web identity tokens, shared config files and ECS or EC2 metadata, and used
+// to assume aws_role_arn when it is set. configs override the session
+// config, eg the STS endpoint.
+func awsCredentials(c *config, configs ...*aws.Config) (*credentials.Credentials, error) {
+	sessConfig := aws.Config{Region: aws.String(c.awsRegion)}
+	sessConfig.MergeIn(configs...)
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            sessConfig,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if c.awsRoleARN == "" {
+		return sess.Config.Credentials, nil
+	}
+	return stscreds.NewCredentials(sess, c.awsRoleARN), nil
+}
+
+// awsSigningClient returns client with its requests signed for the es service
+// of aws_region
+func awsSigningClient(c *config, client *http.Client) (*http.Client, error) {
+	creds, err := awsCredentials(c)
+	if err != nil {
+		return nil, fmt.Errorf("creating AWS credentials: %s", err)
+	}
+	signed, err := aws_signing_client.New(v4.NewSigner(creds), client, "es", c.awsRegion)
+	if err != nil {
+		return nil, fmt.Errorf("creating AWS signing client for region %q: %s", c.awsRegion, err)
+	}
+	return signed, nil
+}
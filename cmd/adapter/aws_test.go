@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/namsral/flag"
+)
+
+// awsVars are the environment variables the AWS SDK resolves the region and
+// credentials from
+var awsVars = []string{
+	"AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY", "AWS_SECRET_KEY", "AWS_SESSION_TOKEN",
+	"AWS_REGION", "AWS_DEFAULT_REGION", "AWS_PROFILE", "AWS_DEFAULT_PROFILE", "AWS_SDK_LOAD_CONFIG",
+	"AWS_CONFIG_FILE", "AWS_SHARED_CREDENTIALS_FILE", "AWS_ROLE_ARN", "AWS_WEB_IDENTITY_TOKEN_FILE",
+	"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_CREDENTIALS_FULL_URI", "AWS_EC2_METADATA_DISABLED",
+}
+
+// awsEnv replaces the AWS environment with env, without shared config files
+// or instance metadata unless env sets them, and returns a func restoring it
+func awsEnv(env map[string]string) func() {
+	saved := make(map[string]string)
+	for _, name := range awsVars {
+		if v, ok := os.LookupEnv(name); ok {
+			saved[name] = v
+		}
+		os.Unsetenv(name)
+	}
+	missing := filepath.Join(os.TempDir(), "prometheus-es-adapter-missing")
+	os.Setenv("AWS_CONFIG_FILE", missing)
+	os.Setenv("AWS_SHARED_CREDENTIALS_FILE", missing)
+	os.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	for name, v := range env {
+		os.Setenv(name, v)
+	}
+	return func() {
+		for _, name := range awsVars {
+			os.Unsetenv(name)
+		}
+		for name, v := range saved {
+			os.Setenv(name, v)
+		}
+	}
+}
+
+func TestAWSSigningClient(t *testing.T) {
+	defer awsEnv(map[string]string{"AWS_ACCESS_KEY_ID": "AKID", "AWS_SECRET_ACCESS_KEY": "SECRET"})()
+	var auth string
+	// the signer always sends https requests
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+	}))
+	defer srv.Close()
+
+	c := validConfig()
+	c.awsSigning = true
+	if _, err := awsSigningClient(c, &http.Client{}); err == nil || !strings.Contains(err.Error(), `region ""`) {
+		t.Errorf("got error %v without a region, want the missing region reported", err)
+	}
+
+	c.awsRegion = "eu-west-1"
+	client, err := awsSigningClient(c, srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if !strings.Contains(auth, "Credential=AKID/") || !strings.Contains(auth, "/eu-west-1/es/aws4_request") {
+		t.Errorf("got Authorization %q, want it signed by AKID for es in eu-west-1", auth)
+	}
+}
+
+func TestAWSRegion(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want string
+	}{
+		{"flag", []string{"-aws_region", "eu-west-1"}, nil, "eu-west-1"},
+		{"env", nil, map[string]string{"AWS_REGION": "us-east-1"}, "us-east-1"},
+		{"flag over env", []string{"-aws_region", "eu-west-1"}, map[string]string{"AWS_REGION": "us-east-1"}, "eu-west-1"},
+		{"neither", nil, nil, ""},
+	}
+	for _, test := range tests {
+		restore := awsEnv(test.env)
+		c, err := parseFlagSet(flag.NewFlagSet("adapter", flag.ContinueOnError), append([]string{"-es_aws_signing"}, test.args...))
+		restore()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if c.awsRegion != test.want {
+			t.Errorf("%s: got region %q, want %q", test.name, c.awsRegion, test.want)
+		}
+		err = validateConfig(c)
+		if test.want == "" && (err == nil || !strings.Contains(err.Error(), "aws_region is required")) {
+			t.Errorf("%s: got error %v, want the missing region rejected", test.name, err)
+		}
+		if test.want != "" && err != nil {
+			t.Errorf("%s: got error %v, want the region accepted", test.name, err)
+		}
+	}
+}
+
+// assumeRoleResponse answers an STS AssumeRole request
+const assumeRoleResponse = `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>ASSUMED</AccessKeyId>
+      <SecretAccessKey>SECRET</SecretAccessKey>
+      <SessionToken>TOKEN</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleResult>
+</AssumeRoleResponse>`
+
+func TestAWSCredentialsRole(t *testing.T) {
+	defer awsEnv(map[string]string{"AWS_ACCESS_KEY_ID": "AKID", "AWS_SECRET_ACCESS_KEY": "SECRET"})()
+	var roles []string
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		roles = append(roles, r.Form.Get("RoleArn"))
+		fmt.Fprintf(w, assumeRoleResponse, time.Now().Add(time.Hour).UTC().Format("2006-01-02T15:04:05Z"))
+	}))
+	defer sts.Close()
+
+	role := "arn:aws:iam::123456789012:role/prometheus"
+	tests := []struct {
+		name     string
+		role     string
+		provider string
+		key      string
+	}{
+		{"env credentials", "", "EnvConfigCredentials", "AKID"},
+		{"assumed role", role, stscreds.ProviderName, "ASSUMED"},
+	}
+	for _, test := range tests {
+		roles = nil
+		c := validConfig()
+		c.awsRegion = "eu-west-1"
+		c.awsRoleARN = test.role
+		creds, err := awsCredentials(c, &aws.Config{Endpoint: aws.String(sts.URL)})
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		v, err := creds.Get()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if v.ProviderName != test.provider || v.AccessKeyID != test.key {
+			t.Errorf("%s: got key %s from %s, want %s from %s", test.name, v.AccessKeyID, v.ProviderName, test.key, test.provider)
+		}
+		var want []string
+		if test.role != "" {
+			want = []string{test.role}
+		}
+		if !reflect.DeepEqual(roles, want) {
+			t.Errorf("%s: got roles %v assumed, want %v", test.name, roles, want)
+		}
+	}
+}
+
+func TestAWSCredentialsChain(t *testing.T) {
+	f, err := ioutil.TempFile("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("[default]\naws_access_key_id = SHARED\naws_secret_access_key = SECRET\n")
+	f.Close()
+
+	tests := []struct {
+		name     string
+		env      map[string]string
+		provider string
+		key      string
+	}{
+		{"env over shared", map[string]string{"AWS_SHARED_CREDENTIALS_FILE": f.Name(), "AWS_ACCESS_KEY_ID": "AKID", "AWS_SECRET_ACCESS_KEY": "SECRET"}, "EnvConfigCredentials", "AKID"},
+		{"shared without env", map[string]string{"AWS_SHARED_CREDENTIALS_FILE": f.Name()}, "SharedConfigCredentials", "SHARED"},
+		{"none", nil, "", ""},
+	}
+	for _, test := range tests {
+		restore := awsEnv(test.env)
+		c := validConfig()
+		c.awsRegion = "eu-west-1"
+		creds, err := awsCredentials(c)
+		if err != nil {
+			restore()
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		v, err := creds.Get()
+		restore()
+		if test.provider == "" {
+			if err == nil {
+				t.Errorf("%s: got credentials from %s, want none found", test.name, v.ProviderName)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if !strings.HasPrefix(v.ProviderName, test.provider) || v.AccessKeyID != test.key {
+			t.Errorf("%s: got key %s from %s, want %s from %s", test.name, v.AccessKeyID, v.ProviderName, test.key, test.provider)
+		}
+	}
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/namsral/flag"
+	"github.com/pwillie/prometheus-es-adapter/pkg/elasticsearch"
+)
+
+// config holds the command line options, each of which can also be set by
+// the upper cased environment variable of the same name
+type config struct {
+	esURL         string
+	scheme        string
+	user          string
+	pass          string
+	userFile      string
+	passFile      string
+	apiKey        string
+	apiKeyID      string
+	caFile        string
+	tlsInsecure   bool
+	clientCert    string
+	clientKey     string
+	connTimeout   int
+	reqTimeout    int
+	maxRetries    int
+	userAgent     string
+	retryBackoff  int
+	awsSigning    bool
+	awsRegion     string
+	awsRoleARN    string
+	workers       int
+	readWorkers   int
+	batchMaxAge   int
+	batchMaxDocs  int
+	batchMaxSize  int
+	backoffMin    int
+	backoffMax    int
+	rejectLimit   int
+	rejectPause   int
+	maxQueued     int64
+	dryRun        bool
+	processorName string
+	docModel      string
+	maxLabelNames int
+	storeMetadata bool
+	exemplars     bool
+	writeRefresh  string
+	timeField     string
+	labelField    string
+	labelText     string
+	nestedLabels  bool
+	dropRegex     string
+	keepRegex     string
+	filterFile    string
+	maxSampleAge  int
+	maxFuture     int
+	dropRange     bool
+	sampleRatio   float64
+	sampleRegex   string
+	sanitize      bool
+	dedup         bool
+	pipeline      string
+	deadLetter    string
+	indexAlias    string
+	templateName  string
+	templateAPI   string
+	components    string
+	tenantLabel   string
+	indexDaily    bool
+	dailyLayout   string
+	dailyUTC      bool
+	precreate     int
+	indexShards   int
+	indexReplicas int
+	routingShards int
+	indexRefresh  string
+	indexCodec    string
+	labelMappings string
+	indexMaxAge   string
+	indexMaxDocs  int64
+	indexMaxSize  string
+	retention     string
+	checkInterval int
+	dataStream    bool
+	useILM        bool
+	ilmPolicy     string
+	searchMaxDocs int
+	searchLimit   int
+	downsample    int
+	readConc      int
+	cacheSize     int
+	cacheTTL      int
+	sniffEnabled  bool
+	gzipEnabled   bool
+	webAddr       string
+	adminAddr     string
+	adminEnabled  bool
+	singlePort    bool
+	shutdownWait  int
+	readTimeout   int
+	writeTimeout  int
+	idleTimeout   int
+	maxBody       int64
+	webTLSCert    string
+	webTLSKey     string
+	webUser       string
+	webPass       string
+	webPassFile   string
+	adminUser     string
+	adminPass     string
+	adminPassFile string
+	metricsAuth   bool
+	pprofEnabled  bool
+	statsHealth   int
+	statsEnabled  bool
+	otelEndpoint  string
+	logLevel      string
+	logFormat     string
+	debug         bool
+}
+
+// parseFlags registers and parses the command line options
+func parseFlags() *config {
+	// CommandLine exits on errors
+	c, _ := parseFlagSet(flag.CommandLine, os.Args[1:])
+	return c
+}
+
+// parseFlagSet registers the options on fs and parses them from args, then
+// from the environment variables named after them in upper case
+func parseFlagSet(fs *flag.FlagSet, args []string) (*config, error) {
+	c := &config{}
+	fs.StringVar(&c.esURL, "es_url", "http://localhost:9200", "Comma separated list of Elasticsearch URLs.")
+	fs.StringVar(&c.scheme, "es_scheme", "", "Elasticsearch URL scheme, derived from es_url when empty.")
+	fs.StringVar(&c.user, "es_user", "", "Elasticsearch User.")
+	fs.StringVar(&c.pass, "es_password", "", "Elasticsearch User Password.")
+	fs.StringVar(&c.userFile, "es_user_file", "", "File containing the Elasticsearch User, instead of es_user")
+	fs.StringVar(&c.passFile, "es_password_file", "", "File containing the Elasticsearch User Password, instead of es_password")
+	fs.StringVar(&c.apiKey, "es_api_key", "", "Elasticsearch API key, base64 encoded id:key unless es_api_key_id is set")
+	fs.StringVar(&c.apiKeyID, "es_api_key_id", "", "Id of es_api_key when it is not already encoded with it")
+	fs.StringVar(&c.caFile, "es_ca_file", "", "PEM file of certificate authorities trusted for Elasticsearch TLS, instead of the system roots")
+	fs.BoolVar(&c.tlsInsecure, "es_tls_insecure", false, "Skip verification of the Elasticsearch TLS certificate, for testing only")
+	fs.StringVar(&c.clientCert, "es_client_cert", "", "PEM client certificate presented to Elasticsearch for mutual TLS")
+	fs.StringVar(&c.clientKey, "es_client_key", "", "PEM private key of es_client_cert")
+	fs.IntVar(&c.connTimeout, "es_connect_timeout", 5, "Timeout in seconds for connecting to Elasticsearch and health checks")
+	fs.IntVar(&c.reqTimeout, "es_request_timeout", 0, "Timeout in seconds for Elasticsearch requests, 0 for no timeout")
+	fs.IntVar(&c.maxRetries, "es_max_retries", 0, "Max retries of Elasticsearch requests that fail to connect or are answered with 429, 502, 503 or 504")
+	fs.IntVar(&c.retryBackoff, "es_retry_backoff", 100, "Initial wait in milliseconds between retries, doubled after each retry")
+	fs.StringVar(&c.userAgent, "es_user_agent", "", "User-Agent of Elasticsearch requests, defaults to prometheus-es-adapter with the build and commit")
+	fs.BoolVar(&c.awsSigning, "es_aws_signing", false, "Sign Elasticsearch requests with AWS v4 credentials.")
+	fs.StringVar(&c.awsRegion, "aws_region", "", "AWS region of the Elasticsearch domain used to sign requests")
+	fs.StringVar(&c.awsRoleARN, "aws_role_arn", "", "ARN of an AWS IAM role assumed to sign requests")
+	fs.IntVar(&c.workers, "es_workers", 1, "Number of bulk processor workers committing batches to Elasticsearch concurrently")
+	fs.IntVar(&c.batchMaxAge, "es_batch_max_age", 10, "Max period in seconds between bulk Elasticsearch insert operations")
+	fs.IntVar(&c.batchMaxDocs, "es_batch_max_docs", 1000, "Max items for bulk Elasticsearch insert operation")
+	fs.IntVar(&c.batchMaxSize, "es_batch_max_size", 4096, "Max size in bytes for bulk Elasticsearch insert operation")
+	fs.Int64Var(&c.maxQueued, "es_max_queued_samples", 0, "Max samples waiting to be committed before writes are rejected with 429, 0 for no limit")
+	fs.IntVar(&c.backoffMin, "es_bulk_backoff_min", 200, "Initial wait in milliseconds between retries of failed or rejected bulk commits, doubled after each retry")
+	fs.IntVar(&c.backoffMax, "es_bulk_backoff_max", 10000, "Max wait in milliseconds between retries of a bulk commit, reaching it gives up")
+	fs.IntVar(&c.rejectLimit, "es_bulk_reject_limit", 0, "Items rejected with 429 in a bulk commit after which writes are refused with 429, 0 to disable")
+	fs.IntVar(&c.rejectPause, "es_bulk_reject_pause", 10, "Seconds writes are refused after es_bulk_reject_limit rejections")
+	fs.BoolVar(&c.dryRun, "es_dry_run", false, "Log bulk requests at debug level instead of indexing samples")
+	fs.StringVar(&c.processorName, "es_processor_name", "", "Name of the bulk processor, also sent as X-Opaque-Id to Elasticsearch, defaults to the hostname")
+	fs.StringVar(&c.docModel, "es_doc_model", elasticsearch.DocModelSample, "Document model, per-sample or per-series-nested to index the samples of a series in one doc")
+	fs.IntVar(&c.maxLabelNames, "es_max_label_names", 0, "Max distinct label names indexed, series adding more are dropped, 0 for no limit")
+	fs.BoolVar(&c.storeMetadata, "es_store_metadata", false, "Store metric type, help and unit sent by remote write 2.0 in the es_alias_metadata index")
+	fs.BoolVar(&c.exemplars, "es_store_exemplars", false, "Store exemplars sent by remote write in the es_alias_exemplars index")
+	fs.StringVar(&c.writeRefresh, "es_write_refresh", "", "Refresh policy of bulk requests, false, true or wait_for, defaults to the index refresh interval")
+	fs.StringVar(&c.timeField, "es_timestamp_field", "timestamp", "Name of the document field holding the sample timestamp")
+	fs.StringVar(&c.labelField, "es_label_field", "label", "Name of the document object holding the labels")
+	fs.StringVar(&c.labelText, "es_label_text_field", "", "Name of a text field all label values are copied to for full-text search, disabled when empty")
+	fs.BoolVar(&c.nestedLabels, "es_nested_labels", false, "Store labels as a nested array of name and value pairs, so new label names do not add fields to the mapping")
+	fs.StringVar(&c.dropRegex, "es_write_drop_regex", "", "Regex of metric names not to index")
+	fs.StringVar(&c.keepRegex, "es_write_keep_regex", "", "Regex of metric names always indexed, even when matching es_write_drop_regex")
+	fs.StringVar(&c.filterFile, "es_write_filter_file", "", "File of drop: and keep: metric name regex rules, instead of es_write_drop_regex and es_write_keep_regex, reloaded by POST /reload")
+	fs.IntVar(&c.maxSampleAge, "es_write_max_sample_age", 0, "Seconds after which samples are counted and logged as too old, 0 to disable")
+	fs.IntVar(&c.maxFuture, "es_write_max_sample_future", 0, "Seconds ahead of the adapter clock after which samples are counted and logged as future, 0 to disable")
+	fs.Float64Var(&c.sampleRatio, "es_write_sample_ratio", 1, "Fraction of series indexed, consistently chosen by their labels, 1 indexes all series")
+	fs.StringVar(&c.sampleRegex, "es_write_sample_regex", "", "Regex of metric names es_write_sample_ratio applies to, all metrics when empty")
+	fs.BoolVar(&c.dropRange, "es_write_drop_out_of_range", false, "Drop samples flagged by es_write_max_sample_age or es_write_max_sample_future instead of indexing them")
+	fs.BoolVar(&c.dedup, "es_write_dedup", false, "Derive doc ids from the series and sample timestamps so samples sent again overwrite rather than duplicate their docs")
+	fs.BoolVar(&c.sanitize, "es_sanitize_labels", false, "Replace characters not valid in Prometheus label names with underscores")
+	fs.StringVar(&c.pipeline, "es_ingest_pipeline", "", "Elasticsearch ingest pipeline to index samples through")
+	fs.StringVar(&c.deadLetter, "es_deadletter_file", "", "File to append samples that failed to index to")
+	fs.StringVar(&c.indexAlias, "es_alias", "prom-metrics", "Elasticsearch alias pointing to active write index")
+	fs.StringVar(&c.templateName, "es_template_name", "", "Name of the index template created by the adapter, defaults to es_alias")
+	fs.StringVar(&c.templateAPI, "es_template_api", "auto", "Index template API, legacy, composable for Elasticsearch 7.8+ or auto to pick composable when supported")
+	fs.StringVar(&c.components, "es_component_templates", "", "Comma separated existing component templates the composable index template is composed of")
+	fs.StringVar(&c.tenantLabel, "es_tenant_label", "", "Label whose value routes series to a per-tenant index named es_alias-tenant-<value>")
+	fs.BoolVar(&c.indexDaily, "es_index_daily", false, "Create daily indexes and disable index management service")
+	fs.StringVar(&c.dailyLayout, "es_daily_index_pattern", "2006-01-02", "Go time layout appended to es_alias to name daily indexes")
+	fs.BoolVar(&c.dailyUTC, "es_daily_index_utc", false, "Name daily indexes after the UTC day of samples instead of the local day")
+	fs.IntVar(&c.precreate, "es_index_daily_precreate", 0, "Seconds before midnight the next daily index is created, 0 to create it on the first write")
+	fs.IntVar(&c.indexShards, "es_index_shards", 5, "Number of Elasticsearch shards to create per index")
+	fs.IntVar(&c.indexReplicas, "es_index_replicas", 1, "Number of Elasticsearch replicas to create per index")
+	fs.IntVar(&c.routingShards, "es_index_routing_shards", 0, "Number of routing shards of created Elasticsearch indexes, allowing later splits")
+	fs.StringVar(&c.indexRefresh, "es_index_refresh_interval", "", "Refresh interval of created Elasticsearch indexes eg 30s")
+	fs.StringVar(&c.indexCodec, "es_index_codec", "", "Compression codec of created Elasticsearch indexes eg best_compression")
+	fs.StringVar(&c.labelMappings, "es_label_mappings", "", "Comma separated label:type mappings overriding keyword, type is keyword, text or none")
+	fs.StringVar(&c.indexMaxAge, "es_index_max_age", "7d", "Max age of Elasticsearch index before rollover")
+	fs.Int64Var(&c.indexMaxDocs, "es_index_max_docs", 1000000, "Max number of docs in Elasticsearch index before rollover")
+	fs.StringVar(&c.indexMaxSize, "es_index_max_size", "", "Max size of index before rollover eg 5gb")
+	fs.StringVar(&c.retention, "es_index_retention", "", "Max age of rolled over Elasticsearch index before deletion eg 30d")
+	fs.IntVar(&c.checkInterval, "es_index_check_interval", 300, "Period in seconds between evaluations of the rollover conditions")
+	fs.BoolVar(&c.dataStream, "es_use_datastream", false, "Write to an Elasticsearch data stream named after es_alias, requires 7.9+")
+	fs.BoolVar(&c.useILM, "es_use_ilm", false, "Manage indexes with an Elasticsearch ILM policy instead of adapter rollover")
+	fs.StringVar(&c.ilmPolicy, "es_ilm_policy", "", "Name of an existing ILM policy attached to created indexes")
+	fs.IntVar(&c.searchMaxDocs, "es_search_max_docs", 1000, "Max number of docs returned per Elasticsearch search page")
+	fs.IntVar(&c.searchLimit, "es_search_max_results", 100000, "Max number of docs returned for a query, paged by es_search_max_docs, 0 for unlimited")
+	fs.IntVar(&c.downsample, "es_read_downsample", 0, "Average remote read results into this many points per series, 0 to disable")
+	fs.IntVar(&c.readConc, "es_read_concurrency", 0, "Max remote read requests searching Elasticsearch at once, excess requests get 503, 0 for no limit")
+	fs.IntVar(&c.readWorkers, "es_read_workers", 1, "Number of queries of a remote read request searched concurrently")
+	fs.IntVar(&c.cacheSize, "es_read_cache_size", 0, "Number of remote read query results cached in memory, 0 to disable the cache")
+	fs.IntVar(&c.cacheTTL, "es_read_cache_ttl", 10, "Seconds a cached remote read query result is reused for identical queries")
+	fs.BoolVar(&c.sniffEnabled, "es_sniff", false, "Enable Elasticsearch sniffing")
+	fs.BoolVar(&c.gzipEnabled, "es_gzip", false, "Gzip compress request bodies sent to Elasticsearch, trading adapter CPU for network usage")
+	fs.StringVar(&c.webAddr, "web_listen_address", ":8000", "Address to listen on for remote read and write requests")
+	fs.IntVar(&c.readTimeout, "web_read_timeout", 30, "Timeout in seconds for reading remote read and write requests, 0 for no timeout")
+	fs.IntVar(&c.writeTimeout, "web_write_timeout", 30, "Timeout in seconds for handling and answering remote read and write requests, 0 for no timeout")
+	fs.IntVar(&c.idleTimeout, "web_idle_timeout", 120, "Timeout in seconds for idle keep-alive connections, 0 for no timeout")
+	fs.Int64Var(&c.maxBody, "web_max_body_bytes", 32<<20, "Max size in bytes of compressed remote read and write request bodies, 0 for no limit")
+	fs.StringVar(&c.webTLSCert, "web_tls_cert", "", "PEM certificate to serve remote read and write requests over TLS")
+	fs.StringVar(&c.webTLSKey, "web_tls_key", "", "PEM private key of web_tls_cert")
+	fs.StringVar(&c.webUser, "web_auth_user", "", "User required by basic auth on remote read and write requests, disabled when empty")
+	fs.StringVar(&c.webPass, "web_auth_password", "", "Password required by basic auth on remote read and write requests")
+	fs.StringVar(&c.webPassFile, "web_auth_password_file", "", "File containing web_auth_password")
+	fs.StringVar(&c.adminUser, "admin_auth_user", "", "User required by basic auth on the admin endpoints but the probes, disabled when empty")
+	fs.StringVar(&c.adminPass, "admin_auth_password", "", "Password required by basic auth on the admin endpoints")
+	fs.StringVar(&c.adminPassFile, "admin_auth_password_file", "", "File containing admin_auth_password")
+	fs.BoolVar(&c.metricsAuth, "metrics_auth", true, "Require the admin, or with single_port the web, basic auth on /metrics")
+	fs.StringVar(&c.adminAddr, "admin_listen_address", ":9000", "Address to listen on for metrics and health checks")
+	fs.IntVar(&c.shutdownWait, "shutdown_timeout", 15, "Timeout in seconds for draining requests and then flushing pending samples on shutdown")
+	fs.BoolVar(&c.singlePort, "single_port", false, "Serve the admin endpoints on web_listen_address instead of a separate listener")
+	fs.BoolVar(&c.adminEnabled, "admin_enabled", true, "Start the admin listener serving metrics, health checks and admin endpoints")
+	fs.BoolVar(&c.pprofEnabled, "enable_pprof", false, "Expose Go pprof endpoints on the admin listener")
+	fs.IntVar(&c.statsHealth, "stats_health_interval", 30, "Period in seconds between Elasticsearch cluster health and index stats checks exposed as metrics")
+	fs.BoolVar(&c.statsEnabled, "stats", true, "Expose Prometheus metrics endpoint")
+	fs.StringVar(&c.otelEndpoint, "otel_endpoint", "", "OTLP/HTTP collector endpoint traces are exported to eg http://localhost:4318, tracing is disabled when empty")
+	fs.StringVar(&c.logLevel, "es_log_level", "info", "Log level, one of debug, info, warn or error")
+	fs.StringVar(&c.logFormat, "log_format", "", "Log encoding, json or console, defaults to console when debugging and json otherwise")
+	fs.BoolVar(&c.debug, "debug", false, "Debug logging, same as es_log_level=debug")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// validateConfig checks option ranges and combinations that would otherwise
+// fail confusingly at runtime, returning the first problem found
+func validateConfig(c *config) error {
+	if c.esURL == "" {
+		return errors.New("es_url is required")
+	}
+	for _, u := range strings.Split(c.esURL, ",") {
+		if strings.TrimSpace(u) == "" {
+			return fmt.Errorf("es_url %q contains an empty entry", c.esURL)
+		}
+	}
+	if c.user != "" && c.userFile != "" {
+		return errors.New("es_user and es_user_file are mutually exclusive")
+	}
+	if c.pass != "" && c.passFile != "" {
+		return errors.New("es_password and es_password_file are mutually exclusive")
+	}
+	if c.user == "" && c.userFile == "" && (c.pass != "" || c.passFile != "") {
+		return errors.New("es_password is set but es_user is empty")
+	}
+	if c.apiKeyID != "" && c.apiKey == "" {
+		return errors.New("es_api_key_id is set but es_api_key is empty")
+	}
+	var modes []string
+	if c.user != "" || c.userFile != "" {
+		modes = append(modes, "es_user")
+	}
+	if c.apiKey != "" {
+		modes = append(modes, "es_api_key")
+	}
+	if c.awsSigning {
+		modes = append(modes, "es_aws_signing")
+	}
+	if len(modes) > 1 {
+		return fmt.Errorf("only one Elasticsearch authentication mode may be used, got %s", strings.Join(modes, ", "))
+	}
+	if c.awsSigning && c.awsRegion == "" {
+		return errors.New("aws_region is required when es_aws_signing is enabled")
+	}
+	if (c.clientCert == "") != (c.clientKey == "") {
+		return errors.New("es_client_cert and es_client_key must be set together")
+	}
+	if c.connTimeout < 0 {
+		return fmt.Errorf("es_connect_timeout must not be negative, got %d", c.connTimeout)
+	}
+	if c.reqTimeout < 0 {
+		return fmt.Errorf("es_request_timeout must not be negative, got %d", c.reqTimeout)
+	}
+	if c.maxRetries < 0 {
+		return fmt.Errorf("es_max_retries must not be negative, got %d", c.maxRetries)
+	}
+	if c.retryBackoff < 0 {
+		return fmt.Errorf("es_retry_backoff must not be negative, got %d", c.retryBackoff)
+	}
+	// bulk workers mostly wait on Elasticsearch, more than the CPUs is fine
+	if c.workers < 1 {
+		return fmt.Errorf("es_workers must be at least 1, got %d", c.workers)
+	}
+	if c.readWorkers < 1 {
+		return fmt.Errorf("es_read_workers must be at least 1, got %d", c.readWorkers)
+	}
+	if c.batchMaxAge < 0 {
+		return fmt.Errorf("es_batch_max_age must not be negative, got %d", c.batchMaxAge)
+	}
+	if c.batchMaxDocs < 0 {
+		return fmt.Errorf("es_batch_max_docs must not be negative, got %d", c.batchMaxDocs)
+	}
+	if c.batchMaxSize < 0 {
+		return fmt.Errorf("es_batch_max_size must not be negative, got %d", c.batchMaxSize)
+	}
+	if c.maxQueued < 0 {
+		return fmt.Errorf("es_max_queued_samples must not be negative, got %d", c.maxQueued)
+	}
+	if c.docModel != elasticsearch.DocModelSample && c.docModel != elasticsearch.DocModelSeries {
+		return fmt.Errorf("es_doc_model must be %s or %s, got %q", elasticsearch.DocModelSample, elasticsearch.DocModelSeries, c.docModel)
+	}
+	if c.docModel == elasticsearch.DocModelSeries && c.downsample > 0 {
+		return fmt.Errorf("es_read_downsample is not supported with es_doc_model=%s", elasticsearch.DocModelSeries)
+	}
+	switch c.writeRefresh {
+	case "", "false", "true", "wait_for":
+	default:
+		return fmt.Errorf("es_write_refresh must be false, true or wait_for, got %q", c.writeRefresh)
+	}
+	reserved := map[string]bool{"value": true, "fingerprint": true, "end_timestamp": true, "samples": true, "@timestamp": true}
+	for _, f := range []struct{ flag, name string }{{"es_timestamp_field", c.timeField}, {"es_label_field", c.labelField}} {
+		if f.name == "" || strings.Contains(f.name, ".") || reserved[f.name] {
+			return fmt.Errorf("%s must be a non empty name without dots other than the built in fields, got %q", f.flag, f.name)
+		}
+	}
+	if c.timeField == c.labelField {
+		return fmt.Errorf("es_timestamp_field and es_label_field must differ, both are %q", c.timeField)
+	}
+	if c.labelText != "" {
+		if strings.Contains(c.labelText, ".") || reserved[c.labelText] || c.labelText == c.timeField || c.labelText == c.labelField {
+			return fmt.Errorf("es_label_text_field must be a name without dots other than the document fields, got %q", c.labelText)
+		}
+	}
+	if c.backoffMin <= 0 || c.backoffMax < c.backoffMin {
+		return fmt.Errorf("es_bulk_backoff_min must be positive and at most es_bulk_backoff_max, got %d and %d", c.backoffMin, c.backoffMax)
+	}
+	if c.rejectLimit < 0 || c.rejectPause < 0 {
+		return fmt.Errorf("es_bulk_reject_limit and es_bulk_reject_pause must not be negative, got %d and %d", c.rejectLimit, c.rejectPause)
+	}
+	if c.filterFile != "" && (c.dropRegex != "" || c.keepRegex != "") {
+		return errors.New("es_write_filter_file and es_write_drop_regex or es_write_keep_regex are mutually exclusive")
+	}
+	if c.nestedLabels && c.labelMappings != "" {
+		return errors.New("es_label_mappings cannot be used with es_nested_labels, all nested label values are keywords")
+	}
+	if c.templateName != "" && (strings.TrimSpace(c.templateName) != c.templateName || strings.ContainsAny(c.templateName, " ,/*?\"<>|")) {
+		return fmt.Errorf("es_template_name must be a name without spaces or any of ,/*?\"<>|, got %q", c.templateName)
+	}
+	switch c.templateAPI {
+	case "auto", "composable":
+	case "legacy":
+		if c.dataStream {
+			return errors.New("es_use_datastream requires the composable es_template_api")
+		}
+		if c.components != "" {
+			return errors.New("es_component_templates requires the composable es_template_api")
+		}
+	default:
+		return fmt.Errorf("es_template_api must be auto, legacy or composable, got %q", c.templateAPI)
+	}
+	for _, name := range componentTemplates(c.components) {
+		if name == "" || strings.ContainsAny(name, " ,/*?\"<>|\\") {
+			return fmt.Errorf("es_component_templates must be comma separated names without spaces or any of /*?\"<>|\\, got %q", c.components)
+		}
+	}
+	if c.sampleRatio <= 0 || c.sampleRatio > 1 {
+		return fmt.Errorf("es_write_sample_ratio must be above 0 and at most 1, got %g", c.sampleRatio)
+	}
+	if c.maxSampleAge < 0 {
+		return fmt.Errorf("es_write_max_sample_age must not be negative, got %d", c.maxSampleAge)
+	}
+	if c.maxFuture < 0 {
+		return fmt.Errorf("es_write_max_sample_future must not be negative, got %d", c.maxFuture)
+	}
+	if c.maxLabelNames < 0 {
+		return fmt.Errorf("es_max_label_names must not be negative, got %d", c.maxLabelNames)
+	}
+	if c.indexShards < 1 {
+		return fmt.Errorf("es_index_shards must be at least 1, got %d", c.indexShards)
+	}
+	if c.indexReplicas < 0 {
+		return fmt.Errorf("es_index_replicas must not be negative, got %d", c.indexReplicas)
+	}
+	if c.routingShards < 0 {
+		return fmt.Errorf("es_index_routing_shards must not be negative, got %d", c.routingShards)
+	}
+	if c.indexMaxDocs < 0 {
+		return fmt.Errorf("es_index_max_docs must not be negative, got %d", c.indexMaxDocs)
+	}
+	if c.checkInterval < 1 {
+		return fmt.Errorf("es_index_check_interval must be at least 1, got %d", c.checkInterval)
+	}
+	if c.searchMaxDocs < 1 {
+		return fmt.Errorf("es_search_max_docs must be at least 1, got %d", c.searchMaxDocs)
+	}
+	if c.searchLimit < 0 {
+		return fmt.Errorf("es_search_max_results must not be negative, got %d", c.searchLimit)
+	}
+	if c.downsample < 0 {
+		return fmt.Errorf("es_read_downsample must not be negative, got %d", c.downsample)
+	}
+	if c.readConc < 0 {
+		return fmt.Errorf("es_read_concurrency must not be negative, got %d", c.readConc)
+	}
+	if c.cacheSize < 0 {
+		return fmt.Errorf("es_read_cache_size must not be negative, got %d", c.cacheSize)
+	}
+	if c.cacheSize > 0 && c.cacheTTL < 1 {
+		return fmt.Errorf("es_read_cache_ttl must be at least 1, got %d", c.cacheTTL)
+	}
+	if c.statsEnabled && c.statsHealth < 1 {
+		return fmt.Errorf("stats_health_interval must be at least 1, got %d", c.statsHealth)
+	}
+	if c.useILM && c.ilmPolicy == "" {
+		return errors.New("es_ilm_policy is required when es_use_ilm is enabled")
+	}
+	// tenant indexes are created on first write outside the write alias
+	if c.tenantLabel != "" {
+		if c.dataStream {
+			return errors.New("es_tenant_label is not supported with es_use_datastream")
+		}
+		if c.retention != "" {
+			return errors.New("es_tenant_label is not supported with es_index_retention")
+		}
+		if c.useILM {
+			return errors.New("es_tenant_label is not supported with es_use_ilm")
+		}
+	}
+	if c.precreate < 0 || c.precreate >= 24*60*60 {
+		return fmt.Errorf("es_index_daily_precreate must be between 0 and a day, got %d", c.precreate)
+	}
+	if c.precreate > 0 && !c.indexDaily {
+		return errors.New("es_index_daily_precreate requires es_index_daily")
+	}
+	if c.dataStream && c.indexDaily {
+		return errors.New("es_use_datastream and es_index_daily are mutually exclusive")
+	}
+	// daily indexes are never rolled over or managed by the index service
+	if c.indexDaily && !c.useILM {
+		if c.indexMaxSize != "" {
+			return errors.New("es_index_max_size has no effect with es_index_daily")
+		}
+		if c.retention != "" {
+			return errors.New("es_index_retention has no effect with es_index_daily")
+		}
+	}
+	if c.readTimeout < 0 {
+		return fmt.Errorf("web_read_timeout must not be negative, got %d", c.readTimeout)
+	}
+	if c.writeTimeout < 0 {
+		return fmt.Errorf("web_write_timeout must not be negative, got %d", c.writeTimeout)
+	}
+	if c.idleTimeout < 0 {
+		return fmt.Errorf("web_idle_timeout must not be negative, got %d", c.idleTimeout)
+	}
+	if c.shutdownWait < 1 {
+		return fmt.Errorf("shutdown_timeout must be at least 1, got %d", c.shutdownWait)
+	}
+	if c.maxBody < 0 {
+		return fmt.Errorf("web_max_body_bytes must not be negative, got %d", c.maxBody)
+	}
+	if (c.webTLSCert == "") != (c.webTLSKey == "") {
+		return errors.New("web_tls_cert and web_tls_key must be set together")
+	}
+	if c.webPass != "" && c.webPassFile != "" {
+		return errors.New("web_auth_password and web_auth_password_file are mutually exclusive")
+	}
+	if c.webUser == "" && (c.webPass != "" || c.webPassFile != "") {
+		return errors.New("web_auth_password is set but web_auth_user is empty")
+	}
+	if c.webUser != "" && c.webPass == "" && c.webPassFile == "" {
+		return errors.New("web_auth_user requires web_auth_password or web_auth_password_file")
+	}
+	if c.adminPass != "" && c.adminPassFile != "" {
+		return errors.New("admin_auth_password and admin_auth_password_file are mutually exclusive")
+	}
+	if c.adminUser == "" && (c.adminPass != "" || c.adminPassFile != "") {
+		return errors.New("admin_auth_password is set but admin_auth_user is empty")
+	}
+	if c.adminUser != "" && c.adminPass == "" && c.adminPassFile == "" {
+		return errors.New("admin_auth_user requires admin_auth_password or admin_auth_password_file")
+	}
+	if c.singlePort && !c.adminEnabled {
+		return errors.New("single_port serves the admin endpoints on the web listener, it cannot be combined with admin_enabled=false")
+	}
+	if c.singlePort && c.pprofEnabled {
+		return errors.New("enable_pprof requires the admin listener, pprof is never served on the web listener with single_port")
+	}
+	if c.otelEndpoint != "" {
+		if u, err := url.Parse(c.otelEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("otel_endpoint must be an http or https URL, got %q", c.otelEndpoint)
+		}
+	}
+	if c.adminEnabled && !c.singlePort && c.webAddr == c.adminAddr {
+		return fmt.Errorf("web_listen_address and admin_listen_address must differ, both are %q", c.webAddr)
+	}
+	return nil
+}
+
+// resolveCredentials replaces the users and passwords with the contents of
+// their files, if set
+func resolveCredentials(c *config) error {
+	var err error
+	if c.userFile != "" {
+		if c.user, err = readSecret(c.userFile); err != nil {
+			return fmt.Errorf("reading es_user_file: %s", err)
+		}
+	}
+	if c.passFile != "" {
+		if c.pass, err = readSecret(c.passFile); err != nil {
+			return fmt.Errorf("reading es_password_file: %s", err)
+		}
+	}
+	if c.webPassFile != "" {
+		if c.webPass, err = readSecret(c.webPassFile); err != nil {
+			return fmt.Errorf("reading web_auth_password_file: %s", err)
+		}
+	}
+	if c.adminPassFile != "" {
+		if c.adminPass, err = readSecret(c.adminPassFile); err != nil {
+			return fmt.Errorf("reading admin_auth_password_file: %s", err)
+		}
+	}
+	return nil
+}
+
+// readSecret returns the contents of path without trailing newlines, which
+// most editors and secret mounts add
+func readSecret(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// componentTemplates splits the es_component_templates flag
+func componentTemplates(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/pwillie/prometheus-es-adapter/pkg/elasticsearch"
+)
+
+// validConfig returns the flag defaults, which pass validation
+func validConfig() *config {
+	return &config{
+		esURL:         "http://localhost:9200",
+		connTimeout:   5,
+		retryBackoff:  100,
+		workers:       1,
+		batchMaxAge:   10,
+		batchMaxDocs:  1000,
+		batchMaxSize:  4096,
+		backoffMin:    200,
+		backoffMax:    10000,
+		rejectPause:   10,
+		docModel:      elasticsearch.DocModelSample,
+		timeField:     "timestamp",
+		labelField:    "label",
+		sampleRatio:   1,
+		indexAlias:    "prom-metrics",
+		templateAPI:   "auto",
+		dailyLayout:   "2006-01-02",
+		indexShards:   5,
+		indexReplicas: 1,
+		indexMaxAge:   "7d",
+		indexMaxDocs:  1000000,
+		checkInterval: 300,
+		searchMaxDocs: 1000,
+		searchLimit:   100000,
+		readWorkers:   1,
+		cacheTTL:      10,
+		webAddr:       ":8000",
+		readTimeout:   30,
+		writeTimeout:  30,
+		idleTimeout:   120,
+		maxBody:       32 << 20,
+		adminAddr:     ":9000",
+		shutdownWait:  15,
+		adminEnabled:  true,
+		statsHealth:   30,
+		statsEnabled:  true,
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(c *config)
+		want   string
+	}{
+		{"defaults", func(c *config) {}, ""},
+		{"no url", func(c *config) { c.esURL = "" }, "es_url is required"},
+		{"empty url entry", func(c *config) { c.esURL = "http://a:9200,,http://b:9200" }, "contains an empty entry"},
+		{"user and user file", func(c *config) { c.user, c.userFile = "u", "/u" }, "es_user and es_user_file"},
+		{"password and password file", func(c *config) { c.user, c.pass, c.passFile = "u", "p", "/p" }, "es_password and es_password_file"},
+		{"password without user", func(c *config) { c.pass = "p" }, "es_password is set but es_user is empty"},
+		{"api key id without key", func(c *config) { c.apiKeyID = "id" }, "es_api_key_id is set"},
+		{"user and api key", func(c *config) { c.user, c.pass, c.apiKey = "u", "p", "k" }, "only one Elasticsearch authentication mode"},
+		{"aws without region", func(c *config) { c.awsSigning = true }, "aws_region is required"},
+		{"client cert without key", func(c *config) { c.clientCert = "/cert" }, "es_client_cert and es_client_key"},
+		{"negative connect timeout", func(c *config) { c.connTimeout = -1 }, "es_connect_timeout"},
+		{"negative request timeout", func(c *config) { c.reqTimeout = -1 }, "es_request_timeout"},
+		{"negative retries", func(c *config) { c.maxRetries = -1 }, "es_max_retries"},
+		{"negative retry backoff", func(c *config) { c.retryBackoff = -1 }, "es_retry_backoff"},
+		{"no workers", func(c *config) { c.workers = 0 }, "es_workers"},
+		{"workers above GOMAXPROCS", func(c *config) { c.workers = runtime.GOMAXPROCS(0) + 1 }, ""},
+		{"no read workers", func(c *config) { c.readWorkers = 0 }, "es_read_workers"},
+		{"negative batch age", func(c *config) { c.batchMaxAge = -1 }, "es_batch_max_age"},
+		{"negative batch docs", func(c *config) { c.batchMaxDocs = -1 }, "es_batch_max_docs"},
+		{"negative batch size", func(c *config) { c.batchMaxSize = -1 }, "es_batch_max_size"},
+		{"negative queued samples", func(c *config) { c.maxQueued = -1 }, "es_max_queued_samples"},
+		{"unknown doc model", func(c *config) { c.docModel = "per-metric" }, "es_doc_model must be"},
+		{"series docs downsampled", func(c *config) { c.docModel, c.downsample = elasticsearch.DocModelSeries, 10 }, "es_read_downsample is not supported"},
+		{"unknown refresh", func(c *config) { c.writeRefresh = "later" }, "es_write_refresh"},
+		{"empty timestamp field", func(c *config) { c.timeField = "" }, "es_timestamp_field must be"},
+		{"dotted label field", func(c *config) { c.labelField = "labels.all" }, "es_label_field must be"},
+		{"reserved label field", func(c *config) { c.labelField = "value" }, "es_label_field must be"},
+		{"same timestamp and label fields", func(c *config) { c.labelField = "timestamp" }, "must differ"},
+		{"label text field is the label field", func(c *config) { c.labelText = "label" }, "es_label_text_field"},
+		{"no bulk backoff", func(c *config) { c.backoffMin = 0 }, "es_bulk_backoff_min"},
+		{"bulk backoff max below min", func(c *config) { c.backoffMax = 100 }, "es_bulk_backoff_min"},
+		{"negative reject limit", func(c *config) { c.rejectLimit = -1 }, "es_bulk_reject_limit"},
+		{"negative reject pause", func(c *config) { c.rejectPause = -1 }, "es_bulk_reject_limit"},
+		{"filter file and regex", func(c *config) { c.filterFile, c.dropRegex = "/filter", "^go_" }, "es_write_filter_file"},
+		{"nested labels with mappings", func(c *config) { c.nestedLabels, c.labelMappings = true, "msg:text" }, "es_label_mappings"},
+		{"template name with a space", func(c *config) { c.templateName = "prom metrics" }, "es_template_name"},
+		{"legacy templates with data stream", func(c *config) { c.templateAPI, c.dataStream = "legacy", true }, "es_use_datastream requires"},
+		{"legacy templates with components", func(c *config) { c.templateAPI, c.components = "legacy", "mappings" }, "es_component_templates requires"},
+		{"unknown template api", func(c *config) { c.templateAPI = "v2" }, "es_template_api"},
+		{"empty component template", func(c *config) { c.components = "mappings,,settings" }, "es_component_templates must be"},
+		{"no sample ratio", func(c *config) { c.sampleRatio = 0 }, "es_write_sample_ratio"},
+		{"sample ratio above 1", func(c *config) { c.sampleRatio = 1.5 }, "es_write_sample_ratio"},
+		{"negative sample age", func(c *config) { c.maxSampleAge = -1 }, "es_write_max_sample_age"},
+		{"negative sample future", func(c *config) { c.maxFuture = -1 }, "es_write_max_sample_future"},
+		{"negative label names", func(c *config) { c.maxLabelNames = -1 }, "es_max_label_names"},
+		{"no shards", func(c *config) { c.indexShards = 0 }, "es_index_shards"},
+		{"negative replicas", func(c *config) { c.indexReplicas = -1 }, "es_index_replicas"},
+		{"negative routing shards", func(c *config) { c.routingShards = -1 }, "es_index_routing_shards"},
+		{"negative index docs", func(c *config) { c.indexMaxDocs = -1 }, "es_index_max_docs"},
+		{"no check interval", func(c *config) { c.checkInterval = 0 }, "es_index_check_interval"},
+		{"no search docs", func(c *config) { c.searchMaxDocs = 0 }, "es_search_max_docs"},
+		{"negative search results", func(c *config) { c.searchLimit = -1 }, "es_search_max_results"},
+		{"negative downsample", func(c *config) { c.downsample = -1 }, "es_read_downsample must not"},
+		{"negative read concurrency", func(c *config) { c.readConc = -1 }, "es_read_concurrency"},
+		{"negative cache size", func(c *config) { c.cacheSize = -1 }, "es_read_cache_size"},
+		{"cache without ttl", func(c *config) { c.cacheSize, c.cacheTTL = 100, 0 }, "es_read_cache_ttl"},
+		{"stats without health interval", func(c *config) { c.statsHealth = 0 }, "stats_health_interval"},
+		{"ilm without policy", func(c *config) { c.useILM = true }, "es_ilm_policy is required"},
+		{"tenants with data stream", func(c *config) { c.tenantLabel, c.dataStream = "tenant", true }, "es_tenant_label is not supported with es_use_datastream"},
+		{"tenants with retention", func(c *config) { c.tenantLabel, c.retention = "tenant", "30d" }, "es_tenant_label is not supported with es_index_retention"},
+		{"tenants with ilm", func(c *config) { c.tenantLabel, c.useILM, c.ilmPolicy = "tenant", true, "metrics" }, "es_tenant_label is not supported with es_use_ilm"},
+		{"precreate a day ahead", func(c *config) { c.indexDaily, c.precreate = true, 24*60*60 }, "es_index_daily_precreate must be"},
+		{"precreate without daily indexes", func(c *config) { c.precreate = 60 }, "es_index_daily_precreate requires"},
+		{"data stream with daily indexes", func(c *config) { c.dataStream, c.indexDaily = true, true }, "es_use_datastream and es_index_daily"},
+		{"daily indexes with max size", func(c *config) { c.indexDaily, c.indexMaxSize = true, "5gb" }, "es_index_max_size has no effect"},
+		{"daily indexes with retention", func(c *config) { c.indexDaily, c.retention = true, "30d" }, "es_index_retention has no effect"},
+		{"negative web read timeout", func(c *config) { c.readTimeout = -1 }, "web_read_timeout"},
+		{"negative web write timeout", func(c *config) { c.writeTimeout = -1 }, "web_write_timeout"},
+		{"negative web idle timeout", func(c *config) { c.idleTimeout = -1 }, "web_idle_timeout"},
+		{"no shutdown timeout", func(c *config) { c.shutdownWait = 0 }, "shutdown_timeout"},
+		{"negative max body", func(c *config) { c.maxBody = -1 }, "web_max_body_bytes"},
+		{"web tls key without cert", func(c *config) { c.webTLSKey = "/key" }, "web_tls_cert and web_tls_key"},
+		{"web password and password file", func(c *config) { c.webUser, c.webPass, c.webPassFile = "u", "p", "/p" }, "web_auth_password and web_auth_password_file"},
+		{"web password without user", func(c *config) { c.webPass = "p" }, "web_auth_password is set"},
+		{"web user without password", func(c *config) { c.webUser = "u" }, "web_auth_user requires"},
+		{"admin password and password file", func(c *config) { c.adminUser, c.adminPass, c.adminPassFile = "u", "p", "/p" }, "admin_auth_password and admin_auth_password_file"},
+		{"admin password without user", func(c *config) { c.adminPassFile = "/p" }, "admin_auth_password is set"},
+		{"admin user without password", func(c *config) { c.adminUser = "u" }, "admin_auth_user requires"},
+		{"otel endpoint without scheme", func(c *config) { c.otelEndpoint = "localhost:4318" }, "otel_endpoint"},
+		{"otel endpoint without host", func(c *config) { c.otelEndpoint = "http://" }, "otel_endpoint"},
+		{"single port without admin", func(c *config) { c.singlePort, c.adminEnabled = true, false }, "single_port serves the admin endpoints"},
+		{"single port with pprof", func(c *config) { c.singlePort, c.pprofEnabled = true, true }, "enable_pprof requires"},
+		{"same web and admin address", func(c *config) { c.adminAddr = ":8000" }, "must differ"},
+		{"single port on the web address", func(c *config) { c.singlePort, c.adminAddr = true, ":8000" }, ""},
+		{"no admin on the web address", func(c *config) { c.adminEnabled, c.adminAddr = false, ":8000" }, ""},
+	}
+	for _, test := range tests {
+		c := validConfig()
+		test.mutate(c)
+		err := validateConfig(c)
+		switch {
+		case test.want == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		case test.want != "" && err == nil:
+			t.Errorf("%s: got no error, want %q", test.name, test.want)
+		case test.want != "" && !strings.Contains(err.Error(), test.want):
+			t.Errorf("%s: got %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestResolveCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// secret mounts and editors leave trailing newlines
+	files := map[string]string{"user": "elastic\n", "password": "s3cret\r\n", "web": "web\n", "admin": "admin"}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := validConfig()
+	c.userFile = filepath.Join(dir, "user")
+	c.passFile = filepath.Join(dir, "password")
+	c.webPassFile = filepath.Join(dir, "web")
+	c.adminPassFile = filepath.Join(dir, "admin")
+	if err := resolveCredentials(c); err != nil {
+		t.Fatal(err)
+	}
+	if c.user != "elastic" || c.pass != "s3cret" || c.webPass != "web" || c.adminPass != "admin" {
+		t.Errorf("got user %q, password %q, web %q, admin %q, want them read without newlines", c.user, c.pass, c.webPass, c.adminPass)
+	}
+
+	c = validConfig()
+	c.user, c.pass = "inline", "inline"
+	if err := resolveCredentials(c); err != nil || c.user != "inline" || c.pass != "inline" {
+		t.Errorf("got %q, %q, %v, want the inline credentials kept without files", c.user, c.pass, err)
+	}
+
+	c = validConfig()
+	c.passFile = filepath.Join(dir, "missing")
+	if err := resolveCredentials(c); err == nil || !strings.Contains(err.Error(), "es_password_file") {
+		t.Errorf("got error %v, want the missing es_password_file reported", err)
+	}
+}
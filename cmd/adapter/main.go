@@ -4,17 +4,17 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/TV4/graceful"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
 	gorilla "github.com/gorilla/handlers"
-	"github.com/namsral/flag"
 	"github.com/pwillie/prometheus-es-adapter/pkg/elasticsearch"
 	"github.com/pwillie/prometheus-es-adapter/pkg/handlers"
 	"github.com/pwillie/prometheus-es-adapter/pkg/logger"
-	"github.com/sha1sum/aws_signing_client"
+	"github.com/pwillie/prometheus-es-adapter/pkg/tracing"
 	"go.uber.org/zap"
 	elastic "gopkg.in/olivere/elastic.v6"
 )
@@ -27,88 +27,249 @@ var (
 )
 
 func main() {
-	var (
-		url = flag.String("es_url", "http://localhost:9200", "Elasticsearch URL.")
-		// user          = flag.String("es_user", "", "Elasticsearch User.")
-		// pass          = flag.String("es_password", "", "Elasticsearch User Password.")
-		workers       = flag.Int("es_workers", 1, "Number of batch workers.")
-		batchMaxAge   = flag.Int("es_batch_max_age", 10, "Max period in seconds between bulk Elasticsearch insert operations")
-		batchMaxDocs  = flag.Int("es_batch_max_docs", 1000, "Max items for bulk Elasticsearch insert operation")
-		batchMaxSize  = flag.Int("es_batch_max_size", 4096, "Max size in bytes for bulk Elasticsearch insert operation")
-		indexAlias    = flag.String("es_alias", "prom-metrics", "Elasticsearch alias pointing to active write index")
-		indexDaily    = flag.Bool("es_index_daily", false, "Create daily indexes and disable index management service")
-		indexShards   = flag.Int("es_index_shards", 5, "Number of Elasticsearch shards to create per index")
-		indexReplicas = flag.Int("es_index_replicas", 1, "Number of Elasticsearch replicas to create per index")
-		indexMaxAge   = flag.String("es_index_max_age", "7d", "Max age of Elasticsearch index before rollover")
-		indexMaxDocs  = flag.Int64("es_index_max_docs", 1000000, "Max number of docs in Elasticsearch index before rollover")
-		indexMaxSize  = flag.String("es_index_max_size", "", "Max size of index before rollover eg 5gb")
-		searchMaxDocs = flag.Int("es_search_max_docs", 1000, "Max number of docs returned for Elasticsearch search operation")
-		sniffEnabled  = flag.Bool("es_sniff", false, "Enable Elasticsearch sniffing")
-		statsEnabled  = flag.Bool("stats", true, "Expose Prometheus metrics endpoint")
-		debug         = flag.Bool("debug", false, "Debug logging")
-	)
-	flag.Parse()
-
-	log := logger.NewLogger(*debug)
+	cfg := parseFlags()
+
+	if cfg.debug {
+		cfg.logLevel = "debug"
+	}
+	log := logger.NewLogger(cfg.logLevel, cfg.logFormat)
 
 	log.Info(fmt.Sprintf("Starting commit: %+v, build: %+v", Commit, Build))
 
-	if *url == "" {
-		log.Fatal("missing url")
+	if err := validateConfig(cfg); err != nil {
+		log.Fatal("Invalid configuration", zap.Error(err))
+	}
+	if err := resolveCredentials(cfg); err != nil {
+		log.Fatal("Failed to read credentials", zap.Error(err))
+	}
+	var urls []string
+	for _, u := range strings.Split(cfg.esURL, ",") {
+		urls = append(urls, strings.TrimSpace(u))
+	}
+	if cfg.scheme == "" {
+		u, err := url.Parse(urls[0])
+		if err != nil {
+			log.Fatal("Failed to parse es_url", zap.Error(err))
+		}
+		cfg.scheme = u.Scheme
+		if cfg.scheme == "" {
+			cfg.scheme = "http"
+		}
+	}
+	if cfg.useILM {
+		if cfg.indexDaily {
+			log.Warn("es_index_daily is ignored when es_use_ilm is enabled")
+			cfg.indexDaily = false
+		}
+	} else {
+		cfg.ilmPolicy = ""
+	}
+	mappings, err := elasticsearch.ParseLabelMappings(cfg.labelMappings)
+	if err != nil {
+		log.Fatal("Invalid es_label_mappings", zap.Error(err))
+	}
+	seriesDocs := cfg.docModel == elasticsearch.DocModelSeries
+	fields := elasticsearch.FieldNames{Timestamp: cfg.timeField, Label: cfg.labelField, Nested: cfg.nestedLabels}
+	var filter *elasticsearch.Filter
+	if cfg.filterFile != "" {
+		filter, err = elasticsearch.LoadFilter(cfg.filterFile)
+	} else {
+		filter, err = elasticsearch.NewFilter(cfg.dropRegex, cfg.keepRegex)
+	}
+	if err != nil {
+		log.Fatal("Invalid write filter", zap.Error(err))
+	}
+	sampler, err := elasticsearch.NewSampler(cfg.sampleRatio, cfg.sampleRegex)
+	if err != nil {
+		log.Fatal("Invalid write sampling", zap.Error(err))
+	}
+
+	if cfg.tlsInsecure {
+		log.Warn("TLS certificate verification is disabled, do not use es_tls_insecure in production",
+			zap.Bool("es_ca_file_ignored", cfg.caFile != ""))
 	}
 
 	ctx := context.TODO()
 
-	creds := credentials.NewEnvCredentials()
-	signer := v4.NewSigner(creds)
-	awsClient, err := aws_signing_client.New(signer, nil, "es", os.Getenv("AWS_REGION"))
+	if cfg.processorName == "" {
+		cfg.processorName, _ = os.Hostname()
+	}
+	if cfg.userAgent == "" {
+		cfg.userAgent = fmt.Sprintf("prometheus-es-adapter/%s (commit %s)", Build, Commit)
+	}
+	if cfg.writeRefresh == "true" {
+		log.Warn("es_write_refresh=true refreshes after every bulk request and severely limits indexing throughput, consider wait_for")
+	}
+	httpClient, compat, err := newHTTPClient(cfg)
+	if err != nil {
+		log.Fatal("Failed to create Elasticsearch HTTP client", zap.Bool("aws_signing", cfg.awsSigning), zap.Error(err))
+	}
 
-	client, err := elastic.NewClient(
-		elastic.SetURL(*url),
-		elastic.SetScheme("https"),
-		elastic.SetHttpClient(awsClient),
-		elastic.SetSniff(*sniffEnabled),
-	)
+	client, err := elastic.NewClient(clientOptions(cfg, urls, httpClient)...)
 	if err != nil {
 		log.Fatal("Failed to create elastic client", zap.Error(err))
 	}
 	defer client.Stop()
 
+	info, err := elasticsearch.GetClusterInfo(ctx, client)
+	if err != nil {
+		log.Fatal("Failed to detect Elasticsearch version", zap.Error(err))
+	}
+	version := info.String()
+	typeless, err := info.Typeless()
+	if err != nil {
+		log.Fatal("Failed to detect Elasticsearch version", zap.Error(err))
+	}
+	if typeless {
+		compat.Enable()
+	}
+	log.Info("Detected Elasticsearch version", zap.String("version", version))
+	if cfg.dataStream && !typeless {
+		log.Fatal("es_use_datastream requires Elasticsearch 7.9 or later", zap.String("version", version))
+	}
+	composable, err := info.ComposableTemplates()
+	if err != nil {
+		log.Fatal("Failed to detect Elasticsearch version", zap.Error(err))
+	}
+	switch cfg.templateAPI {
+	case "legacy":
+		composable = false
+	case "composable":
+		if !composable {
+			log.Fatal("Composable index templates require Elasticsearch 7.8 or later", zap.String("version", version))
+		}
+	}
+	if cfg.components != "" && !composable {
+		log.Fatal("es_component_templates requires Elasticsearch 7.8 or later", zap.String("version", version))
+	}
+	if cfg.useILM && info.IsOpenSearch() {
+		// OpenSearch replaced ILM with ISM and rejects the index.lifecycle settings
+		log.Fatal("es_use_ilm is not supported by OpenSearch, attach an ISM policy instead", zap.String("version", version))
+	}
+
 	err = elasticsearch.EnsureIndexTemplate(ctx, client, &elasticsearch.IndexTemplateConfig{
-		Alias:    *indexAlias,
-		Shards:   *indexShards,
-		Replicas: *indexReplicas,
+		Alias:           cfg.indexAlias,
+		Name:            cfg.templateName,
+		Shards:          cfg.indexShards,
+		Replicas:        cfg.indexReplicas,
+		RoutingShards:   cfg.routingShards,
+		RefreshInterval: cfg.indexRefresh,
+		Codec:           cfg.indexCodec,
+		LabelMappings:   mappings,
+		LabelText:       cfg.labelText,
+		ILMPolicy:       cfg.ilmPolicy,
+		Typeless:        typeless,
+		DataStream:      cfg.dataStream,
+		Composable:      composable,
+		Components:      componentTemplates(cfg.components),
+		SeriesDocs:      seriesDocs,
+		Fields:          fields,
 	})
 	if err != nil {
 		log.Fatal("Failed to create index template", zap.Error(err))
 	}
 
-	if !*indexDaily {
-		_, err = elasticsearch.NewIndexService(ctx, log, client, &elasticsearch.IndexConfig{
-			Alias:   *indexAlias,
-			MaxAge:  *indexMaxAge,
-			MaxDocs: *indexMaxDocs,
-			MaxSize: *indexMaxSize,
+	var indexSvc *elasticsearch.IndexService
+	if cfg.dataStream {
+		if err := elasticsearch.EnsureDataStream(ctx, client, cfg.indexAlias); err != nil {
+			log.Fatal("Failed to create data stream", zap.Error(err))
+		}
+	} else if !cfg.indexDaily {
+		indexSvc, err = elasticsearch.NewIndexService(ctx, log, client, &elasticsearch.IndexConfig{
+			Alias:           cfg.indexAlias,
+			MaxAge:          cfg.indexMaxAge,
+			MaxDocs:         cfg.indexMaxDocs,
+			MaxSize:         cfg.indexMaxSize,
+			RetentionMaxAge: cfg.retention,
+			ILM:             cfg.useILM,
+			CheckInterval:   time.Duration(cfg.checkInterval) * time.Second,
 		})
 		if err != nil {
 			log.Fatal("Failed to create indexer", zap.Error(err))
 		}
 	}
 
+	// background polling is stopped before the final flush
+	pollCtx, stopPolling := context.WithCancel(ctx)
+	defer stopPolling()
+	if cfg.statsEnabled {
+		elasticsearch.NewHealthService(pollCtx, log, client, time.Duration(cfg.statsHealth)*time.Second)
+		elasticsearch.NewIndexStatsService(pollCtx, log, client, cfg.indexAlias, time.Duration(cfg.statsHealth)*time.Second)
+	}
+
+	var tracer *tracing.Tracer
+	if cfg.otelEndpoint != "" {
+		log.Info("Exporting traces", zap.String("endpoint", cfg.otelEndpoint))
+		tracer = tracing.NewTracer(log, cfg.otelEndpoint, "prometheus-es-adapter")
+		// deferred first so the spans of the last bulk flush are exported
+		defer tracer.Close()
+	}
+
 	readCfg := &elasticsearch.ReadConfig{
-		Alias:   *indexAlias,
-		MaxDocs: *searchMaxDocs,
+		Alias:            cfg.indexAlias,
+		MaxDocs:          cfg.searchMaxDocs,
+		MaxResults:       cfg.searchLimit,
+		Stats:            cfg.statsEnabled,
+		DownsamplePoints: cfg.downsample,
+		Typeless:         typeless,
+		DataStream:       cfg.dataStream,
+		SeriesDocs:       seriesDocs,
+		Fields:           fields,
+		TenantLabel:      cfg.tenantLabel,
+		MaxConcurrent:    cfg.readConc,
+		CacheSize:        cfg.cacheSize,
+		CacheTTL:         time.Duration(cfg.cacheTTL) * time.Second,
+		QueryWorkers:     cfg.readWorkers,
+		Tracer:           tracer,
 	}
 	readSvc := elasticsearch.NewReadService(log, client, readCfg)
 
 	writeCfg := &elasticsearch.WriteConfig{
-		Alias:   *indexAlias,
-		Daily:   *indexDaily,
-		MaxAge:  *batchMaxAge,
-		MaxDocs: *batchMaxDocs,
-		MaxSize: *batchMaxSize,
-		Workers: *workers,
-		Stats:   *statsEnabled,
+		Alias:          cfg.indexAlias,
+		Daily:          cfg.indexDaily,
+		MaxAge:         cfg.batchMaxAge,
+		MaxDocs:        cfg.batchMaxDocs,
+		MaxSize:        cfg.batchMaxSize,
+		FlushWorkers:   cfg.workers,
+		Stats:          cfg.statsEnabled,
+		DeadLetterFile: cfg.deadLetter,
+		Typeless:       typeless,
+		DataStream:     cfg.dataStream,
+		Filter:         filter,
+		Sampler:        sampler,
+		SanitizeLabels: cfg.sanitize,
+		DailyLayout:    cfg.dailyLayout,
+		DailyUTC:       cfg.dailyUTC,
+		Pipeline:       cfg.pipeline,
+		MaxQueued:      cfg.maxQueued,
+		DryRun:         cfg.dryRun,
+		Name:           cfg.processorName,
+		SeriesDocs:     seriesDocs,
+		MaxLabelNames:  cfg.maxLabelNames,
+		Metadata:       cfg.storeMetadata,
+		Exemplars:      cfg.exemplars,
+		Fields:         fields,
+		TenantLabel:    cfg.tenantLabel,
+		MaxSampleAge:   time.Duration(cfg.maxSampleAge) * time.Second,
+		MaxFutureSkew:  time.Duration(cfg.maxFuture) * time.Second,
+		DropOutOfRange: cfg.dropRange,
+		BackoffMin:     time.Duration(cfg.backoffMin) * time.Millisecond,
+		BackoffMax:     time.Duration(cfg.backoffMax) * time.Millisecond,
+		RejectLimit:    cfg.rejectLimit,
+		RejectPause:    time.Duration(cfg.rejectPause) * time.Second,
+		PrecreateLead:  time.Duration(cfg.precreate) * time.Second,
+		DedupIDs:       cfg.dedup,
+		Tracer:         tracer,
+	}
+	if indexSvc != nil {
+		writeCfg.MissingAlias = func() {
+			if _, err := indexSvc.EnsureAlias(ctx); err != nil {
+				log.Error("Failed to recreate missing write alias", zap.Error(err))
+			}
+		}
+	}
+	if cfg.dryRun {
+		log.Warn("Dry run enabled, samples are logged at debug level instead of indexed")
 	}
 	writeSvc, err := elasticsearch.NewWriteService(ctx, log, client, writeCfg)
 	if err != nil {
@@ -116,16 +277,197 @@ func main() {
 	}
 	defer writeSvc.Close()
 
-	// Create an "admin" listener on 0.0.0.0:9000
-	go http.ListenAndServe(":9000", handlers.NewAdminRouter(client))
+	// daily indexes are written directly so there is no alias to check
+	readyAlias := cfg.indexAlias
+	if cfg.indexDaily || cfg.dataStream {
+		readyAlias = ""
+	}
+	adminCfg := &handlers.AdminConfig{
+		Alias:        readyAlias,
+		Pprof:        cfg.pprofEnabled,
+		Metrics:      cfg.statsEnabled,
+		MetricsAuth:  cfg.metricsAuth,
+		Index:        indexSvc,
+		AuthUser:     cfg.adminUser,
+		AuthPassword: cfg.adminPass,
+		Version: handlers.VersionInfo{
+			Build:                Build,
+			Commit:               Commit,
+			ElasticsearchVersion: version,
+		},
+	}
+	if cfg.filterFile != "" {
+		adminCfg.Reload = filterReloader(log, cfg.filterFile, writeSvc)
+	}
+	if cfg.storeMetadata {
+		adminCfg.MetadataIndex = elasticsearch.MetadataIndex(cfg.indexAlias)
+	}
+	routerCfg := &handlers.RouterConfig{
+		MaxBodyBytes: cfg.maxBody,
+		AuthUser:     cfg.webUser,
+		AuthPassword: cfg.webPass,
+		Exemplars:    cfg.exemplars,
+		Stats:        cfg.statsEnabled,
+		Tracer:       tracer,
+		Logger:       log,
+	}
+	router, admin := newRouters(cfg, log, writeSvc, readSvc, routerCfg, client, adminCfg)
+	if admin != nil {
+		go http.ListenAndServe(cfg.adminAddr, admin)
+	}
+	shutdownTimeout := time.Duration(cfg.shutdownWait) * time.Second
+	// bounds draining in flight requests, the bulk flush gets the same again
+	graceful.Timeout = shutdownTimeout
+	server := newServer(cfg, log, router)
+	if cfg.webTLSCert != "" {
+		log.Info("Starting web listener", zap.String("address", cfg.webAddr), zap.Bool("tls", true))
+		graceful.ListenAndServeTLS(server, cfg.webTLSCert, cfg.webTLSKey)
+	} else {
+		log.Info("Starting web listener", zap.String("address", cfg.webAddr))
+		graceful.ListenAndServe(server)
+	}
+
+	stopPolling()
+	// the listener no longer accepts writes, flush any buffered samples
+	// before the deferred Close stops the processor
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := writeSvc.Flush(shutdownCtx); err == context.DeadlineExceeded {
+		log.Error("Pending samples were not flushed within shutdown_timeout, dropping them", zap.Duration("timeout", shutdownTimeout))
+		// Close would flush again without a deadline
+		writeSvc.CloseNow()
+	} else if err != nil {
+		log.Error("Failed to flush pending samples", zap.Error(err))
+	}
+	if indexSvc != nil {
+		indexSvc.Close()
+	}
+}
+
+// filterSetter replaces the write filter, implemented by WriteService
+type filterSetter interface {
+	SetFilter(f *elasticsearch.Filter)
+}
+
+// filterReloader returns the admin reload, loading the write filter rules
+// from path into svc.  The filter in use is kept when the rules are invalid.
+func filterReloader(log *zap.Logger, path string, svc filterSetter) func() error {
+	return func() error {
+		filter, err := elasticsearch.LoadFilter(path)
+		if err != nil {
+			log.Error("Failed to reload write filter rules", zap.String("file", path), zap.Error(err))
+			return err
+		}
+		svc.SetFilter(filter)
+		log.Info("Reloaded write filter rules", zap.String("file", path))
+		return nil
+	}
+}
+
+// newRouters returns the handler of the web listener and that of the admin
+// listener, nil when the admin endpoints are disabled or served by the web
+// listener
+func newRouters(cfg *config, log *zap.Logger, writeSvc *elasticsearch.WriteService, readSvc *elasticsearch.ReadService, routerCfg *handlers.RouterConfig, client *elastic.Client, adminCfg *handlers.AdminConfig) (router, admin http.Handler) {
+	switch {
+	case !cfg.adminEnabled:
+		log.Warn("Admin listener disabled, metrics, health checks and admin endpoints are not served")
+		return handlers.NewRouter(writeSvc, readSvc, routerCfg), nil
+	case cfg.singlePort:
+		log.Info("Serving admin endpoints on the web listener")
+		return handlers.NewSinglePortRouter(writeSvc, readSvc, routerCfg, client, adminCfg), nil
+	default:
+		log.Info("Starting admin listener", zap.String("address", cfg.adminAddr))
+		// JSON answers such as /metadata can be large, compress them as the
+		// web listener does
+		admin = gorilla.CompressHandler(handlers.NewAdminRouter(client, adminCfg))
+		return handlers.NewRouter(writeSvc, readSvc, routerCfg), admin
+	}
+}
 
-	graceful.ListenAndServe(&http.Server{
-		Addr: ":8000",
+// newServer returns the web listener serving router, served over TLS by the
+// caller when web_tls_cert is set
+func newServer(cfg *config, log *zap.Logger, router http.Handler) *http.Server {
+	return &http.Server{
+		Addr: cfg.webAddr,
 		Handler: gorilla.RecoveryHandler(gorilla.PrintRecoveryStack(true))(
-			gorilla.CompressHandler(
-				handlers.NewRouter(writeSvc, readSvc),
+			handlers.NewLoggingHandler(log,
+				gorilla.CompressHandler(router),
 			),
 		),
+		ReadTimeout:  time.Duration(cfg.readTimeout) * time.Second,
+		WriteTimeout: time.Duration(cfg.writeTimeout) * time.Second,
+		IdleTimeout:  time.Duration(cfg.idleTimeout) * time.Second,
+	}
+}
+
+// clientOptions returns the options of the elastic client of urls sending
+// its requests with httpClient
+func clientOptions(cfg *config, urls []string, httpClient *http.Client) []elastic.ClientOptionFunc {
+	opts := []elastic.ClientOptionFunc{
+		elastic.SetURL(urls...),
+		elastic.SetScheme(cfg.scheme),
+		elastic.SetSniff(cfg.sniffEnabled),
+		elastic.SetGzip(cfg.gzipEnabled),
+		elastic.SetHttpClient(httpClient),
+		elastic.SetHealthcheckTimeout(time.Duration(cfg.connTimeout) * time.Second),
+		elastic.SetHealthcheckTimeoutStartup(time.Duration(cfg.connTimeout) * time.Second),
+	}
+	if cfg.maxRetries > 0 {
+		opts = append(opts, elastic.SetRetrier(
+			elasticsearch.NewRetrier(cfg.maxRetries, time.Duration(cfg.retryBackoff)*time.Millisecond),
+		))
+	}
+	if cfg.user != "" && cfg.pass != "" {
+		opts = append(opts, elastic.SetBasicAuth(cfg.user, cfg.pass))
+	}
+	return opts
+}
+
+// newHTTPClient returns the client of the Elasticsearch requests, bounding
+// connecting by es_connect_timeout and each request by es_request_timeout,
+// and its compatibility transport to enable once the version is known
+func newHTTPClient(cfg *config) (*http.Client, *elasticsearch.CompatTransport, error) {
+	transport, err := elasticsearch.NewHTTPTransport(&elasticsearch.HTTPConfig{
+		ConnectTimeout:     time.Duration(cfg.connTimeout) * time.Second,
+		CAFile:             cfg.caFile,
+		InsecureSkipVerify: cfg.tlsInsecure,
+		ClientCert:         cfg.clientCert,
+		ClientKey:          cfg.clientKey,
 	})
-	// TODO: graceful shutdown of bulk processor
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating transport: %s", err)
+	}
+	var rt http.RoundTripper = transport
+	if cfg.maxRetries > 0 {
+		// the elastic retrier only sees requests failing without a response
+		rt = &elasticsearch.RetryTransport{
+			Next:    rt,
+			Retrier: elasticsearch.NewRetrier(cfg.maxRetries, time.Duration(cfg.retryBackoff)*time.Millisecond),
+		}
+	}
+	rt = &elasticsearch.UserAgentTransport{Next: rt, UserAgent: cfg.userAgent}
+	if cfg.processorName != "" {
+		rt = &elasticsearch.OpaqueIDTransport{Next: rt, ID: cfg.processorName}
+	}
+	if cfg.apiKey != "" {
+		rt = elasticsearch.NewAPIKeyTransport(rt, cfg.apiKeyID, cfg.apiKey)
+	}
+	// the AWS signer wraps this client so it shares the timeouts
+	httpClient := &http.Client{
+		Transport: rt,
+		Timeout:   time.Duration(cfg.reqTimeout) * time.Second,
+	}
+	if cfg.awsSigning {
+		httpClient, err = awsSigningClient(cfg, httpClient)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	// these wrap the signer so query parameters they add are signed too
+	compat := &elasticsearch.CompatTransport{Next: httpClient.Transport}
+	httpClient.Transport = compat
+	if cfg.writeRefresh != "" {
+		httpClient.Transport = &elasticsearch.RefreshTransport{Next: httpClient.Transport, Refresh: cfg.writeRefresh}
+	}
+	return httpClient, compat, nil
 }
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/namsral/flag"
+	"github.com/prometheus/common/model"
+	"github.com/pwillie/prometheus-es-adapter/pkg/elasticsearch"
+	"github.com/pwillie/prometheus-es-adapter/pkg/handlers"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+func TestAdminCompression(t *testing.T) {
+	adminCfg := &handlers.AdminConfig{Version: handlers.VersionInfo{Build: "1.0"}}
+	_, admin := newRouters(validConfig(), zap.NewNop(), nil, nil, &handlers.RouterConfig{}, nil, adminCfg)
+	if admin == nil {
+		t.Fatal("got no admin handler, want the admin listener enabled by default")
+	}
+	tests := []struct {
+		name     string
+		encoding string
+		want     string
+	}{
+		{"gzip accepted", "gzip", "gzip"},
+		{"not accepted", "", ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/version", nil)
+		if test.encoding != "" {
+			req.Header.Set("Accept-Encoding", test.encoding)
+		}
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+
+		if got := rec.Header().Get("Content-Encoding"); got != test.want {
+			t.Fatalf("%s: got Content-Encoding %q, want %q", test.name, got, test.want)
+		}
+		var body io.Reader = rec.Body
+		if test.want == "gzip" {
+			zr, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+			body = zr
+		}
+		var info handlers.VersionInfo
+		if err := json.NewDecoder(body).Decode(&info); err != nil {
+			t.Fatalf("%s: got undecodable body: %s", test.name, err)
+		}
+		if info.Build != "1.0" {
+			t.Errorf("%s: got build %q, want 1.0", test.name, info.Build)
+		}
+	}
+}
+
+// serve returns the status of a GET of path on h
+func serve(h http.Handler, path string) int {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec.Code
+}
+
+func TestAdminDisabled(t *testing.T) {
+	cfg, err := parseFlagSet(flag.NewFlagSet("adapter", flag.ContinueOnError), []string{"-admin_enabled=false", "-admin_listen_address=:8000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the admin address is unused, it may equal the web address
+	if err := validateConfig(cfg); err != nil {
+		t.Fatalf("got %s, want a valid config without the admin listener", err)
+	}
+	var logs bytes.Buffer
+	logger := zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(&logs), zap.WarnLevel))
+	router, admin := newRouters(cfg, logger, nil, nil, &handlers.RouterConfig{}, nil, &handlers.AdminConfig{})
+	if admin != nil {
+		t.Fatal("got an admin handler, want none started")
+	}
+	if strings.Count(logs.String(), `"msg":"Admin listener disabled`) != 1 {
+		t.Errorf("got logs %q, want the admin listener disabled warning", logs.String())
+	}
+	// the admin endpoints are not moved to the web listener
+	for _, path := range []string{"/metrics", "/version", "/healthz"} {
+		if got := serve(router, path); got != http.StatusNotFound {
+			t.Errorf("got %s status %d, want 404", path, got)
+		}
+	}
+	if got := serve(router, "/write"); got == http.StatusNotFound {
+		t.Error("got /write status 404, want it served")
+	}
+}
+
+func TestHTTPClientTimeout(t *testing.T) {
+	defer awsEnv(map[string]string{"AWS_ACCESS_KEY_ID": "AKID", "AWS_SECRET_ACCESS_KEY": "SECRET"})()
+	release := make(chan struct{})
+	var signed int32
+	// a hung node, the signer always sends https requests
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			atomic.AddInt32(&signed, 1)
+		}
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	for _, awsSigning := range []bool{false, true} {
+		c := validConfig()
+		c.reqTimeout = 1
+		c.tlsInsecure = true
+		c.awsSigning = awsSigning
+		c.awsRegion = "eu-west-1"
+		client, _, err := newHTTPClient(c)
+		if err != nil {
+			t.Fatalf("aws signing %t: %s", awsSigning, err)
+		}
+		start := time.Now()
+		_, err = client.Get(srv.URL)
+		if err, ok := err.(net.Error); !ok || !err.Timeout() {
+			t.Errorf("aws signing %t: got error %v, want a timeout", awsSigning, err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("aws signing %t: request returned after %s, want es_request_timeout", awsSigning, elapsed)
+		}
+	}
+	if atomic.LoadInt32(&signed) != 1 {
+		t.Errorf("got %d signed requests, want the AWS signing request", signed)
+	}
+}
+
+func TestProcessorNameHeader(t *testing.T) {
+	var opaqueID string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		opaqueID = r.Header.Get("X-Opaque-Id")
+	}))
+	defer srv.Close()
+	cfg, err := parseFlagSet(flag.NewFlagSet("adapter", flag.ContinueOnError), []string{"-es_processor_name=adapter-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _, err := newHTTPClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := client.Get(srv.URL + "/_bulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	// tells the bulk tasks of each adapter apart in the tasks API
+	if opaqueID != "adapter-a" {
+		t.Errorf("got X-Opaque-Id %q, want adapter-a", opaqueID)
+	}
+}
+
+func TestClientGzip(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"default", nil, ""},
+		{"es_gzip", []string{"-es_gzip"}, "gzip"},
+	}
+	for _, test := range tests {
+		var encoding, body string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if r.URL.Path != "/_bulk" {
+				return
+			}
+			encoding = r.Header.Get("Content-Encoding")
+			var rd io.Reader = r.Body
+			if encoding == "gzip" {
+				zr, err := gzip.NewReader(r.Body)
+				if err != nil {
+					t.Errorf("%s: %s", test.name, err)
+					return
+				}
+				rd = zr
+			}
+			b, _ := ioutil.ReadAll(rd)
+			body = string(b)
+			w.Write([]byte(`{"items":[{"index":{"_index":"prom-metrics","status":201}}]}`))
+		}))
+		cfg, err := parseFlagSet(flag.NewFlagSet("adapter", flag.ContinueOnError), test.args)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		httpClient, _, err := newHTTPClient(cfg)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		client, err := elastic.NewClient(clientOptions(cfg, []string{srv.URL}, httpClient)...)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		_, err = client.Bulk().Add(elastic.NewBulkIndexRequest().Index("prom-metrics").Type("_doc").Doc(map[string]int{"value": 1})).Do(context.Background())
+		client.Stop()
+		srv.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if encoding != test.want || !strings.Contains(body, `{"value":1}`) {
+			t.Errorf("%s: got Content-Encoding %q, body %q, want %q", test.name, encoding, body, test.want)
+		}
+	}
+}
+
+// fakeFilterSetter records the last filter set
+type fakeFilterSetter struct {
+	filter *elasticsearch.Filter
+}
+
+func (f *fakeFilterSetter) SetFilter(filter *elasticsearch.Filter) {
+	f.filter = filter
+}
+
+func TestFilterReloader(t *testing.T) {
+	f, err := ioutil.TempFile("", "filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	svc := &fakeFilterSetter{}
+	reload := filterReloader(zap.NewNop(), f.Name(), svc)
+	dropped := func(name string) bool {
+		return svc.filter.Drop(model.Metric{model.MetricNameLabel: model.LabelValue(name)})
+	}
+
+	steps := []struct {
+		rules   string
+		err     bool
+		dropped []string
+		kept    []string
+	}{
+		{rules: "drop: go_.*\n", dropped: []string{"go_goroutines"}, kept: []string{"up"}},
+		{rules: "drop: up\n", dropped: []string{"up"}, kept: []string{"go_goroutines"}},
+		// invalid rules keep the filter in use
+		{rules: "drop: (\n", err: true, dropped: []string{"up"}, kept: []string{"go_goroutines"}},
+	}
+	for i, step := range steps {
+		if err := ioutil.WriteFile(f.Name(), []byte(step.rules), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := reload(); (err != nil) != step.err {
+			t.Fatalf("reload %d: got error %v, want error %t", i+1, err, step.err)
+		}
+		for _, name := range step.dropped {
+			if !dropped(name) {
+				t.Errorf("reload %d: got %s kept, want it dropped", i+1, name)
+			}
+		}
+		for _, name := range step.kept {
+			if dropped(name) {
+				t.Errorf("reload %d: got %s dropped, want it kept", i+1, name)
+			}
+		}
+	}
+}
+
+// writeTestCert writes a self signed certificate for 127.0.0.1 and its key
+// to dir
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "adapter"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	for path, block := range map[string]*pem.Block{certFile: {Type: "CERTIFICATE", Bytes: der}, keyFile: {Type: "EC PRIVATE KEY", Bytes: keyDER}} {
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return certFile, keyFile
+}
+
+func TestServerTimeouts(t *testing.T) {
+	tests := []struct {
+		name              string
+		args              []string
+		read, write, idle time.Duration
+	}{
+		{"defaults", nil, 30 * time.Second, 30 * time.Second, 120 * time.Second},
+		{"flags", []string{"-web_read_timeout=5", "-web_write_timeout=10", "-web_idle_timeout=60"}, 5 * time.Second, 10 * time.Second, 60 * time.Second},
+		{"unbounded", []string{"-web_read_timeout=0", "-web_write_timeout=0", "-web_idle_timeout=0"}, 0, 0, 0},
+	}
+	for _, test := range tests {
+		cfg, err := parseFlagSet(flag.NewFlagSet("adapter", flag.ContinueOnError), test.args)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		server := newServer(cfg, zap.NewNop(), http.NotFoundHandler())
+		if server.ReadTimeout != test.read || server.WriteTimeout != test.write || server.IdleTimeout != test.idle {
+			t.Errorf("%s: got read %s, write %s, idle %s, want %s, %s, %s", test.name,
+				server.ReadTimeout, server.WriteTimeout, server.IdleTimeout, test.read, test.write, test.idle)
+		}
+	}
+
+	// a client trickling its headers is disconnected after the read timeout
+	cfg := validConfig()
+	cfg.readTimeout = 1
+	server := newServer(cfg, zap.NewNop(), http.NotFoundHandler())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+	defer server.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("POST /write HTTP/1.1\r\nHost: adapter\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Errorf("got %s, want the connection closed by the server", err)
+	}
+}
+
+func TestServerTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir)
+	router := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	server := newServer(validConfig(), zap.NewNop(), router)
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(ln, certFile, keyFile)
+	defer server.Close()
+
+	pemCert, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(pemCert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	res, err := client.Get("https://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("got %d %q over TLS, want 200 ok", res.StatusCode, body)
+	}
+
+	res, err = http.Get("http://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("got %d for plain HTTP, want 400", res.StatusCode)
+	}
+}
@@ -12,11 +12,13 @@ require (
 	github.com/gorilla/handlers v1.4.0
 	github.com/grpc-ecosystem/grpc-gateway v1.9.0 // indirect
 	github.com/heptiolabs/healthcheck v0.0.0-20180807145615-6ff867650f40
+	github.com/klauspost/compress v1.10.0
 	github.com/mailru/easyjson v0.0.0-20190403194419-1ea4449da983 // indirect
 	github.com/namsral/flag v1.7.4-pre
 	github.com/olivere/elastic v6.2.18+incompatible // indirect
 	github.com/pkg/errors v0.8.1 // indirect
 	github.com/prometheus/client_golang v0.9.3
+	github.com/prometheus/client_model v0.0.0-20190129233127-fd36f4220a90
 	github.com/prometheus/common v0.4.1
 	github.com/prometheus/procfs v0.0.0-20190523193104-a7aeb8df3389 // indirect
 	github.com/prometheus/prometheus v2.5.0+incompatible
@@ -0,0 +1,81 @@
+package elasticsearch
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// queryCache is an LRU cache of read results keyed by the serialized query,
+// entries expire ttl after they were added
+type queryCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key     string
+	series  []*prompb.TimeSeries
+	expires time.Time
+}
+
+func newQueryCache(size int, ttl time.Duration) *queryCache {
+	return &queryCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element, size),
+	}
+}
+
+// cacheKey returns the key of q, covering its matchers, time range and hints
+func cacheKey(q *prompb.Query) (string, error) {
+	b, err := q.Marshal()
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// get returns the unexpired results cached for key
+func (c *queryCache) get(key string) ([]*prompb.TimeSeries, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(e)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return entry.series, true
+}
+
+// add caches series for key, evicting the least recently used entry when full
+func (c *queryCache) add(key string, series []*prompb.TimeSeries) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := time.Now().Add(c.ttl)
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*cacheEntry)
+		entry.series = series
+		entry.expires = expires
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, series: series, expires: expires})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
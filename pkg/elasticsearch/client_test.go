@@ -0,0 +1,308 @@
+package elasticsearch
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+// testCert is a generated certificate and the PEM files holding it
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// newTestCert generates a certificate for 127.0.0.1 named name, signed by ca
+// or a self signed CA when ca is nil, and writes it to dir
+func newTestCert(t *testing.T, dir, name string, ca *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, name+".pem"),
+		keyFile:  filepath.Join(dir, name+"-key.pem"),
+	}
+	writePEM(t, c.certFile, "CERTIFICATE", der)
+	writePEM(t, c.keyFile, "EC PRIVATE KEY", keyDER)
+	return c
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTLSServer starts a server presenting cert, answering with the common
+// name of the client certificate, which it requires signed by clientCA when
+// set
+func newTLSServer(t *testing.T, cert, clientCA *testCert) *httptest.Server {
+	keyPair, err := tls.LoadX509KeyPair(cert.certFile, cert.keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+		}
+	}))
+	// the failed handshakes are expected
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{keyPair}}
+	if clientCA != nil {
+		pool := x509.NewCertPool()
+		pool.AddCert(clientCA.cert)
+		srv.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+		srv.TLS.ClientCAs = pool
+	}
+	srv.StartTLS()
+	return srv
+}
+
+// get requests url through a transport built from config, returning the body
+func get(config *HTTPConfig, url string) (string, error) {
+	transport, err := NewHTTPTransport(config)
+	if err != nil {
+		return "", err
+	}
+	defer transport.CloseIdleConnections()
+	res, err := (&http.Client{Transport: transport}).Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	return string(body), err
+}
+
+func TestHTTPTransportCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, dir, "ca", nil)
+	srv := newTLSServer(t, newTestCert(t, dir, "server", ca), nil)
+	defer srv.Close()
+
+	if _, err := get(&HTTPConfig{}, srv.URL); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("got error %v with the system roots, want the private CA untrusted", err)
+	}
+	if _, err := get(&HTTPConfig{CAFile: ca.certFile}, srv.URL); err != nil {
+		t.Errorf("got error %v with es_ca_file, want the server trusted", err)
+	}
+	other := newTestCert(t, dir, "other", nil)
+	if _, err := get(&HTTPConfig{CAFile: other.certFile}, srv.URL); err == nil {
+		t.Error("got no error with another CA, want the server untrusted")
+	}
+	if _, err := NewHTTPTransport(&HTTPConfig{CAFile: ca.keyFile}); err == nil || !strings.Contains(err.Error(), "no certificates") {
+		t.Errorf("got error %v for a CA file without certificates, want it rejected", err)
+	}
+}
+
+func TestHTTPTransportInsecure(t *testing.T) {
+	transport, err := NewHTTPTransport(&HTTPConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transport.TLSClientConfig != nil {
+		t.Errorf("got TLS config %+v by default, want the Go defaults", transport.TLSClientConfig)
+	}
+	transport, err = NewHTTPTransport(&HTTPConfig{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transport.TLSClientConfig == nil || !transport.TLSClientConfig.InsecureSkipVerify {
+		t.Errorf("got TLS config %+v, want verification skipped", transport.TLSClientConfig)
+	}
+
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := newTLSServer(t, newTestCert(t, dir, "self-signed", nil), nil)
+	defer srv.Close()
+	if _, err := get(&HTTPConfig{InsecureSkipVerify: true}, srv.URL); err != nil {
+		t.Errorf("got error %v with es_tls_insecure, want the self signed server accepted", err)
+	}
+}
+
+func TestHTTPTransportClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, dir, "ca", nil)
+	client := newTestCert(t, dir, "adapter", ca)
+	srv := newTLSServer(t, newTestCert(t, dir, "server", ca), ca)
+	defer srv.Close()
+
+	got, err := get(&HTTPConfig{CAFile: ca.certFile, ClientCert: client.certFile, ClientKey: client.keyFile}, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "adapter" {
+		t.Errorf("got client certificate %q, want adapter", got)
+	}
+	if _, err := get(&HTTPConfig{CAFile: ca.certFile}, srv.URL); err == nil {
+		t.Error("got no error without a client certificate, want the server to refuse the connection")
+	}
+	other := newTestCert(t, dir, "other", nil)
+	if _, err := NewHTTPTransport(&HTTPConfig{ClientCert: client.certFile, ClientKey: other.keyFile}); err == nil || !strings.Contains(err.Error(), "loading client certificate") {
+		t.Errorf("got error %v for a key not matching the certificate, want it rejected", err)
+	}
+}
+
+// sentHeaders returns the headers Elasticsearch receives from a client whose
+// transport is wrapped by wrap
+func sentHeaders(t *testing.T, wrap func(http.RoundTripper) http.RoundTripper) http.Header {
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+	client, err := elastic.NewClient(
+		elastic.SetURL(srv.URL),
+		elastic.SetSniff(false),
+		elastic.SetHealthcheck(false),
+		elastic.SetHttpClient(&http.Client{Transport: wrap(http.DefaultTransport)}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.PerformRequest(context.Background(), elastic.PerformRequestOptions{Method: "GET", Path: "/"}); err != nil {
+		t.Fatal(err)
+	}
+	return header
+}
+
+func TestAPIKeyTransport(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		key  string
+		want string
+	}{
+		{"encoded key", "", "aWQ6c2VjcmV0", "ApiKey aWQ6c2VjcmV0"},
+		{"id and key", "id", "secret", "ApiKey aWQ6c2VjcmV0"},
+	}
+	for _, test := range tests {
+		header := sentHeaders(t, func(next http.RoundTripper) http.RoundTripper {
+			return NewAPIKeyTransport(next, test.id, test.key)
+		})
+		if got := header.Get("Authorization"); got != test.want {
+			t.Errorf("%s: got Authorization %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	NewAPIKeyTransport(&fakeTransport{statuses: []int{200}}, "", "key").RoundTrip(req)
+	if got := req.Header.Get("Authorization"); got != "" {
+		t.Errorf("got Authorization %q set on the caller's request, want it untouched", got)
+	}
+}
+
+func TestUserAgentTransport(t *testing.T) {
+	header := sentHeaders(t, func(next http.RoundTripper) http.RoundTripper { return next })
+	if got := header.Get("User-Agent"); !strings.HasPrefix(got, "elastic/") {
+		t.Fatalf("got User-Agent %q without the transport, want the elastic client default", got)
+	}
+	header = sentHeaders(t, func(next http.RoundTripper) http.RoundTripper {
+		return &UserAgentTransport{Next: next, UserAgent: "prometheus-es-adapter/1.0 (commit abc)"}
+	})
+	if got := header.Get("User-Agent"); got != "prometheus-es-adapter/1.0 (commit abc)" {
+		t.Errorf("got User-Agent %q, want the adapter one", got)
+	}
+}
+
+func TestRefreshTransport(t *testing.T) {
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Path+"?"+r.URL.RawQuery)
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/_bulk") {
+			w.Write([]byte(`{"items":[{"index":{"status":201}}]}`))
+			return
+		}
+		w.Write([]byte(`{"hits":{"total":0,"hits":[]}}`))
+	}))
+	defer srv.Close()
+	client, err := elastic.NewClient(
+		elastic.SetURL(srv.URL),
+		elastic.SetSniff(false),
+		elastic.SetHealthcheck(false),
+		elastic.SetHttpClient(&http.Client{Transport: &RefreshTransport{Refresh: "wait_for"}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	bulk := client.Bulk().Pipeline("p").Add(elastic.NewBulkIndexRequest().Index("prom-metrics").Type("_doc").Doc(map[string]int{"value": 1}))
+	if _, err := bulk.Do(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Search("prom-metrics").Do(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/_bulk?pipeline=p&refresh=wait_for", "/prom-metrics/_search?"}
+	if !reflect.DeepEqual(queries, want) {
+		t.Errorf("got requests %v, want %v", queries, want)
+	}
+}
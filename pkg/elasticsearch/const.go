@@ -1,44 +1,155 @@
 package elasticsearch
 
+import "time"
+
 const sampleType = "sample"
 
+const defaultDailyLayout = "2006-01-02"
+
+// defaultCheckInterval is how often rollover conditions are evaluated by default
+const defaultCheckInterval = 5 * time.Minute
+
+// Document models selected by es_doc_model
+const (
+	// DocModelSample indexes one doc per sample
+	DocModelSample = "per-sample"
+	// DocModelSeries indexes one doc per series and request, with nested samples
+	DocModelSeries = "per-series-nested"
+)
+
+// maxDownsampleSeries caps the number of series returned by a downsampled read
+const maxDownsampleSeries = 10000
+
 const indexCreate = `{
 	"aliases": {
-		"{{.Alias}}": {}
+		{{json .Alias}}: {{if .ILM}}{
+			"is_write_index": true
+		}{{else}}{}{{end}}
 	}
 }`
 
-const indexTemplate = `{
-	"index_patterns": ["{{.Alias}}-*"],
-	"settings": {
+// indexSettings and sampleMapping are shared by the legacy and composable templates
+const indexSettings = `{{define "settings"}}{
 		"number_of_shards": {{.Shards}},
-		"number_of_replicas": {{.Replicas}}
-	},
-	"mappings": {
-		"sample": {
+		"number_of_replicas": {{.Replicas}}{{if .RoutingShards}},
+		"number_of_routing_shards": {{.RoutingShards}}{{end}}{{if .RefreshInterval}},
+		"index.refresh_interval": {{json .RefreshInterval}}{{end}}{{if .Codec}},
+		"index.codec": {{json .Codec}}{{end}}{{if .LabelText}},
+		"index.query.default_field": [{{json .LabelText}}]{{end}}{{if .ILMPolicy}},
+		"index.lifecycle.name": {{json .ILMPolicy}}{{if not .DataStream}},
+		"index.lifecycle.rollover_alias": {{json .Alias}}{{end}}{{end}}
+	}{{end}}`
+
+const sampleMapping = `{{define "mapping"}}{
 			"_source": {
 				"enabled": true
 			},
 			"properties": {
-				"timestamp": {
+				{{json .Fields.Timestamp}}: {
 					"type": "date",
 					"format": "strict_date_optional_time||epoch_millis"
-				},
+				},{{if .DataStream}}
+				"@timestamp": {
+					"type": "date",
+					"format": "epoch_millis"
+				},{{end}}
 				"value": {
 					"type": "double"
-				}
+				},{{if .SeriesDocs}}
+				"end_timestamp": {
+					"type": "date",
+					"format": "strict_date_optional_time||epoch_millis"
+				},
+				"samples": {
+					"type": "nested",
+					"properties": {
+						"timestamp": {
+							"type": "date",
+							"format": "epoch_millis"
+						},
+						"value": {
+							"type": "double"
+						}
+					}
+				},{{end}}
+				"fingerprint": {
+					"type": "keyword"
+				},{{if .LabelText}}
+				{{json .LabelText}}: {
+					"type": "text"
+				},{{end}}
+				{{json .Fields.Label}}: {{if .Fields.Nested}}{
+					"type": "nested",
+					"properties": {
+						"name": {
+							"type": "keyword"
+						},
+						"value": {
+							"type": "keyword"{{if .LabelText}},
+							"copy_to": {{json .LabelText}}{{end}}
+						}
+					}
+				}{{else}}{
+					"properties": {
+						"__name__": {
+							"type": "keyword"{{if .LabelText}},
+							"copy_to": {{json .LabelText}}{{end}}
+						}{{range .LabelMappings}},
+						{{json .Name}}: {{if eq .Type "none"}}{
+							"type": "keyword",
+							"index": false
+						}{{else}}{
+							"type": {{json .Type}}{{if $.LabelText}},
+							"copy_to": {{json $.LabelText}}{{end}}
+						}{{end}}{{end}}
+					}
+				}{{end}}
 			},
 			"dynamic_templates": [
 				{
 					"strings": {
 						"match_mapping_type": "string",
-						"path_match": "label.*",
+						"path_match": {{json (printf "%s.*" .Fields.Label)}},
 						"mapping": {
-							"type": "keyword"
+							"type": "keyword"{{if .LabelText}},
+							"copy_to": {{json .LabelText}}{{end}}
 						}
 					}
 				}
 			]
-		}
+		}{{end}}`
+
+// composableTemplate is a composable index template for rollover or daily
+// indexes, replacing the deprecated legacy indexTemplate from Elasticsearch 7.8
+const composableTemplate = `{
+	"index_patterns": [{{json (printf "%s-*" .Alias)}}],
+	"priority": 200,{{template "composed_of" .}}
+	"template": {
+		"settings": {{template "settings" .}},
+		"mappings": {{template "mapping" .}}
+	}
+}`
+
+// composedOf lists the component templates of a composable template
+const composedOf = `{{define "composed_of"}}{{if .Components}}
+	"composed_of": [{{range $i, $c := .Components}}{{if $i}}, {{end}}{{json $c}}{{end}}],{{end}}{{end}}`
+
+const indexTemplate = `{
+	"index_patterns": [{{json (printf "%s-*" .Alias)}}],
+	"settings": {{template "settings" .}},
+	"mappings": {{if not .Typeless}}{
+		"sample": {{end}}{{template "mapping" .}}{{if not .Typeless}}
+	}{{end}}
+}`
+
+// dataStreamTemplate is a composable index template backing a data stream
+// named after the alias, available from Elasticsearch 7.9
+const dataStreamTemplate = `{
+	"index_patterns": [{{json .Alias}}],
+	"data_stream": {},
+	"priority": 200,{{template "composed_of" .}}
+	"template": {
+		"settings": {{template "settings" .}},
+		"mappings": {{template "mapping" .}}
 	}
 }`
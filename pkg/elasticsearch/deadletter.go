@@ -0,0 +1,57 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+// deadLetterEntry is a single line written to the dead letter file
+type deadLetterEntry struct {
+	Reason string          `json:"reason"`
+	Doc    json.RawMessage `json:"doc,omitempty"`
+}
+
+// deadLetterWriter appends bulk requests that failed to index to a file as
+// newline delimited JSON so they can be diagnosed or replayed later
+type deadLetterWriter struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func newDeadLetterWriter(path string) (*deadLetterWriter, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &deadLetterWriter{
+		file: f,
+		enc:  json.NewEncoder(f),
+	}, nil
+}
+
+// Write records the failed request along with the reason it failed
+func (d *deadLetterWriter) Write(req elastic.BulkableRequest, reason string) error {
+	entry := deadLetterEntry{Reason: reason}
+	lines, err := req.Source()
+	if err != nil {
+		return err
+	}
+	// the first line is the bulk action, the second the document itself
+	if len(lines) > 1 {
+		entry.Doc = json.RawMessage(lines[1])
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.enc.Encode(entry)
+}
+
+// Close closes the underlying file
+func (d *deadLetterWriter) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.file.Close()
+}
@@ -0,0 +1,98 @@
+package elasticsearch
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+// readDeadLetters returns the entries of a dead letter file
+func readDeadLetters(t *testing.T, path string) []deadLetterEntry {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []deadLetterEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry deadLetterEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestDeadLetterFailedItems(t *testing.T) {
+	tests := []struct {
+		name      string
+		docs      []string
+		response  *elastic.BulkResponse
+		resent    []*elastic.BulkResponse
+		want      string
+		wantError string
+	}{
+		{
+			name:      "mixed response",
+			docs:      []string{"a", "b"},
+			response:  testResponse(201, 400),
+			want:      "b",
+			wantError: "error_400",
+		},
+		{
+			name:      "failed after a partial retry",
+			docs:      []string{"a", "b", "c"},
+			response:  testResponse(429, 201, 201),
+			resent:    []*elastic.BulkResponse{testResponse(400)},
+			want:      "a",
+			wantError: "error_400",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "deadletter")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "dead.json")
+			dead, err := newDeadLetterWriter(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, srv := newTestClient(t, &bulkServer{responses: test.resent})
+			defer srv.Close()
+			svc := newTestWriteService(client, elastic.NewConstantBackoff(time.Millisecond))
+			svc.dead = dead
+			svc.after(1, testRequests(test.docs...), test.response, nil)
+			dead.Close()
+
+			entries := readDeadLetters(t, path)
+			if len(entries) != 1 {
+				t.Fatalf("got %d dead letters, want 1", len(entries))
+			}
+			var doc map[string]string
+			if err := json.Unmarshal(entries[0].Doc, &doc); err != nil {
+				t.Fatal(err)
+			}
+			if doc["name"] != test.want {
+				t.Errorf("got dead letter of doc %q, want %q", doc["name"], test.want)
+			}
+			if got := entries[0].Reason; !strings.Contains(got, test.wantError) {
+				t.Errorf("got reason %q, want it to contain %q", got, test.wantError)
+			}
+			if got := counterValue(svc.deadCount); got != 1 {
+				t.Errorf("got %g dead letters counted, want 1", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package elasticsearch
+
+import (
+	"time"
+
+	"github.com/prometheus/common/model"
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+// Exemplar is a sample of Series annotated with Labels such as a trace id
+type Exemplar struct {
+	Series    model.Metric
+	Labels    model.Metric
+	Value     float64
+	Timestamp int64
+}
+
+// exemplarDoc is an exemplar as indexed.  The timestamp is a date string so
+// that the dynamic mapping of the exemplar index maps it as a date.
+type exemplarDoc struct {
+	Series    model.Metric `json:"label"`
+	Labels    model.Metric `json:"exemplar"`
+	Value     float64      `json:"value"`
+	Timestamp string       `json:"timestamp"`
+}
+
+// ExemplarIndex returns the index exemplars are stored in, outside the
+// alias-* pattern like MetadataIndex
+func ExemplarIndex(alias string) string {
+	return alias + "_exemplars"
+}
+
+// WriteExemplars queues exemplars to be stored, one doc each, when enabled
+// by WriteConfig.Exemplars.  Exemplars of series dropped by the filter are
+// skipped.
+func (svc *WriteService) WriteExemplars(exemplars []Exemplar) {
+	if !svc.config.Exemplars {
+		return
+	}
+	for _, e := range exemplars {
+		series := e.Series
+		if svc.config.SanitizeLabels {
+			series = make(model.Metric, len(e.Series))
+			for name, value := range e.Series {
+				series[model.LabelName(sanitizeLabelName(string(name)))] = value
+			}
+		}
+		if svc.activeFilter().Drop(series) {
+			continue
+		}
+		doc := exemplarDoc{
+			Series:    series,
+			Labels:    e.Labels,
+			Value:     e.Value,
+			Timestamp: time.Unix(0, e.Timestamp*int64(time.Millisecond)).UTC().Format("2006-01-02T15:04:05.000Z"),
+		}
+		r := elastic.
+			NewBulkIndexRequest().
+			Index(ExemplarIndex(svc.config.Alias)).
+			Type(docType(svc.config.Typeless)).
+			Doc(doc)
+		if svc.config.DryRun {
+			svc.logDryRun(r)
+			continue
+		}
+		svc.processor.Add(r)
+	}
+}
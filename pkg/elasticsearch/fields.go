@@ -0,0 +1,185 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+const (
+	defaultTimestampField = "timestamp"
+	defaultLabelField     = "label"
+)
+
+// FieldNames are the names of the document fields holding the sample
+// timestamp and the labels, empty names default to timestamp and label
+type FieldNames struct {
+	Timestamp string
+	Label     string
+	// Nested stores the labels as an array of name and value objects mapped
+	// as nested, so the mapping does not grow with each new label name
+	Nested bool
+}
+
+// nestedLabel is a label as stored when FieldNames.Nested is set
+type nestedLabel struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// withDefaults returns f with empty names replaced by their defaults
+func (f FieldNames) withDefaults() FieldNames {
+	if f.Timestamp == "" {
+		f.Timestamp = defaultTimestampField
+	}
+	if f.Label == "" {
+		f.Label = defaultLabelField
+	}
+	return f
+}
+
+func (f FieldNames) timestamp() string {
+	return f.withDefaults().Timestamp
+}
+
+// label returns the field of the named label
+func (f FieldNames) label(name string) string {
+	return f.withDefaults().Label + "." + name
+}
+
+// renames maps the default field names to the configured ones, nil when
+// they are the same
+func (f FieldNames) renames() map[string]string {
+	f = f.withDefaults()
+	if f.Timestamp == defaultTimestampField && f.Label == defaultLabelField {
+		return nil
+	}
+	return map[string]string{
+		defaultTimestampField: f.Timestamp,
+		defaultLabelField:     f.Label,
+	}
+}
+
+// encode returns doc for indexing, renaming its fields and nesting its labels
+// when configured
+func (f FieldNames) encode(doc interface{}) interface{} {
+	renames := f.renames()
+	if renames == nil && !f.Nested {
+		return doc
+	}
+	return &renamedDoc{doc: doc, renames: renames, nested: f.Nested}
+}
+
+// decode unmarshals a doc source into v, reverting any renamed fields and
+// nested labels
+func (f FieldNames) decode(source []byte, v interface{}) error {
+	renames := f.renames()
+	if renames == nil && !f.Nested {
+		return json.Unmarshal(source, v)
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(source, &m); err != nil {
+		return err
+	}
+	inverse := make(map[string]string, len(renames))
+	for from, to := range renames {
+		inverse[to] = from
+	}
+	m = renameKeys(m, inverse)
+	if f.Nested {
+		if err := unnestLabels(m); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// renamedDoc marshals doc with its top level fields renamed, and its labels
+// nested when set
+type renamedDoc struct {
+	doc     interface{}
+	renames map[string]string
+	nested  bool
+}
+
+// MarshalJSON implements json.Marshaler
+func (d *renamedDoc) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(d.doc)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	if d.nested {
+		if err := nestLabels(m); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(renameKeys(m, d.renames))
+}
+
+// renameKeys renames the top level keys of a JSON object
+func renameKeys(m map[string]json.RawMessage, renames map[string]string) map[string]json.RawMessage {
+	if len(renames) == 0 {
+		return m
+	}
+	out := make(map[string]json.RawMessage, len(m))
+	for k, v := range m {
+		if to, ok := renames[k]; ok {
+			k = to
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// nestLabels replaces the label object of a doc by an array of nestedLabel
+// sorted by name
+func nestLabels(m map[string]json.RawMessage) error {
+	raw, ok := m[defaultLabelField]
+	if !ok {
+		return nil
+	}
+	var labels map[string]string
+	if err := json.Unmarshal(raw, &labels); err != nil {
+		return err
+	}
+	nested := make([]nestedLabel, 0, len(labels))
+	for name, value := range labels {
+		nested = append(nested, nestedLabel{Name: name, Value: value})
+	}
+	sort.Slice(nested, func(i, j int) bool { return nested[i].Name < nested[j].Name })
+	b, err := json.Marshal(nested)
+	if err != nil {
+		return err
+	}
+	m[defaultLabelField] = b
+	return nil
+}
+
+// unnestLabels reverts nestLabels
+func unnestLabels(m map[string]json.RawMessage) error {
+	raw, ok := m[defaultLabelField]
+	if !ok {
+		return nil
+	}
+	var nested []nestedLabel
+	if err := json.Unmarshal(raw, &nested); err != nil {
+		return err
+	}
+	labels := make(map[string]string, len(nested))
+	for _, l := range nested {
+		labels[l.Name] = l.Value
+	}
+	b, err := json.Marshal(labels)
+	if err != nil {
+		return err
+	}
+	m[defaultLabelField] = b
+	return nil
+}
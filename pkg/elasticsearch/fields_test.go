@@ -0,0 +1,41 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestNestedLabelsRoundTrip(t *testing.T) {
+	fields := FieldNames{Timestamp: "@ts", Label: "labels", Nested: true}
+	sample := prometheusSample{
+		Labels:    model.Metric{"__name__": "up", "job": "node"},
+		Value:     1,
+		Timestamp: 1000,
+	}
+	b, err := json.Marshal(fields.encode(sample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Timestamp int64         `json:"@ts"`
+		Labels    []nestedLabel `json:"labels"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatalf("got doc %s: %s", b, err)
+	}
+	want := []nestedLabel{{Name: "__name__", Value: "up"}, {Name: "job", Value: "node"}}
+	if doc.Timestamp != 1000 || !reflect.DeepEqual(doc.Labels, want) {
+		t.Errorf("got doc %s, want the timestamp in @ts and labels nested in labels sorted by name", b)
+	}
+
+	var got prometheusSample
+	if err := fields.decode(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, sample) {
+		t.Errorf("got sample %+v, want %+v", got, sample)
+	}
+}
@@ -0,0 +1,129 @@
+package elasticsearch
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// Filter decides which series are indexed based on their metric name.  Series
+// matching the drop regex are skipped unless they also match the keep regex.
+type Filter struct {
+	drop *regexp.Regexp
+	keep *regexp.Regexp
+}
+
+// NewFilter compiles the drop and keep regexes, either may be empty.  Like
+// Prometheus the regexes must match the whole metric name.
+func NewFilter(drop, keep string) (*Filter, error) {
+	f := &Filter{}
+	var err error
+	if f.drop, err = compileAnchored(drop); err != nil {
+		return nil, fmt.Errorf("invalid drop regex: %s", err)
+	}
+	if f.keep, err = compileAnchored(keep); err != nil {
+		return nil, fmt.Errorf("invalid keep regex: %s", err)
+	}
+	return f, nil
+}
+
+// Drop reports whether the series should not be indexed
+func (f *Filter) Drop(m model.Metric) bool {
+	if f == nil || f.drop == nil {
+		return false
+	}
+	name := string(m[model.MetricNameLabel])
+	if f.keep != nil && f.keep.MatchString(name) {
+		return false
+	}
+	return f.drop.MatchString(name)
+}
+
+// LoadFilter reads a Filter from a rules file, each line being either
+// "drop: <regex>" or "keep: <regex>".  Rules of the same kind are combined so
+// a series matching any drop rule is skipped unless it matches a keep rule.
+// Blank lines and lines starting with # are ignored.
+func LoadFilter(path string) (*Filter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var drop, keep []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: expected drop: or keep: followed by a regex", n)
+		}
+		expr := strings.TrimSpace(line[i+1:])
+		if _, err := regexp.Compile(expr); err != nil {
+			return nil, fmt.Errorf("line %d: invalid regex: %s", n, err)
+		}
+		switch strings.TrimSpace(line[:i]) {
+		case "drop":
+			drop = append(drop, "(?:"+expr+")")
+		case "keep":
+			keep = append(keep, "(?:"+expr+")")
+		default:
+			return nil, fmt.Errorf("line %d: unknown rule %q, expected drop or keep", n, line[:i])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewFilter(strings.Join(drop, "|"), strings.Join(keep, "|"))
+}
+
+func compileAnchored(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+// Sampler indexes a fixed fraction of series, chosen by their fingerprint so
+// a series is consistently kept or dropped across requests and restarts
+type Sampler struct {
+	// threshold is the highest fingerprint kept
+	threshold uint64
+	match     *regexp.Regexp
+}
+
+// NewSampler returns a Sampler keeping ratio, between 0 and 1, of the series
+// whose metric name matches the regex, all series when it is empty.  Nil is
+// returned when ratio keeps every series.
+func NewSampler(ratio float64, match string) (*Sampler, error) {
+	if ratio <= 0 || ratio > 1 {
+		return nil, fmt.Errorf("sample ratio must be above 0 and at most 1, got %g", ratio)
+	}
+	if ratio == 1 {
+		return nil, nil
+	}
+	s := &Sampler{threshold: uint64(ratio * math.MaxUint64)}
+	var err error
+	if s.match, err = compileAnchored(match); err != nil {
+		return nil, fmt.Errorf("invalid sample regex: %s", err)
+	}
+	return s, nil
+}
+
+// Drop reports whether the series is sampled out
+func (s *Sampler) Drop(m model.Metric) bool {
+	if s == nil {
+		return false
+	}
+	if s.match != nil && !s.match.MatchString(string(m[model.MetricNameLabel])) {
+		return false
+	}
+	return uint64(m.Fingerprint()) > s.threshold
+}
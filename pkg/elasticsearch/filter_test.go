@@ -0,0 +1,150 @@
+package elasticsearch
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestNewFilter(t *testing.T) {
+	tests := []struct {
+		name       string
+		drop, keep string
+		metric     string
+		want       bool
+	}{
+		{"no rules", "", "", "go_goroutines", false},
+		{"dropped", "go_.*", "", "go_goroutines", true},
+		{"not matched", "go_.*", "", "up", false},
+		{"anchored", "go", "", "go_goroutines", false},
+		{"keep beats drop", "go_.*", "go_goroutines", "go_goroutines", false},
+		{"keep alone", "", "go_.*", "up", false},
+	}
+	for _, test := range tests {
+		f, err := NewFilter(test.drop, test.keep)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if got := f.Drop(model.Metric{model.MetricNameLabel: model.LabelValue(test.metric)}); got != test.want {
+			t.Errorf("%s: got drop %t for %s, want %t", test.name, got, test.metric, test.want)
+		}
+	}
+
+	if _, err := NewFilter("(", ""); err == nil || !strings.Contains(err.Error(), "invalid drop regex") {
+		t.Errorf("got error %v, want invalid drop regex", err)
+	}
+	if _, err := NewFilter("", "("); err == nil || !strings.Contains(err.Error(), "invalid keep regex") {
+		t.Errorf("got error %v, want invalid keep regex", err)
+	}
+}
+
+func TestLoadFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   string
+		dropped []string
+		kept    []string
+		err     string
+	}{
+		{
+			name:    "rules",
+			rules:   "# noisy runtime metrics\ndrop: go_.*\ndrop: process_.*\n\nkeep: go_goroutines\n",
+			dropped: []string{"go_gc_duration_seconds", "process_open_fds"},
+			kept:    []string{"go_goroutines", "up"},
+		},
+		{
+			name:  "empty",
+			rules: "\n# nothing\n",
+			kept:  []string{"go_goroutines", "up"},
+		},
+		{name: "missing colon", rules: "drop go_.*\n", err: "line 1: expected drop: or keep:"},
+		{name: "bad regex", rules: "# comment\ndrop: (\n", err: "line 2: invalid regex"},
+		{name: "unknown rule", rules: "allow: up\n", err: `line 1: unknown rule "allow"`},
+	}
+	for _, test := range tests {
+		f, err := loadTestFilter(t, test.rules)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		for _, name := range test.dropped {
+			if !f.Drop(model.Metric{model.MetricNameLabel: model.LabelValue(name)}) {
+				t.Errorf("%s: got %s kept, want it dropped", test.name, name)
+			}
+		}
+		for _, name := range test.kept {
+			if f.Drop(model.Metric{model.MetricNameLabel: model.LabelValue(name)}) {
+				t.Errorf("%s: got %s dropped, want it kept", test.name, name)
+			}
+		}
+	}
+
+	if _, err := LoadFilter("does-not-exist.rules"); err == nil {
+		t.Error("got no error loading a missing rules file")
+	}
+}
+
+// loadTestFilter loads a Filter from a temporary file holding rules
+func loadTestFilter(t *testing.T, rules string) (*Filter, error) {
+	f, err := ioutil.TempFile("", "filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(rules); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	return LoadFilter(f.Name())
+}
+
+func TestSampler(t *testing.T) {
+	s, err := NewSampler(0.25, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const series = 10000
+	kept := 0
+	for i := 0; i < series; i++ {
+		m := model.Metric{model.MetricNameLabel: "up", "instance": model.LabelValue(strconv.Itoa(i))}
+		drop := s.Drop(m)
+		for j := 0; j < 3; j++ {
+			if s.Drop(m.Clone()) != drop {
+				t.Fatalf("got %s both kept and dropped", m)
+			}
+		}
+		if !drop {
+			kept++
+		}
+	}
+	if ratio := float64(kept) / series; ratio < 0.22 || ratio > 0.28 {
+		t.Errorf("got %g of the series kept, want about 0.25", ratio)
+	}
+
+	// only matching metric names are sampled
+	s, err = NewSampler(0.0001, "node_.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Drop(model.Metric{model.MetricNameLabel: "up"}) {
+		t.Error("got a series sampled out although its name does not match")
+	}
+
+	if s, err := NewSampler(1, ""); s != nil || err != nil {
+		t.Errorf("got sampler %v and error %v, want none keeping every series", s, err)
+	}
+	for _, ratio := range []float64{0, -1, 1.5} {
+		if _, err := NewSampler(ratio, ""); err == nil {
+			t.Errorf("got no error for ratio %g", ratio)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package elasticsearch
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+// HealthService periodically polls the Elasticsearch cluster health and
+// exposes it as Prometheus gauges
+type HealthService struct {
+	ctx        context.Context
+	client     *elastic.Client
+	logger     *zap.Logger
+	interval   time.Duration
+	status     prometheus.Gauge
+	active     prometheus.Gauge
+	unassigned prometheus.Gauge
+}
+
+// clusterStatus maps the cluster health status to the exported gauge value
+var clusterStatus = map[string]float64{
+	"green":  0,
+	"yellow": 1,
+	"red":    2,
+}
+
+// NewHealthService registers the cluster health gauges and starts polling
+// the cluster every interval until ctx is done
+func NewHealthService(ctx context.Context, logger *zap.Logger, client *elastic.Client, interval time.Duration) *HealthService {
+	svc := &HealthService{
+		ctx:      ctx,
+		client:   client,
+		logger:   logger,
+		interval: interval,
+		status: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "cluster_status",
+			Help:      "Elasticsearch cluster status, 0 green, 1 yellow, 2 red",
+		}),
+		active: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "active_shards",
+			Help:      "Number of active shards in the Elasticsearch cluster",
+		}),
+		unassigned: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "unassigned_shards",
+			Help:      "Number of unassigned shards in the Elasticsearch cluster",
+		}),
+	}
+	prometheus.MustRegister(svc)
+	go svc.poll()
+	return svc
+}
+
+// Describe implements prometheus.Collector
+func (svc *HealthService) Describe(ch chan<- *prometheus.Desc) {
+	svc.status.Describe(ch)
+	svc.active.Describe(ch)
+	svc.unassigned.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (svc *HealthService) Collect(ch chan<- prometheus.Metric) {
+	svc.status.Collect(ch)
+	svc.active.Collect(ch)
+	svc.unassigned.Collect(ch)
+}
+
+func (svc *HealthService) poll() error {
+	svc.update()
+	for {
+		select {
+		case <-time.After(svc.interval):
+			svc.update()
+		case <-svc.ctx.Done():
+			svc.logger.Info("Health service exiting")
+			return svc.ctx.Err()
+		}
+	}
+}
+
+func (svc *HealthService) update() {
+	res, err := svc.client.ClusterHealth().Do(svc.ctx)
+	if err != nil {
+		svc.logger.Error("Failed to get cluster health", zap.Error(err))
+		return
+	}
+	status, ok := clusterStatus[res.Status]
+	if !ok {
+		svc.logger.Warn("Unknown cluster status", zap.String("status", res.Status))
+		return
+	}
+	svc.status.Set(status)
+	svc.active.Set(float64(res.ActiveShards))
+	svc.unassigned.Set(float64(res.UnassignedShards))
+}
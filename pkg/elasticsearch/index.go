@@ -3,10 +3,19 @@ package elasticsearch
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"html/template"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
+	"github.com/prometheus/common/model"
 	"go.uber.org/zap"
 	elastic "gopkg.in/olivere/elastic.v6"
 )
@@ -17,6 +26,15 @@ type IndexService struct {
 	client *elastic.Client
 	config *IndexConfig
 	logger *zap.Logger
+	// mu serializes manual and scheduled rollovers
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	// migrating is 1 while a migration reindexes
+	migrating int32
+	// after waits between the checks of the background loops, time.After
+	// but for tests
+	after func(time.Duration) <-chan time.Time
 }
 
 // IndexConfig is used to configure IndexService
@@ -25,61 +43,275 @@ type IndexConfig struct {
 	MaxAge  string
 	MaxDocs int64
 	MaxSize string
+	// RetentionMaxAge is the age (eg 30d or 12h) after which rolled over
+	// indexes are deleted.  Retention is disabled when empty.
+	RetentionMaxAge string
+	// ILM hands rollover and retention to an Elasticsearch ILM policy, the
+	// service then only bootstraps the initial write index.
+	ILM bool
+	// CheckInterval is how often rollover conditions are evaluated,
+	// defaults to 5 minutes
+	CheckInterval time.Duration
 }
 
 // IndexTemplateConfig is used to resolve template
 type IndexTemplateConfig struct {
-	Alias    string
+	Alias string
+	// Name of the index template, the alias when empty
+	Name     string
 	Shards   int
 	Replicas int
+	// RoutingShards sets index.number_of_routing_shards to allow later splits,
+	// omitted when 0
+	RoutingShards int
+	// RefreshInterval and Codec set index.refresh_interval and index.codec,
+	// Elasticsearch defaults apply when empty
+	RefreshInterval string
+	Codec           string
+	// LabelMappings override the default keyword mapping of individual labels
+	LabelMappings []LabelMapping
+	// LabelText names a text field all indexed label values are copied to,
+	// also made the default field of queries without one.  Omitted when empty.
+	LabelText string
+	// ILMPolicy names an existing ILM policy to attach to new indexes
+	ILMPolicy string
+	// Typeless omits the mapping type, required by Elasticsearch 7+
+	Typeless bool
+	// SeriesDocs maps the nested samples of series docs
+	SeriesDocs bool
+	// Fields names the timestamp and label fields, see WriteConfig
+	Fields FieldNames
+	// DataStream creates a composable template for a data stream named
+	// after the alias instead of a legacy template for rollover indexes
+	DataStream bool
+	// Composable creates a composable template for the rollover indexes
+	// instead of a legacy one, requires Elasticsearch 7.8+
+	Composable bool
+	// Components names existing component templates the composable
+	// template is composed of, its own settings and mappings taking
+	// precedence
+	Components []string
+}
+
+// LabelMapping maps a single label to the given field type.  Type is one of
+// keyword, text or none, the latter storing the label without indexing it.
+type LabelMapping struct {
+	Name string
+	Type string
+}
+
+// ParseLabelMappings parses a comma separated list of label:type pairs eg
+// instance:text,pod:none.  The metric name label cannot be remapped.
+func ParseLabelMappings(s string) ([]LabelMapping, error) {
+	var mappings []LabelMapping
+	if s == "" {
+		return mappings, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid label mapping %q, expected label:type", pair)
+		}
+		name, typ := parts[0], parts[1]
+		if !model.LabelName(name).IsValid() {
+			return nil, fmt.Errorf("invalid label name %q", name)
+		}
+		if name == model.MetricNameLabel {
+			return nil, fmt.Errorf("the %s label is always mapped as keyword", model.MetricNameLabel)
+		}
+		switch typ {
+		case "keyword", "text", "none":
+		default:
+			return nil, fmt.Errorf("invalid type %q for label %s, expected keyword, text or none", typ, name)
+		}
+		mappings = append(mappings, LabelMapping{Name: name, Type: typ})
+	}
+	return mappings, nil
 }
 
 // NewIndexService will ensure required alias and indexes exist.  It will also monitor
-// active index and rollover as necessary
+// active index and rollover as necessary, unless ILM is enabled
 func NewIndexService(ctx context.Context, logger *zap.Logger, client *elastic.Client, config *IndexConfig) (*IndexService, error) {
+	ctx, cancel := context.WithCancel(ctx)
 	svc := &IndexService{
 		ctx:    ctx,
 		client: client,
 		config: config,
 		logger: logger,
+		cancel: cancel,
+		after:  time.After,
+	}
+	var retention time.Duration
+	if config.RetentionMaxAge != "" && !config.ILM {
+		var err error
+		retention, err = parseAge(config.RetentionMaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention max age: %s", err)
+		}
 	}
 	if err := svc.createIndex(); err != nil {
+		cancel()
 		return nil, err
 	}
-	go svc.rolloverIndex()
+	if config.ILM {
+		return svc, nil
+	}
+	svc.wg.Add(1)
+	go func() {
+		defer svc.wg.Done()
+		svc.rolloverIndex()
+	}()
+	if retention > 0 {
+		svc.wg.Add(1)
+		go func() {
+			defer svc.wg.Done()
+			svc.retainIndices(retention)
+		}()
+	}
 	return svc, nil
 }
 
+// Close stops the rollover and retention loops, waiting for any request in
+// progress so the client can be safely stopped afterwards
+func (svc *IndexService) Close() {
+	svc.cancel()
+	svc.wg.Wait()
+}
+
+// templateFuncs are available to the JSON body templates, json encoding
+// the values interpolated into them
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// EnsureIndexTemplate creates or updates the index template applied to new indexes
 func EnsureIndexTemplate(ctx context.Context, client *elastic.Client, config *IndexTemplateConfig) error {
+	body := indexTemplate
+	switch {
+	case config.DataStream:
+		body = dataStreamTemplate
+	case config.Composable:
+		body = composableTemplate
+	}
+	resolved := *config
+	resolved.Fields = config.Fields.withDefaults()
 	var buf bytes.Buffer
-	t := template.Must(template.New("template").Parse(indexTemplate))
-	err := t.Execute(&buf, config)
+	t := template.Must(template.New("template").Funcs(templateFuncs).Parse(body + indexSettings + sampleMapping + composedOf))
+	err := t.Execute(&buf, &resolved)
 	if err != nil {
 		return fmt.Errorf("executing template: %s", err)
 	}
 	payload := buf.String()
 
-	_, err = client.IndexPutTemplate(config.Alias).BodyString(payload).Do(ctx)
+	name := config.Name
+	if name == "" {
+		name = config.Alias
+	}
+	if config.DataStream || config.Composable {
+		_, err = client.PerformRequest(ctx, elastic.PerformRequestOptions{
+			Method: "PUT",
+			Path:   "/_index_template/" + url.PathEscape(name),
+			Body:   payload,
+		})
+	} else {
+		_, err = client.IndexPutTemplate(name).BodyString(payload).Do(ctx)
+	}
 	if err != nil {
 		return fmt.Errorf("Failed to create index template: %s", err)
 	}
 	return nil
 }
 
+// EnsureDataStream creates the named data stream unless it already exists.
+// A matching data stream template must be in place first.
+func EnsureDataStream(ctx context.Context, client *elastic.Client, name string) error {
+	path := "/_data_stream/" + url.PathEscape(name)
+	_, err := client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "GET",
+		Path:   path,
+	})
+	if err == nil {
+		return nil
+	}
+	if !elastic.IsNotFound(err) {
+		return err
+	}
+	_, err = client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "PUT",
+		Path:   path,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to create data stream: %s", err)
+	}
+	return nil
+}
+
+// IndexInfo describes the size of an index
+type IndexInfo struct {
+	Index string `json:"index"`
+	// Docs is the number of documents in the primary shards
+	Docs int64 `json:"docs"`
+	// SizeBytes is the store size of all shards, including replicas
+	SizeBytes int64 `json:"size_bytes"`
+}
+
+// writeIndex returns the index alias writes to, "" if there is none
+func writeIndex(aliases *elastic.AliasesResult, alias string) string {
+	indices := aliases.IndicesByAlias(alias)
+	if len(indices) == 1 {
+		return indices[0]
+	}
+	// rolled over aliases can point to several indexes, one of them flagged
+	// as the write index
+	for name, res := range aliases.Indices {
+		for _, a := range res.Aliases {
+			if a.AliasName == alias && a.IsWriteIndex {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// ActiveIndex resolves alias to the index currently written to
+func ActiveIndex(ctx context.Context, client *elastic.Client, alias string) (*IndexInfo, error) {
+	aliases, err := client.Aliases().Index(alias).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	index := writeIndex(aliases, alias)
+	if index == "" {
+		return nil, fmt.Errorf("alias %s has no write index", alias)
+	}
+	stats, err := client.IndexStats(index).Metric("docs", "store").Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	info := &IndexInfo{Index: index}
+	if s, ok := stats.Indices[index]; ok {
+		if s.Primaries != nil && s.Primaries.Docs != nil {
+			info.Docs = s.Primaries.Docs.Count
+		}
+		if s.Total != nil && s.Total.Store != nil {
+			info.SizeBytes = s.Total.Store.SizeInBytes
+		}
+	}
+	return info, nil
+}
+
 func (svc *IndexService) createIndex() error {
 	exists, err := svc.client.IndexExists(svc.config.Alias).Do(svc.ctx)
 	if err != nil {
 		return err
 	}
 	if !exists {
-		var buf bytes.Buffer
-		t := template.Must(template.New("create").Parse(indexCreate))
-		err := t.Execute(&buf, svc.config)
+		payload, err := svc.createBody()
 		if err != nil {
-			return fmt.Errorf("executing template: %s", err)
+			return err
 		}
-		payload := buf.String()
-
 		_, err = svc.client.CreateIndex(svc.config.Alias + "-1").BodyString(payload).Do(svc.ctx)
 		if err != nil {
 			return fmt.Errorf("Failed to create initial index: %s", err)
@@ -88,6 +320,79 @@ func (svc *IndexService) createIndex() error {
 	return nil
 }
 
+// createBody renders the body creating a write index behind the alias
+func (svc *IndexService) createBody() (string, error) {
+	var buf bytes.Buffer
+	t := template.Must(template.New("create").Funcs(templateFuncs).Parse(indexCreate))
+	if err := t.Execute(&buf, svc.config); err != nil {
+		return "", fmt.Errorf("executing template: %s", err)
+	}
+	return buf.String(), nil
+}
+
+// EnsureAlias recreates the write alias when it no longer exists, eg after
+// it was deleted by hand, behind a new index numbered after the existing
+// alias-* indexes.  It reports whether the alias was recreated.  An index
+// named like the alias, auto created by writes in the meantime, prevents
+// this and has to be removed by hand.
+func (svc *IndexService) EnsureAlias(ctx context.Context) (bool, error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	exists, err := svc.client.IndexExists(svc.config.Alias).Do(ctx)
+	if err != nil || exists {
+		return false, err
+	}
+	settings, err := svc.client.IndexGetSettings(svc.config.Alias + "-*").Do(ctx)
+	if err != nil {
+		return false, err
+	}
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	index := nextIndex(svc.config.Alias, names)
+	payload, err := svc.createBody()
+	if err != nil {
+		return false, err
+	}
+	if _, err := svc.client.CreateIndex(index).BodyString(payload).Do(ctx); err != nil {
+		return false, fmt.Errorf("Failed to create index %s: %s", index, err)
+	}
+	svc.logger.Warn("Recreated missing write alias", zap.String("alias", svc.config.Alias), zap.String("index", index))
+	return true, nil
+}
+
+// nextIndex returns the index following the highest numbered of the alias-N
+// indexes, zero padded as rollover names them, or alias-1 when there is none
+func nextIndex(alias string, indices []string) string {
+	max := 0
+	for _, name := range indices {
+		if n, ok := rolloverNumber(alias, name); ok && n > max {
+			max = n
+		}
+	}
+	if max == 0 {
+		return alias + "-1"
+	}
+	return fmt.Sprintf("%s-%06d", alias, max+1)
+}
+
+// rolloverNumber returns the counter of an index named alias-N as created by
+// EnsureAlias and rollover, ok is false for any other name
+func rolloverNumber(alias, name string) (int, bool) {
+	suffix := strings.TrimPrefix(name, alias+"-")
+	if suffix == name || suffix == "" {
+		return 0, false
+	}
+	for _, c := range suffix {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	n, err := strconv.Atoi(suffix)
+	return n, err == nil
+}
+
 // rolloverIndex
 func (svc *IndexService) rolloverIndex() error {
 	rollover := svc.client.RolloverIndex(svc.config.Alias)
@@ -100,10 +405,19 @@ func (svc *IndexService) rolloverIndex() error {
 	if svc.config.MaxSize != "" {
 		rollover.AddCondition("max_size", svc.config.MaxSize)
 	}
+	interval := svc.config.CheckInterval
+	if interval <= 0 {
+		interval = defaultCheckInterval
+	}
 	for {
 		select {
-		case <-time.After(5 * time.Minute):
+		case <-svc.after(interval):
+			if _, err := svc.EnsureAlias(svc.ctx); err != nil {
+				svc.logger.Error("Failed to check write alias", zap.Error(err))
+			}
+			svc.mu.Lock()
 			res, err := rollover.Do(svc.ctx)
+			svc.mu.Unlock()
 			if err != nil {
 				svc.logger.Error("Failed to rollover index", zap.Error(err))
 			} else {
@@ -115,3 +429,239 @@ func (svc *IndexService) rolloverIndex() error {
 		}
 	}
 }
+
+// Rollover unconditionally rolls the alias over to a new index
+func (svc *IndexService) Rollover(ctx context.Context) (*elastic.IndicesRolloverResponse, error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	res, err := svc.client.RolloverIndex(svc.config.Alias).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	svc.logger.Info("Rolled over index", zap.String("old_index", res.OldIndex), zap.String("new_index", res.NewIndex))
+	return res, nil
+}
+
+// MigrateResult describes a started Migrate
+type MigrateResult struct {
+	OldIndex string `json:"old_index"`
+	NewIndex string `json:"new_index"`
+	// Task is the id of the reindex task in the Elasticsearch tasks API
+	Task string `json:"task"`
+}
+
+// ErrMigrating is returned by Migrate while a previous migration reindexes
+var ErrMigrating = errors.New("a migration is already in progress")
+
+// migratePoll is how often the reindex task of a migration is checked
+const migratePoll = 5 * time.Second
+
+// Migrate moves the write index to an index created from the current
+// template, eg after changing the shard count.  The alias is rolled over to
+// the new index and the old write index reindexed into it by a task, which
+// completes in the background on the service context, independently of the
+// caller's.  The old index is blocked for writes before reindexing, so no
+// sample lands in it after the reindex snapshot and is lost with it.  It is
+// then deleted so its samples are not read twice, or kept if reindexing fails.  Only one migration runs at a time.
+func (svc *IndexService) Migrate(ctx context.Context) (*MigrateResult, error) {
+	if !atomic.CompareAndSwapInt32(&svc.migrating, 0, 1) {
+		return nil, ErrMigrating
+	}
+	res, err := svc.startMigration(ctx)
+	if err != nil {
+		atomic.StoreInt32(&svc.migrating, 0)
+		return nil, err
+	}
+	svc.wg.Add(1)
+	go func() {
+		defer svc.wg.Done()
+		defer atomic.StoreInt32(&svc.migrating, 0)
+		svc.finishMigration(res)
+	}()
+	return res, nil
+}
+
+// startMigration rolls the alias over, blocks writes to the old write index
+// and starts reindexing it into the new one
+func (svc *IndexService) startMigration(ctx context.Context) (*MigrateResult, error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	rolled, err := svc.client.RolloverIndex(svc.config.Alias).Do(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to rollover index: %s", err)
+	}
+	res := &MigrateResult{OldIndex: rolled.OldIndex, NewIndex: rolled.NewIndex}
+	_, err = svc.client.IndexPutSettings(res.OldIndex).
+		BodyString(`{"index":{"blocks":{"write":true}}}`).
+		Do(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to block writes to %s: %s", res.OldIndex, err)
+	}
+	task, err := svc.client.Reindex().
+		SourceIndex(res.OldIndex).
+		DestinationIndex(res.NewIndex).
+		Refresh("true").
+		WaitForCompletion(false).
+		DoAsync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to reindex %s into %s: %s", res.OldIndex, res.NewIndex, err)
+	}
+	res.Task = task.TaskId
+	svc.logger.Info("Migrating index",
+		zap.String("old_index", res.OldIndex),
+		zap.String("new_index", res.NewIndex),
+		zap.String("task", res.Task))
+	return res, nil
+}
+
+// reindexTask is the state of a reindex task in the tasks API
+type reindexTask struct {
+	Completed bool                               `json:"completed"`
+	Error     *elastic.ErrorDetails              `json:"error"`
+	Response  *elastic.BulkIndexByScrollResponse `json:"response"`
+}
+
+// finishMigration waits for the reindex task of a migration, deleting the
+// old index once all of its docs were reindexed
+func (svc *IndexService) finishMigration(res *MigrateResult) {
+	log := svc.logger.With(
+		zap.String("old_index", res.OldIndex),
+		zap.String("new_index", res.NewIndex),
+		zap.String("task", res.Task))
+	var task reindexTask
+	for !task.Completed {
+		select {
+		case <-svc.after(migratePoll):
+		case <-svc.ctx.Done():
+			log.Warn("Stopped waiting for the reindex task, delete the old index by hand once it completes")
+			return
+		}
+		resp, err := svc.client.PerformRequest(svc.ctx, elastic.PerformRequestOptions{
+			Method: "GET",
+			Path:   "/_tasks/" + url.PathEscape(res.Task),
+		})
+		if err != nil {
+			log.Warn("Failed to get the reindex task", zap.Error(err))
+			continue
+		}
+		if err := json.Unmarshal(resp.Body, &task); err != nil {
+			log.Warn("Failed to decode the reindex task", zap.Error(err))
+			continue
+		}
+	}
+	if task.Error != nil {
+		log.Error("Failed to reindex, keeping the old index", zap.String("error", fmt.Sprintf("%+v", task.Error)))
+		return
+	}
+	if task.Response == nil || len(task.Response.Failures) > 0 {
+		failures := 0
+		if task.Response != nil {
+			failures = len(task.Response.Failures)
+		}
+		log.Error("Failed to reindex docs, keeping the old index", zap.Int("failures", failures))
+		return
+	}
+	if _, err := svc.client.DeleteIndex(res.OldIndex).Do(svc.ctx); err != nil {
+		log.Error("Failed to delete the old index", zap.Error(err))
+		return
+	}
+	log.Info("Migrated index", zap.Int64("reindexed", task.Response.Created))
+}
+
+// retainIndices periodically deletes indexes older than maxAge
+func (svc *IndexService) retainIndices(maxAge time.Duration) error {
+	for {
+		select {
+		case <-svc.after(time.Hour):
+			if err := svc.deleteExpiredIndices(maxAge); err != nil {
+				svc.logger.Error("Failed to delete expired indices", zap.Error(err))
+			}
+		case <-svc.ctx.Done():
+			svc.logger.Info("Index retention exiting")
+			return svc.ctx.Err()
+		}
+	}
+}
+
+// deleteExpiredIndices deletes the rolled over alias-N indexes created more
+// than maxAge ago, other indexes matching alias-* are left alone. Rollover
+// moves the alias to the new index so the older ones are found by name
+func (svc *IndexService) deleteExpiredIndices(maxAge time.Duration) error {
+	alias := svc.config.Alias
+	aliases, err := svc.client.Aliases().Index(alias).Do(svc.ctx)
+	if err != nil {
+		return err
+	}
+	write := writeIndex(aliases, alias)
+	if write == "" {
+		// without a write index a freshly rolled over one cannot be told apart
+		return fmt.Errorf("alias %s has no write index", alias)
+	}
+	settings, err := svc.client.IndexGetSettings(alias + "-*").Do(svc.ctx)
+	if err != nil {
+		return err
+	}
+	created := make(map[string]time.Time, len(settings))
+	for name, s := range settings {
+		if _, ok := rolloverNumber(alias, name); !ok {
+			continue
+		}
+		t, err := creationDate(s.Settings)
+		if err != nil {
+			svc.logger.Warn("Unable to determine index creation date", zap.String("index", name), zap.Error(err))
+			continue
+		}
+		created[name] = t
+	}
+	expired := expiredIndices(alias, created, write, time.Now().Add(-maxAge))
+	for _, name := range expired {
+		if _, err := svc.client.DeleteIndex(name).Do(svc.ctx); err != nil {
+			return fmt.Errorf("Failed to delete index %s: %s", name, err)
+		}
+		svc.logger.Info("Deleted expired index", zap.String("index", name), zap.Time("created", created[name]))
+	}
+	return nil
+}
+
+// expiredIndices returns the rolled over indexes of alias created before
+// cutoff, never including the current write index
+func expiredIndices(alias string, created map[string]time.Time, write string, cutoff time.Time) []string {
+	var expired []string
+	for name, t := range created {
+		if _, ok := rolloverNumber(alias, name); ok && name != write && t.Before(cutoff) {
+			expired = append(expired, name)
+		}
+	}
+	sort.Strings(expired)
+	return expired
+}
+
+// creationDate extracts index.creation_date from the index settings
+func creationDate(settings map[string]interface{}) (time.Time, error) {
+	index, ok := settings["index"].(map[string]interface{})
+	if !ok {
+		return time.Time{}, fmt.Errorf("missing index settings")
+	}
+	v, ok := index["creation_date"].(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("missing creation_date")
+	}
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)), nil
+}
+
+// parseAge parses a duration which, in addition to the units supported by
+// time.ParseDuration, accepts Elasticsearch style days eg 30d
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
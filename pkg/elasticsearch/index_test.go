@@ -0,0 +1,549 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+func TestExpiredIndices(t *testing.T) {
+	now := time.Now()
+	created := map[string]time.Time{
+		"prom-metrics-000001": now.Add(-48 * time.Hour),
+		"prom-metrics-000002": now.Add(-30 * time.Hour),
+		"prom-metrics-000003": now.Add(-2 * time.Hour),
+		// match the pattern but were not created by rollover
+		"prom-metrics-archive":    now.Add(-72 * time.Hour),
+		"prom-metrics-2019.01.01": now.Add(-72 * time.Hour),
+	}
+	tests := []struct {
+		name  string
+		write string
+		want  []string
+	}{
+		{"rolled over", "prom-metrics-000003", []string{"prom-metrics-000001", "prom-metrics-000002"}},
+		// just rolled over with a max age below the retention
+		{"write index expired", "prom-metrics-000002", []string{"prom-metrics-000001"}},
+	}
+	for _, test := range tests {
+		got := expiredIndices("prom-metrics", created, test.write, now.Add(-24*time.Hour))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDeleteExpiredIndices(t *testing.T) {
+	now := time.Now()
+	millis := func(age time.Duration) string {
+		return strconv.FormatInt(now.Add(-age).UnixNano()/int64(time.Millisecond), 10)
+	}
+	settings := map[string]interface{}{}
+	for name, age := range map[string]time.Duration{
+		"prom-metrics-1":       72 * time.Hour,
+		"prom-metrics-000002":  48 * time.Hour,
+		"prom-metrics-000003":  time.Hour,
+		"prom-metrics-archive": 72 * time.Hour,
+	} {
+		settings[name] = map[string]interface{}{
+			"settings": map[string]interface{}{"index": map[string]interface{}{"creation_date": millis(age)}},
+		}
+	}
+	var mu sync.Mutex
+	var deleted []string
+	client, srv := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/prom-metrics/_alias":
+			// after a rollover without ILM the alias only names the new index
+			w.Write([]byte(`{"prom-metrics-000003":{"aliases":{"prom-metrics":{}}}}`))
+		case r.Method == "GET" && r.URL.Path == "/prom-metrics-*/_settings":
+			json.NewEncoder(w).Encode(settings)
+		case r.Method == "DELETE":
+			mu.Lock()
+			deleted = append(deleted, strings.TrimPrefix(r.URL.Path, "/"))
+			mu.Unlock()
+			w.Write([]byte(`{"acknowledged":true}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	svc := &IndexService{
+		ctx:    context.Background(),
+		client: client,
+		config: &IndexConfig{Alias: "prom-metrics"},
+		logger: zap.NewNop(),
+	}
+
+	if err := svc.deleteExpiredIndices(24 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"prom-metrics-000002", "prom-metrics-1"}
+	if !reflect.DeepEqual(deleted, want) {
+		t.Errorf("got deleted %v, want %v", deleted, want)
+	}
+}
+
+// jsonObject returns the object found by following keys from m, nil if
+// there is none
+func jsonObject(m map[string]interface{}, keys ...string) map[string]interface{} {
+	for _, key := range keys {
+		m, _ = m[key].(map[string]interface{})
+	}
+	return m
+}
+
+func TestEnsureIndexTemplate(t *testing.T) {
+	config := IndexTemplateConfig{
+		Alias:         "prom-metrics",
+		Shards:        1,
+		Replicas:      0,
+		Codec:         "best_compression",
+		LabelText:     "label_text",
+		LabelMappings: []LabelMapping{{Name: "pod", Type: "text"}, {Name: "instance", Type: "none"}},
+		ILMPolicy:     "p+1",
+		Typeless:      true,
+		Components:    []string{"<shared>"},
+	}
+	tests := []struct {
+		name   string
+		modify func(c *IndexTemplateConfig)
+		path   string
+	}{
+		{"legacy", func(c *IndexTemplateConfig) {}, "/_template/prom-metrics"},
+		// Elasticsearch 6 requires the mapping type
+		{"legacy typed", func(c *IndexTemplateConfig) { c.Typeless = false }, "/_template/prom-metrics"},
+		{"composable", func(c *IndexTemplateConfig) { c.Composable = true }, "/_index_template/prom-metrics"},
+		{"data stream", func(c *IndexTemplateConfig) { c.DataStream = true }, "/_index_template/prom-metrics"},
+		{"legacy named", func(c *IndexTemplateConfig) { c.Name = "custom" }, "/_template/custom"},
+		{"composable named", func(c *IndexTemplateConfig) { c.Name = "custom"; c.Composable = true }, "/_index_template/custom"},
+		{"refresh interval", func(c *IndexTemplateConfig) { c.RefreshInterval = "30s" }, "/_template/prom-metrics"},
+		{"routing shards", func(c *IndexTemplateConfig) { c.RoutingShards = 30 }, "/_template/prom-metrics"},
+		{"without label text", func(c *IndexTemplateConfig) { c.LabelText = "" }, "/_template/prom-metrics"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var path string
+			var body []byte
+			client, srv := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				path = r.URL.Path
+				body, _ = ioutil.ReadAll(r.Body)
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"acknowledged":true}`))
+			}))
+			defer srv.Close()
+			c := config
+			test.modify(&c)
+			if err := EnsureIndexTemplate(context.Background(), client, &c); err != nil {
+				t.Fatal(err)
+			}
+			if path != test.path {
+				t.Errorf("got path %s, want %s", path, test.path)
+			}
+			var got map[string]interface{}
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Fatalf("got invalid JSON %s: %s", body, err)
+			}
+			// composable templates nest the settings and mappings
+			template := got
+			if c.Composable || c.DataStream {
+				template = got["template"].(map[string]interface{})
+			}
+			settings, _ := template["settings"].(map[string]interface{})
+			if settings["index.lifecycle.name"] != "p+1" || settings["index.codec"] != "best_compression" {
+				t.Errorf("got settings %v, want the ILM policy and codec verbatim", settings)
+			}
+			if refresh, ok := settings["index.refresh_interval"]; ok != (c.RefreshInterval != "") || ok && refresh != c.RefreshInterval {
+				t.Errorf("got refresh interval %v, want %q omitted when empty", refresh, c.RefreshInterval)
+			}
+			if shards, ok := settings["number_of_routing_shards"]; ok != (c.RoutingShards != 0) || ok && shards != float64(c.RoutingShards) {
+				t.Errorf("got routing shards %v, want %d omitted when 0", shards, c.RoutingShards)
+			}
+			if c.Composable || c.DataStream {
+				if components, _ := got["composed_of"].([]interface{}); len(components) != 1 || components[0] != "<shared>" {
+					t.Errorf("got composed_of %v, want [<shared>]", got["composed_of"])
+				}
+			}
+			mappings, _ := template["mappings"].(map[string]interface{})
+			if !c.Typeless {
+				mappings, _ = mappings[sampleType].(map[string]interface{})
+			}
+			if _, ok := mappings["properties"]; !ok {
+				t.Errorf("got mappings %v, want properties with typeless %t", template["mappings"], c.Typeless)
+			}
+			// label mappings merge with the fixed types of the built in fields
+			if typ := jsonObject(mappings, "properties", "timestamp")["type"]; typ != "date" {
+				t.Errorf("got timestamp type %v, want date", typ)
+			}
+			labels := jsonObject(mappings, "properties", "label", "properties")
+			for name, want := range map[string]string{"__name__": "keyword", "pod": "text", "instance": "keyword"} {
+				if typ := jsonObject(labels, name)["type"]; typ != want {
+					t.Errorf("got %s type %v, want %s", name, typ, want)
+				}
+			}
+			if index, ok := jsonObject(labels, "instance")["index"]; !ok || index != false {
+				t.Errorf("got instance mapping %v, want it not indexed", labels["instance"])
+			}
+			// indexed label values are copied to the label text field
+			var want interface{}
+			if c.LabelText != "" {
+				want = c.LabelText
+			}
+			dynamic, _ := mappings["dynamic_templates"].([]interface{})
+			if len(dynamic) != 1 {
+				t.Fatalf("got dynamic templates %v, want the strings one", dynamic)
+			}
+			for field, mapping := range map[string]map[string]interface{}{
+				"__name__":        jsonObject(labels, "__name__"),
+				"pod":             jsonObject(labels, "pod"),
+				"dynamic strings": jsonObject(dynamic[0].(map[string]interface{}), "strings", "mapping"),
+			} {
+				if copyTo := mapping["copy_to"]; copyTo != want {
+					t.Errorf("got %s copied to %v, want %v", field, copyTo, want)
+				}
+			}
+			if copyTo, ok := jsonObject(labels, "instance")["copy_to"]; ok {
+				t.Errorf("got the not indexed instance copied to %v, want it not copied", copyTo)
+			}
+			if c.LabelText != "" && jsonObject(mappings, "properties", c.LabelText)["type"] != "text" {
+				t.Errorf("got %s mapping %v, want text", c.LabelText, jsonObject(mappings, "properties", c.LabelText))
+			}
+		})
+	}
+}
+
+func TestCreateBody(t *testing.T) {
+	for _, ilm := range []bool{false, true} {
+		svc := &IndexService{config: &IndexConfig{Alias: "prom+metrics", ILM: ilm}}
+		body, err := svc.createBody()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got struct {
+			Aliases map[string]struct {
+				IsWriteIndex bool `json:"is_write_index"`
+			} `json:"aliases"`
+		}
+		if err := json.Unmarshal([]byte(body), &got); err != nil {
+			t.Fatalf("got invalid JSON %s: %s", body, err)
+		}
+		alias, ok := got.Aliases["prom+metrics"]
+		if !ok || alias.IsWriteIndex != ilm {
+			t.Errorf("ILM %t: got aliases %+v, want prom+metrics with is_write_index %t", ilm, got.Aliases, ilm)
+		}
+	}
+}
+
+// esServer answers requests by method and path, eg "GET /_alias", with
+// canned JSON bodies and any other request with 404, recording each request
+// and its body
+type esServer struct {
+	mu        sync.Mutex
+	responses map[string]string
+	requests  []string
+	bodies    map[string]string
+}
+
+func (s *esServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	key := r.Method + " " + r.URL.Path
+	s.mu.Lock()
+	s.requests = append(s.requests, key)
+	if s.bodies == nil {
+		s.bodies = map[string]string{}
+	}
+	s.bodies[key] = string(body)
+	res, ok := s.responses[key]
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":{"type":"index_not_found_exception"},"status":404}`))
+		return
+	}
+	w.Write([]byte(res))
+}
+
+// recorded returns the requests made so far
+func (s *esServer) recorded() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+func newTestIndexService(client *elastic.Client, config *IndexConfig) *IndexService {
+	ctx, cancel := context.WithCancel(context.Background())
+	if config.Alias == "" {
+		config.Alias = "prom-metrics"
+	}
+	return &IndexService{
+		ctx:    ctx,
+		client: client,
+		config: config,
+		logger: zap.NewNop(),
+		cancel: cancel,
+		after:  time.After,
+	}
+}
+
+func TestEnsureAlias(t *testing.T) {
+	settings := `{"prom-metrics-1":{"settings":{}},"prom-metrics-000002":{"settings":{}},"prom-metrics-archive":{"settings":{}}}`
+	tests := []struct {
+		name     string
+		exists   bool
+		created  bool
+		requests []string
+	}{
+		{"present", true, false, []string{"HEAD /prom-metrics"}},
+		{"missing", false, true, []string{"HEAD /prom-metrics", "GET /prom-metrics-*/_settings", "PUT /prom-metrics-000003"}},
+	}
+	for _, test := range tests {
+		es := &esServer{responses: map[string]string{
+			"GET /prom-metrics-*/_settings": settings,
+			"PUT /prom-metrics-000003":      `{"acknowledged":true,"index":"prom-metrics-000003"}`,
+		}}
+		if test.exists {
+			es.responses["HEAD /prom-metrics"] = ""
+		}
+		client, srv := newTestClient(t, es)
+		svc := newTestIndexService(client, &IndexConfig{})
+		created, err := svc.EnsureAlias(context.Background())
+		srv.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if created != test.created {
+			t.Errorf("%s: got created %t, want %t", test.name, created, test.created)
+		}
+		if got := es.recorded(); !reflect.DeepEqual(got, test.requests) {
+			t.Errorf("%s: got requests %v, want %v", test.name, got, test.requests)
+		}
+		if !test.created {
+			continue
+		}
+		var body struct {
+			Aliases map[string]interface{}
+		}
+		if err := json.Unmarshal([]byte(es.bodies["PUT /prom-metrics-000003"]), &body); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := body.Aliases["prom-metrics"]; !ok {
+			t.Errorf("%s: got aliases %v, want the index created behind prom-metrics", test.name, body.Aliases)
+		}
+	}
+}
+
+// fakeClock replaces time.After, sending each duration waited for to waits
+// and firing once tick is called
+type fakeClock struct {
+	waits chan time.Duration
+	ticks chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{waits: make(chan time.Duration, 1), ticks: make(chan time.Time)}
+}
+
+func (c *fakeClock) after(d time.Duration) <-chan time.Time {
+	c.waits <- d
+	return c.ticks
+}
+
+func (c *fakeClock) tick() {
+	c.ticks <- time.Now()
+}
+
+func TestRolloverInterval(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		want     time.Duration
+	}{
+		{"configured", 42 * time.Second, 42 * time.Second},
+		{"default", 0, defaultCheckInterval},
+	}
+	for _, test := range tests {
+		es := &esServer{responses: map[string]string{
+			"HEAD /prom-metrics":           "",
+			"POST /prom-metrics/_rollover": `{"old_index":"prom-metrics-1","new_index":"prom-metrics-000002","rolled_over":false}`,
+		}}
+		client, srv := newTestClient(t, es)
+		svc := newTestIndexService(client, &IndexConfig{MaxDocs: 10, CheckInterval: test.interval})
+		clock := newFakeClock()
+		svc.after = clock.after
+		done := make(chan error)
+		go func() { done <- svc.rolloverIndex() }()
+
+		for i := 0; i < 2; i++ {
+			if got := <-clock.waits; got != test.want {
+				t.Errorf("%s: got wait %s, want %s", test.name, got, test.want)
+			}
+			if got := es.recorded(); len(got) != 2*i {
+				t.Errorf("%s: got requests %v before tick %d", test.name, got, i+1)
+			}
+			clock.tick()
+		}
+		<-clock.waits
+		want := []string{"HEAD /prom-metrics", "POST /prom-metrics/_rollover", "HEAD /prom-metrics", "POST /prom-metrics/_rollover"}
+		if got := es.recorded(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got requests %v, want a check per tick %v", test.name, got, want)
+		}
+		svc.cancel()
+		<-done
+		srv.Close()
+	}
+}
+
+func TestIndexServiceLoopsEnd(t *testing.T) {
+	tests := []struct {
+		name string
+		stop func(svc *IndexService, cancel context.CancelFunc)
+	}{
+		{"closed", func(svc *IndexService, cancel context.CancelFunc) { svc.Close() }},
+		{"context cancelled", func(svc *IndexService, cancel context.CancelFunc) {
+			cancel()
+			svc.wg.Wait()
+		}},
+	}
+	for _, test := range tests {
+		es := &esServer{responses: map[string]string{"HEAD /prom-metrics": ""}}
+		client, srv := newTestClient(t, es)
+		ctx, cancel := context.WithCancel(context.Background())
+		svc, err := NewIndexService(ctx, zap.NewNop(), client, &IndexConfig{
+			Alias:           "prom-metrics",
+			RetentionMaxAge: "30d",
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		stopped := make(chan struct{})
+		go func() {
+			test.stop(svc, cancel)
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Errorf("%s: rollover and retention loops still running", test.name)
+		}
+		cancel()
+		srv.Close()
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name     string
+		task     string
+		requests []string
+	}{
+		{
+			"reindexed",
+			`{"completed":true,"response":{"created":5,"failures":[]}}`,
+			[]string{"POST /prom-metrics/_rollover", "PUT /prom-metrics-1/_settings", "POST /_reindex", "GET /_tasks/node:1", "DELETE /prom-metrics-1"},
+		},
+		{
+			// the old index is kept for the docs not reindexed
+			"failures",
+			`{"completed":true,"response":{"created":4,"failures":[{"index":"prom-metrics-000002","status":400}]}}`,
+			[]string{"POST /prom-metrics/_rollover", "PUT /prom-metrics-1/_settings", "POST /_reindex", "GET /_tasks/node:1"},
+		},
+	}
+	for _, test := range tests {
+		es := &esServer{responses: map[string]string{
+			"POST /prom-metrics/_rollover":  `{"old_index":"prom-metrics-1","new_index":"prom-metrics-000002","rolled_over":true}`,
+			"PUT /prom-metrics-1/_settings": `{"acknowledged":true}`,
+			"POST /_reindex":                `{"task":"node:1"}`,
+			"GET /_tasks/node:1":            test.task,
+			"DELETE /prom-metrics-1":        `{"acknowledged":true}`,
+		}}
+		client, srv := newTestClient(t, es)
+		svc := newTestIndexService(client, &IndexConfig{})
+		svc.after = func(time.Duration) <-chan time.Time {
+			c := make(chan time.Time, 1)
+			c <- time.Now()
+			return c
+		}
+		res, err := svc.Migrate(context.Background())
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if res.OldIndex != "prom-metrics-1" || res.NewIndex != "prom-metrics-000002" || res.Task != "node:1" {
+			t.Errorf("%s: got result %+v", test.name, res)
+		}
+		svc.wg.Wait()
+		srv.Close()
+
+		if got := es.recorded(); !reflect.DeepEqual(got, test.requests) {
+			t.Errorf("%s: got requests %v, want %v", test.name, got, test.requests)
+		}
+		var reindex struct {
+			Source struct{ Index string }
+			Dest   struct{ Index string }
+		}
+		if err := json.Unmarshal([]byte(es.bodies["POST /_reindex"]), &reindex); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if reindex.Source.Index != "prom-metrics-1" || reindex.Dest.Index != "prom-metrics-000002" {
+			t.Errorf("%s: got reindex %s, want the old index into the new one", test.name, es.bodies["POST /_reindex"])
+		}
+		if got := es.bodies["PUT /prom-metrics-1/_settings"]; got != `{"index":{"blocks":{"write":true}}}` {
+			t.Errorf("%s: got settings %s, want writes to the old index blocked", test.name, got)
+		}
+	}
+}
+
+func TestRolloverConditions(t *testing.T) {
+	tests := []struct {
+		name   string
+		config IndexConfig
+		want   map[string]interface{}
+	}{
+		{
+			"all",
+			IndexConfig{MaxAge: "7d", MaxDocs: 1000, MaxSize: "50gb"},
+			map[string]interface{}{"max_age": "7d", "max_docs": 1000.0, "max_size": "50gb"},
+		},
+		{"docs only", IndexConfig{MaxDocs: 1000}, map[string]interface{}{"max_docs": 1000.0}},
+	}
+	for _, test := range tests {
+		es := &esServer{responses: map[string]string{
+			"HEAD /prom-metrics":           "",
+			"POST /prom-metrics/_rollover": `{"old_index":"prom-metrics-1","new_index":"prom-metrics-000002","rolled_over":true}`,
+		}}
+		client, srv := newTestClient(t, es)
+		config := test.config
+		svc := newTestIndexService(client, &config)
+		clock := newFakeClock()
+		svc.after = clock.after
+		done := make(chan error)
+		go func() { done <- svc.rolloverIndex() }()
+		<-clock.waits
+		clock.tick()
+		<-clock.waits
+		svc.cancel()
+		<-done
+		srv.Close()
+
+		var body struct {
+			Conditions map[string]interface{}
+		}
+		if err := json.Unmarshal([]byte(es.bodies["POST /prom-metrics/_rollover"]), &body); err != nil {
+			t.Fatalf("%s: got rollover body %q: %s", test.name, es.bodies["POST /prom-metrics/_rollover"], err)
+		}
+		if !reflect.DeepEqual(body.Conditions, test.want) {
+			t.Errorf("%s: got conditions %v, want %v", test.name, body.Conditions, test.want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package elasticsearch
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+// IndexStatsService periodically polls the stats of the indexes behind the
+// alias and exposes their doc count and size as Prometheus gauges
+type IndexStatsService struct {
+	ctx      context.Context
+	client   *elastic.Client
+	logger   *zap.Logger
+	alias    string
+	interval time.Duration
+	docs     *prometheus.GaugeVec
+	size     *prometheus.GaugeVec
+}
+
+// NewIndexStatsService registers the index gauges and starts polling the
+// indexes behind alias every interval until ctx is done
+func NewIndexStatsService(ctx context.Context, logger *zap.Logger, client *elastic.Client, alias string, interval time.Duration) *IndexStatsService {
+	svc := &IndexStatsService{
+		ctx:      ctx,
+		client:   client,
+		logger:   logger,
+		alias:    alias,
+		interval: interval,
+		docs: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "index_docs",
+			Help:      "Number of primary docs per index behind the alias",
+		}, []string{"index"}),
+		size: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "index_size_bytes",
+			Help:      "Store size in bytes including replicas per index behind the alias",
+		}, []string{"index"}),
+	}
+	prometheus.MustRegister(svc)
+	go svc.poll()
+	return svc
+}
+
+// Describe implements prometheus.Collector
+func (svc *IndexStatsService) Describe(ch chan<- *prometheus.Desc) {
+	svc.docs.Describe(ch)
+	svc.size.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (svc *IndexStatsService) Collect(ch chan<- prometheus.Metric) {
+	svc.docs.Collect(ch)
+	svc.size.Collect(ch)
+}
+
+func (svc *IndexStatsService) poll() error {
+	svc.update()
+	for {
+		select {
+		case <-time.After(svc.interval):
+			svc.update()
+		case <-svc.ctx.Done():
+			svc.logger.Info("Index stats service exiting")
+			return svc.ctx.Err()
+		}
+	}
+}
+
+func (svc *IndexStatsService) update() {
+	// the stats API resolves the alias, or data stream, to its indexes
+	res, err := svc.client.IndexStats(svc.alias).Metric("docs", "store").Do(svc.ctx)
+	if err != nil {
+		svc.logger.Error("Failed to get index stats", zap.Error(err))
+		return
+	}
+	// indexes no longer behind the alias are dropped
+	svc.docs.Reset()
+	svc.size.Reset()
+	for name, s := range res.Indices {
+		if s.Primaries != nil && s.Primaries.Docs != nil {
+			svc.docs.WithLabelValues(name).Set(float64(s.Primaries.Docs.Count))
+		}
+		if s.Total != nil && s.Total.Store != nil {
+			svc.size.WithLabelValues(name).Set(float64(s.Total.Store.SizeInBytes))
+		}
+	}
+}
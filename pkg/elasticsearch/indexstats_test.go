@@ -0,0 +1,91 @@
+package elasticsearch
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+)
+
+// gaugeValues returns the value of each gauge in vec by its index label
+func gaugeValues(vec *prometheus.GaugeVec) map[string]float64 {
+	ch := make(chan prometheus.Metric, 10)
+	vec.Collect(ch)
+	close(ch)
+	values := map[string]float64{}
+	for metric := range ch {
+		var m dto.Metric
+		metric.Write(&m)
+		values[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+	}
+	return values
+}
+
+func TestIndexStatsUpdate(t *testing.T) {
+	stats := []string{
+		`{"_shards":{"total":4,"successful":4,"failed":0},"indices":{
+			"prom-metrics-000001":{"primaries":{"docs":{"count":1000,"deleted":0},"store":{"size_in_bytes":4096}},
+				"total":{"docs":{"count":2000,"deleted":0},"store":{"size_in_bytes":8192}}},
+			"prom-metrics-000002":{"primaries":{"docs":{"count":10,"deleted":0},"store":{"size_in_bytes":512}},
+				"total":{"docs":{"count":20,"deleted":0},"store":{"size_in_bytes":1024}}}}}`,
+		// the first index was deleted by its lifecycle policy
+		`{"_shards":{"total":2,"successful":2,"failed":0},"indices":{
+			"prom-metrics-000002":{"primaries":{"docs":{"count":30,"deleted":0},"store":{"size_in_bytes":1536}},
+				"total":{"docs":{"count":60,"deleted":0},"store":{"size_in_bytes":3072}}}}}`,
+	}
+	var served int
+	client, srv := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/prom-metrics/_stats/docs,store" {
+			t.Errorf("got request to %s, want the alias stats", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(stats[served]))
+		served++
+	}))
+	defer srv.Close()
+	svc := &IndexStatsService{
+		ctx:      context.Background(),
+		client:   client,
+		logger:   zap.NewNop(),
+		alias:    "prom-metrics",
+		interval: time.Minute,
+		docs:     prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "index_docs"}, []string{"index"}),
+		size:     prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "index_size_bytes"}, []string{"index"}),
+	}
+
+	tests := []struct {
+		docs map[string]float64
+		size map[string]float64
+	}{
+		{
+			docs: map[string]float64{"prom-metrics-000001": 1000, "prom-metrics-000002": 10},
+			size: map[string]float64{"prom-metrics-000001": 8192, "prom-metrics-000002": 1024},
+		},
+		{
+			docs: map[string]float64{"prom-metrics-000002": 30},
+			size: map[string]float64{"prom-metrics-000002": 3072},
+		},
+	}
+	for i, test := range tests {
+		svc.update()
+		docs, size := gaugeValues(svc.docs), gaugeValues(svc.size)
+		if len(docs) != len(test.docs) || len(size) != len(test.size) {
+			t.Errorf("update %d: got docs %v, size %v, want %v, %v", i, docs, size, test.docs, test.size)
+			continue
+		}
+		for index, want := range test.docs {
+			if docs[index] != want {
+				t.Errorf("update %d: got %v docs in %s, want %v", i, docs[index], index, want)
+			}
+		}
+		for index, want := range test.size {
+			if size[index] != want {
+				t.Errorf("update %d: got %v bytes in %s, want %v", i, size[index], index, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package elasticsearch
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/prometheus/prompb"
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+// maxLabelResults caps the label names or values returned by LabelNames and
+// LabelValues
+const maxLabelResults = 10000
+
+// LabelNames returns the sorted names of the labels of samples between start
+// and end in ms, at most maxLabelResults of them
+func (svc *ReadService) LabelNames(ctx context.Context, start, end int64) ([]string, error) {
+	if svc.config.Fields.Nested {
+		return svc.nestedTerms(ctx, svc.config.Fields.label("name"), nil, start, end)
+	}
+	index := svc.index(&prompb.Query{})
+	prefix := svc.config.Fields.withDefaults().Label + "."
+	caps, err := svc.client.FieldCaps(index).Fields(prefix + "*").Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var mapped []string
+	for field, types := range caps.Fields {
+		if !strings.HasPrefix(field, prefix) {
+			continue
+		}
+		// labels with dots in their name also map their parent objects
+		if _, ok := types["object"]; ok && len(types) == 1 {
+			continue
+		}
+		mapped = append(mapped, strings.TrimPrefix(field, prefix))
+	}
+	if len(mapped) == 0 {
+		return []string{}, nil
+	}
+	sort.Strings(mapped)
+	if len(mapped) > maxLabelResults {
+		mapped = mapped[:maxLabelResults]
+	}
+
+	// names are mapped once seen in any index, keep those with samples in
+	// the window
+	exists := elastic.NewFiltersAggregation()
+	for _, name := range mapped {
+		exists = exists.FilterWithName(name, elastic.NewExistsQuery(svc.config.Fields.label(name)))
+	}
+	res, err := svc.client.Search(index).
+		Type(searchTypes(svc.config.Typeless)...).
+		Query(svc.rangeQuery(start, end)).
+		Size(0).
+		Aggregation("names", exists).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	agg, ok := res.Aggregations.Filters("names")
+	if !ok {
+		return names, nil
+	}
+	for _, name := range mapped {
+		if b, ok := agg.NamedBuckets[name]; ok && b.DocCount > 0 {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// LabelValues returns the sorted values of the named label of samples between
+// start and end in ms, at most maxLabelResults of them
+func (svc *ReadService) LabelValues(ctx context.Context, name string, start, end int64) ([]string, error) {
+	if svc.config.Fields.Nested {
+		return svc.nestedTerms(ctx, svc.config.Fields.label("value"), elastic.NewTermQuery(svc.config.Fields.label("name"), name), start, end)
+	}
+	values := elastic.NewTermsAggregation().
+		Field(svc.config.Fields.label(name)).
+		Size(maxLabelResults).
+		OrderByKeyAsc()
+	res, err := svc.client.Search(svc.index(&prompb.Query{})).
+		Type(searchTypes(svc.config.Typeless)...).
+		Query(svc.rangeQuery(start, end)).
+		Size(0).
+		Aggregation("values", values).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ret := []string{}
+	agg, ok := res.Aggregations.Terms("values")
+	if !ok {
+		return ret, nil
+	}
+	for _, b := range agg.Buckets {
+		if v, ok := b.Key.(string); ok {
+			ret = append(ret, v)
+		}
+	}
+	return ret, nil
+}
+
+// nestedTerms returns the sorted values of field of the nested labels
+// matching filter, all labels when nil, of samples between start and end in
+// ms, at most maxLabelResults of them
+func (svc *ReadService) nestedTerms(ctx context.Context, field string, filter elastic.Query, start, end int64) ([]string, error) {
+	if filter == nil {
+		filter = elastic.NewMatchAllQuery()
+	}
+	terms := elastic.NewTermsAggregation().
+		Field(field).
+		Size(maxLabelResults).
+		OrderByKeyAsc()
+	labels := elastic.NewNestedAggregation().
+		Path(svc.config.Fields.withDefaults().Label).
+		SubAggregation("labels", elastic.NewFilterAggregation().Filter(filter).SubAggregation("terms", terms))
+	res, err := svc.client.Search(svc.index(&prompb.Query{})).
+		Type(searchTypes(svc.config.Typeless)...).
+		Query(svc.rangeQuery(start, end)).
+		Size(0).
+		Aggregation("nested", labels).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ret := []string{}
+	nested, ok := res.Aggregations.Nested("nested")
+	if !ok {
+		return ret, nil
+	}
+	matching, ok := nested.Filter("labels")
+	if !ok {
+		return ret, nil
+	}
+	agg, ok := matching.Terms("terms")
+	if !ok {
+		return ret, nil
+	}
+	for _, b := range agg.Buckets {
+		if v, ok := b.Key.(string); ok {
+			ret = append(ret, v)
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,158 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNestedLabelNamesAndValues(t *testing.T) {
+	aggs := `{"nested":{"doc_count":3,"labels":{"doc_count":2,"terms":{"buckets":[{"key":"a","doc_count":1},{"key":"b","doc_count":1}]}}}}`
+	fields := FieldNames{Timestamp: "@ts", Label: "labels", Nested: true}
+	tests := []struct {
+		name   string
+		search func(svc *ReadService) ([]string, error)
+		filter string
+	}{
+		{
+			"names",
+			func(svc *ReadService) ([]string, error) { return svc.LabelNames(context.Background(), 1000, 2000) },
+			`{"match_all":{}}`,
+		},
+		{
+			"values",
+			func(svc *ReadService) ([]string, error) {
+				return svc.LabelValues(context.Background(), "job", 1000, 2000)
+			},
+			`{"term":{"labels.name":"job"}}`,
+		},
+	}
+	for _, test := range tests {
+		es := &searchServer{aggs: aggs}
+		client, srv := newTestClient(t, es)
+		svc := newTestReadService(client, &ReadConfig{Fields: fields})
+		got, err := test.search(svc)
+		srv.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if want := []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, want)
+		}
+		if len(es.bodies) != 1 {
+			t.Fatalf("%s: got %d searches, want 1", test.name, len(es.bodies))
+		}
+		var body struct {
+			Query        map[string]interface{}
+			Aggregations map[string]struct {
+				Nested       map[string]string
+				Aggregations map[string]struct {
+					Filter json.RawMessage
+				}
+			}
+		}
+		if err := json.Unmarshal([]byte(es.bodies[0]), &body); err != nil {
+			t.Fatal(err)
+		}
+		nested := body.Aggregations["nested"]
+		if nested.Nested["path"] != "labels" {
+			t.Errorf("%s: got nested path %q, want labels", test.name, nested.Nested["path"])
+		}
+		if got := string(nested.Aggregations["labels"].Filter); got != test.filter {
+			t.Errorf("%s: got label filter %s, want %s", test.name, got, test.filter)
+		}
+		if r, _ := body.Query["range"].(map[string]interface{}); r["@ts"] == nil {
+			t.Errorf("%s: got query %v, want the time range on @ts", test.name, body.Query)
+		}
+	}
+}
+
+func TestLabelNames(t *testing.T) {
+	es := &searchServer{aggs: `{"names":{"buckets":{
+		"__name__":{"doc_count":3},
+		"a.b":{"doc_count":1},
+		"job":{"doc_count":2},
+		"stale":{"doc_count":0}
+	}}}`}
+	var capsPath string
+	client, srv := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/_field_caps") {
+			es.ServeHTTP(w, r)
+			return
+		}
+		capsPath = r.URL.Path + "?" + r.URL.RawQuery
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"fields":{
+			"label.__name__":{"keyword":{"type":"keyword"}},
+			"label.a":{"object":{"type":"object"}},
+			"label.a.b":{"keyword":{"type":"keyword"}},
+			"label.job":{"keyword":{"type":"keyword"}},
+			"label.stale":{"keyword":{"type":"keyword"}}
+		}}`))
+	}))
+	defer srv.Close()
+	svc := newTestReadService(client, &ReadConfig{})
+	got, err := svc.LabelNames(context.Background(), 1000, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// stale is mapped without samples in the window
+	if want := []string{"__name__", "a.b", "job"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got names %v, want %v", got, want)
+	}
+	if capsPath != "/prom-metrics-*/_field_caps?fields=label.%2A" {
+		t.Errorf("got field caps request %s, want the label fields of prom-metrics-*", capsPath)
+	}
+	var body struct {
+		Aggregations struct {
+			Names struct {
+				Filters struct {
+					Filters map[string]map[string]map[string]string
+				}
+			}
+		}
+	}
+	if len(es.bodies) != 1 {
+		t.Fatalf("got %d searches, want 1", len(es.bodies))
+	}
+	if err := json.Unmarshal([]byte(es.bodies[0]), &body); err != nil {
+		t.Fatal(err)
+	}
+	filters := body.Aggregations.Names.Filters.Filters
+	if len(filters) != 4 || filters["a.b"]["exists"]["field"] != "label.a.b" {
+		t.Errorf("got filters %v, want an exists filter per mapped label", filters)
+	}
+}
+
+func TestLabelValues(t *testing.T) {
+	es := &searchServer{aggs: `{"values":{"buckets":[{"key":"api","doc_count":2},{"key":"node","doc_count":1}]}}`}
+	client, srv := newTestClient(t, es)
+	defer srv.Close()
+	svc := newTestReadService(client, &ReadConfig{})
+	got, err := svc.LabelValues(context.Background(), "job", 1000, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"api", "node"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got values %v, want %v", got, want)
+	}
+	var body struct {
+		Aggregations struct {
+			Values struct {
+				Terms struct {
+					Field string
+					Size  int
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal([]byte(es.bodies[0]), &body); err != nil {
+		t.Fatal(err)
+	}
+	if terms := body.Aggregations.Values.Terms; terms.Field != "label.job" || terms.Size != maxLabelResults {
+		t.Errorf("got terms %+v, want label.job bounded by %d", terms, maxLabelResults)
+	}
+}
@@ -0,0 +1,85 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+// maxMetadata caps the number of metrics returned by GetMetadata
+const maxMetadata = 10000
+
+// MetricMetadata describes a metric as sent by remote write 2.0
+type MetricMetadata struct {
+	Metric string `json:"metric"`
+	Type   string `json:"type,omitempty"`
+	Help   string `json:"help,omitempty"`
+	Unit   string `json:"unit,omitempty"`
+}
+
+// MetadataIndex returns the index metric metadata is stored in.  It is
+// deliberately outside the alias-* pattern so it is neither searched for
+// samples nor given the sample mapping.
+func MetadataIndex(alias string) string {
+	return alias + "_metadata"
+}
+
+// metadataRequest is the bulk request storing md, kept with it so md is
+// cached once Elasticsearch acknowledged it
+type metadataRequest struct {
+	*elastic.BulkIndexRequest
+	md MetricMetadata
+}
+
+// WriteMetadata queues metadata to be stored, one doc per metric, when
+// enabled by WriteConfig.Metadata.  Only metadata changed since it was last
+// stored is written.
+func (svc *WriteService) WriteMetadata(metadata []MetricMetadata) {
+	if !svc.config.Metadata {
+		return
+	}
+	for _, md := range metadata {
+		if prev, ok := svc.metadata.Load(md.Metric); ok && prev.(MetricMetadata) == md {
+			continue
+		}
+		r := elastic.
+			NewBulkIndexRequest().
+			Index(MetadataIndex(svc.config.Alias)).
+			Type(docType(svc.config.Typeless)).
+			Id(md.Metric).
+			Doc(md)
+		if svc.config.DryRun {
+			svc.metadata.Store(md.Metric, md)
+			svc.logDryRun(r)
+			continue
+		}
+		svc.processor.Add(&metadataRequest{BulkIndexRequest: r, md: md})
+	}
+}
+
+// GetMetadata returns the stored metadata of all metrics sorted by name,
+// none when nothing was stored yet
+func GetMetadata(ctx context.Context, client *elastic.Client, index string) ([]MetricMetadata, error) {
+	res, err := client.Search(index).
+		Query(elastic.NewMatchAllQuery()).
+		Sort("metric.keyword", true).
+		Size(maxMetadata).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	metadata := make([]MetricMetadata, 0, len(res.Hits.Hits))
+	for _, hit := range res.Hits.Hits {
+		var md MetricMetadata
+		if err := json.Unmarshal([]byte(*hit.Source), &md); err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal metadata: %s", err)
+		}
+		metadata = append(metadata, md)
+	}
+	return metadata, nil
+}
@@ -0,0 +1,53 @@
+package elasticsearch
+
+import (
+	"context"
+	"testing"
+
+	"go.uber.org/zap"
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+func TestWriteMetadataCachedOnceStored(t *testing.T) {
+	es := &bulkServer{responses: []*elastic.BulkResponse{testResponse(400), testResponse(201)}}
+	client, srv := newTestClient(t, es)
+	defer srv.Close()
+	svc, err := NewWriteService(context.Background(), zap.NewNop(), client, &WriteConfig{
+		Alias:        "prom-metrics",
+		Metadata:     true,
+		MaxDocs:      100,
+		FlushWorkers: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+	md := []MetricMetadata{{Metric: "up", Type: "gauge"}}
+
+	svc.WriteMetadata(md)
+	if _, ok := svc.metadata.Load("up"); ok {
+		t.Fatal("metadata cached before it was stored")
+	}
+	if err := svc.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := svc.metadata.Load("up"); ok {
+		t.Fatal("metadata cached although storing it failed")
+	}
+
+	// not cached, so written again
+	svc.WriteMetadata(md)
+	if err := svc.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := svc.metadata.Load("up"); !ok || got.(MetricMetadata) != md[0] {
+		t.Fatalf("got cached %v, want %v once stored", got, md[0])
+	}
+	svc.WriteMetadata(md)
+	if err := svc.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(es.names) != 2 {
+		t.Errorf("got %d bulk requests, want 2 as unchanged metadata is not written again", len(es.names))
+	}
+}
@@ -74,6 +74,157 @@ var (
 	)
 )
 
+func newBulkLatency() prometheus.Histogram {
+	return prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "bulk_duration_seconds",
+		Help:      "Latency of bulk requests committed to Elasticsearch",
+		Buckets:   prometheus.DefBuckets,
+	})
+}
+
+func newDeadLetterCounter() prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "deadlettered_total",
+		Help:      "Number of samples written to the dead letter file",
+	})
+}
+
+func newReadTruncatedCounter() prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "read_truncated_total",
+		Help:      "Number of read queries with results truncated at the max results limit",
+	})
+}
+
+func newDroppedCounter() prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dropped_total",
+		Help:      "Number of samples skipped by the write filter",
+	})
+}
+
+func newReceivedCounter() prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "received_samples_total",
+		Help:      "Number of samples received from remote write",
+	})
+}
+
+func newSentCounter() prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sent_samples_total",
+		Help:      "Number of samples Elasticsearch indexed",
+	})
+}
+
+func newFailedCounter() prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "failed_samples_total",
+		Help:      "Number of samples Elasticsearch failed to index",
+	})
+}
+
+func newDryRunCounter() prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dry_run_samples_total",
+		Help:      "Number of samples logged instead of indexed in dry run mode",
+	})
+}
+
+func newLabelLimitCounter() prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "label_limit_dropped_samples_total",
+		Help:      "Number of samples dropped as their series exceeded the label name limit",
+	})
+}
+
+func newFlushCounter() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bulk_flushes_total",
+		Help:      "Number of bulk commits by the threshold that triggered them, age, docs or size",
+	}, []string{"reason"})
+}
+
+func newOutOfRangeCounter() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "out_of_range_samples_total",
+		Help:      "Number of samples with timestamps outside the accepted range, by reason too_old or future",
+	}, []string{"reason"})
+}
+
+func newSampledOutCounter() prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sampled_out_samples_total",
+		Help:      "Number of samples of series not indexed by write sampling",
+	})
+}
+
+func newRejectedCounter() prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bulk_rejected_items_total",
+		Help:      "Number of bulk items rejected by Elasticsearch with 429 after retries",
+	})
+}
+
+func newDuplicateCounter() prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "duplicate_docs_total",
+		Help:      "Number of docs already indexed in a data stream with the same _id",
+	})
+}
+
+func newQueuedGauge(value func() float64) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queued_samples",
+		Help:      "Number of samples waiting to be committed to Elasticsearch",
+	}, value)
+}
+
+func newReadCacheHitsCounter() prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "read_cache_hits_total",
+		Help:      "Number of read queries answered from the query cache",
+	})
+}
+
+func newReadsInFlightGauge(value func() float64) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "reads_in_flight",
+		Help:      "Number of remote read requests searching Elasticsearch",
+	}, value)
+}
+
+// Describe implements prometheus.Collector for the read service
+func (svc *ReadService) Describe(ch chan<- *prometheus.Desc) {
+	svc.truncated.Describe(ch)
+	svc.inFlightGauge.Describe(ch)
+	svc.cacheHits.Describe(ch)
+}
+
+// Collect implements prometheus.Collector for the read service
+func (svc *ReadService) Collect(ch chan<- prometheus.Metric) {
+	svc.truncated.Collect(ch)
+	svc.inFlightGauge.Collect(ch)
+	svc.cacheHits.Collect(ch)
+}
+
 // Describe describes all the metrics exported by the memcached exporter. It
 // implements prometheus.Collector.
 func (svc *WriteService) Describe(ch chan<- *prometheus.Desc) {
@@ -87,6 +238,20 @@ func (svc *WriteService) Describe(ch chan<- *prometheus.Desc) {
 	ch <- failedDesc
 	ch <- queuedDesc
 	ch <- durationDesc
+	svc.latency.Describe(ch)
+	svc.deadCount.Describe(ch)
+	svc.dropped.Describe(ch)
+	svc.received.Describe(ch)
+	svc.sent.Describe(ch)
+	svc.failed.Describe(ch)
+	svc.queuedGauge.Describe(ch)
+	svc.dryRun.Describe(ch)
+	svc.labelDropped.Describe(ch)
+	svc.flushes.Describe(ch)
+	svc.outOfRange.Describe(ch)
+	svc.sampledOut.Describe(ch)
+	svc.rejected.Describe(ch)
+	svc.duplicates.Describe(ch)
 }
 
 // Collect fetches the statistics from the elasticsearch bulk processor, and
@@ -111,4 +276,18 @@ func (svc *WriteService) Collect(ch chan<- prometheus.Metric) {
 		ch <- prometheus.MustNewConstMetric(queuedDesc, prometheus.GaugeValue, float64(queued), strconv.Itoa(i))
 		ch <- prometheus.MustNewConstMetric(durationDesc, prometheus.GaugeValue, float64(duration), strconv.Itoa(i))
 	}
+	svc.latency.Collect(ch)
+	svc.deadCount.Collect(ch)
+	svc.dropped.Collect(ch)
+	svc.received.Collect(ch)
+	svc.sent.Collect(ch)
+	svc.failed.Collect(ch)
+	svc.queuedGauge.Collect(ch)
+	svc.dryRun.Collect(ch)
+	svc.labelDropped.Collect(ch)
+	svc.flushes.Collect(ch)
+	svc.outOfRange.Collect(ch)
+	svc.sampledOut.Collect(ch)
+	svc.rejected.Collect(ch)
+	svc.duplicates.Collect(ch)
 }
@@ -0,0 +1,66 @@
+package elasticsearch
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+// nextDay returns the start of the day in loc following now, when the next
+// daily index is first written to
+func nextDay(now time.Time, loc *time.Location) time.Time {
+	y, m, d := now.In(loc).Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+}
+
+// precreateWait returns how long to wait from now before creating the index
+// of day, which is lead before it starts or immediately when that has passed
+func precreateWait(now, day time.Time, lead time.Duration) time.Duration {
+	wait := day.Add(-lead).Sub(now)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// precreate creates the daily index of each next day PrecreateLead before
+// midnight, until ctx is done, so the first writes of the day do not wait
+// for Elasticsearch to create it.  Only the es_alias indexes are created,
+// tenant indexes are still created by their first write.
+func (svc *WriteService) precreate(ctx context.Context, client *elastic.Client) {
+	day := nextDay(time.Now(), svc.dailyLocation())
+	for {
+		select {
+		case <-time.After(precreateWait(time.Now(), day, svc.config.PrecreateLead)):
+			svc.createDailyIndex(ctx, client, svc.dailyIndex(svc.config.Alias, day.UnixNano()/int64(time.Millisecond)))
+			day = nextDay(day, svc.dailyLocation())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// createDailyIndex creates index unless it already exists, its settings and
+// mappings coming from the index template as when it is created by a write
+func (svc *WriteService) createDailyIndex(ctx context.Context, client *elastic.Client, index string) {
+	exists, err := client.IndexExists(index).Do(ctx)
+	if err != nil {
+		svc.logger.Error("Failed to check daily index", zap.String("index", index), zap.Error(err))
+		return
+	}
+	if exists {
+		return
+	}
+	_, err = client.CreateIndex(index).Do(ctx)
+	if e, ok := err.(*elastic.Error); ok && e.Details != nil && e.Details.Type == "resource_already_exists_exception" {
+		// created by a write in the meantime
+		return
+	}
+	if err != nil {
+		svc.logger.Error("Failed to create daily index", zap.String("index", index), zap.Error(err))
+		return
+	}
+	svc.logger.Info("Created daily index", zap.String("index", index))
+}
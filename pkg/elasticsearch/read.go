@@ -2,105 +2,478 @@ package elasticsearch
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/prompb"
+	"github.com/pwillie/prometheus-es-adapter/pkg/tracing"
 	"go.uber.org/zap"
 	elastic "gopkg.in/olivere/elastic.v6"
 )
 
+// ErrReadBusy is returned by Read when MaxConcurrent reads are already in
+// flight, callers should retry later
+var ErrReadBusy = errors.New("too many concurrent reads")
+
 // ReadService will proxy Prometheus queries to Elasticsearch
 type ReadService struct {
-	client *elastic.Client
-	config *ReadConfig
-	logger *zap.Logger
+	client    *elastic.Client
+	config    *ReadConfig
+	logger    *zap.Logger
+	truncated prometheus.Counter
+	// slots holds a token per read in flight when MaxConcurrent is set
+	slots         chan struct{}
+	inFlight      int64
+	inFlightGauge prometheus.GaugeFunc
+	// cache holds recent results when CacheSize is set
+	cache     *queryCache
+	cacheHits prometheus.Counter
 }
 
 // ReadConfig configures the ReadService
 type ReadConfig struct {
-	Alias   string
+	Alias string
+	// Tracer records a span per search query, nil for none
+	Tracer *tracing.Tracer
+	// MaxDocs is the number of docs fetched per scroll page
 	MaxDocs int
+	// MaxResults caps the total docs returned for a query, 0 means unlimited
+	MaxResults int
+	// DownsamplePoints enables server side downsampling, averaging samples
+	// into roughly this many buckets per series.  0 disables downsampling.
+	DownsamplePoints int
+	Stats            bool
+	Typeless         bool
+	// DataStream searches the data stream named after the alias
+	DataStream bool
+	// SeriesDocs reads series docs with nested samples, see WriteConfig
+	SeriesDocs bool
+	// Fields names the timestamp and label fields, see WriteConfig
+	Fields FieldNames
+	// TenantLabel narrows queries matching one value of this label to the
+	// tenant's indexes, see WriteConfig
+	TenantLabel string
+	// MaxConcurrent bounds the reads searching Elasticsearch at once, excess
+	// reads are rejected with ErrReadBusy.  0 for no limit.
+	MaxConcurrent int
+	// CacheSize is the number of query results kept in memory to answer
+	// identical queries within CacheTTL without searching.  0 disables the
+	// cache.
+	CacheSize int
+	CacheTTL  time.Duration
+	// QueryWorkers is the number of queries of one read request searched at
+	// once, 1 or less searches them in turn.  MaxConcurrent bounds the read
+	// requests instead.
+	QueryWorkers int
 }
 
 // NewReadService will create a new ReadService
 func NewReadService(logger *zap.Logger, client *elastic.Client, config *ReadConfig) *ReadService {
 	svc := &ReadService{
-		client: client,
-		config: config,
-		logger: logger,
+		client:    client,
+		config:    config,
+		logger:    logger,
+		truncated: newReadTruncatedCounter(),
+		cacheHits: newReadCacheHitsCounter(),
+	}
+	if config.CacheSize > 0 {
+		svc.cache = newQueryCache(config.CacheSize, config.CacheTTL)
+	}
+	if config.MaxConcurrent > 0 {
+		svc.slots = make(chan struct{}, config.MaxConcurrent)
+	}
+	svc.inFlightGauge = newReadsInFlightGauge(func() float64 {
+		return float64(atomic.LoadInt64(&svc.inFlight))
+	})
+	if config.Stats {
+		prometheus.MustRegister(svc)
 	}
-	// TODO: add stats
 	return svc
 }
 
-// Read will perform Elasticsearch query
+// Read will perform Elasticsearch query.  ErrReadBusy is returned without
+// searching when MaxConcurrent reads are already in flight.
 func (svc *ReadService) Read(ctx context.Context, req []*prompb.Query) ([]*prompb.QueryResult, error) {
-	results := make([]*prompb.QueryResult, 0, len(req))
-	for _, q := range req {
-		resp, err := svc.buildCommand(q).Do(ctx)
-		if err != nil {
-			return nil, err
+	if svc.slots != nil {
+		select {
+		case svc.slots <- struct{}{}:
+			defer func() { <-svc.slots }()
+		default:
+			return nil, ErrReadBusy
 		}
-		svc.logger.Debug("Query returned results", zap.Int64("hits", resp.Hits.TotalHits))
-		ts, err := svc.createTimeseries(resp.Hits)
-		if err != nil {
-			return nil, err
+	}
+	atomic.AddInt64(&svc.inFlight, 1)
+	defer atomic.AddInt64(&svc.inFlight, -1)
+	results := make([]*prompb.QueryResult, len(req))
+	workers := svc.config.QueryWorkers
+	if workers > len(req) {
+		workers = len(req)
+	}
+	if workers <= 1 {
+		for i, q := range req {
+			res, err := svc.read(ctx, q)
+			if err != nil {
+				return nil, err
+			}
+			results[i] = res
 		}
-		results = append(results, &prompb.QueryResult{Timeseries: ts})
+		return results, nil
+	}
+	// the first error cancels the queries still searching
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	queries := make(chan int)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queries {
+				res, err := svc.read(ctx, req[i])
+				if err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					continue
+				}
+				results[i] = res
+			}
+		}()
+	}
+	for i := range req {
+		queries <- i
+	}
+	close(queries)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
 	}
 	return results, nil
 }
 
-func (svc *ReadService) buildCommand(q *prompb.Query) *elastic.SearchService {
+// read answers one query of a read request, from the cache when enabled
+func (svc *ReadService) read(ctx context.Context, q *prompb.Query) (*prompb.QueryResult, error) {
+	var key string
+	if svc.cache != nil {
+		var err error
+		if key, err = cacheKey(q); err != nil {
+			return nil, err
+		}
+		if ts, ok := svc.cache.get(key); ok {
+			svc.cacheHits.Inc()
+			return &prompb.QueryResult{Timeseries: ts}, nil
+		}
+	}
+	ts, err := svc.query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if svc.cache != nil {
+		svc.cache.add(key, ts)
+	}
+	return &prompb.QueryResult{Timeseries: ts}, nil
+}
+
+// query searches Elasticsearch for the series matching q
+func (svc *ReadService) query(ctx context.Context, q *prompb.Query) ([]*prompb.TimeSeries, error) {
+	ctx, span := svc.config.Tracer.Start(ctx, "elasticsearch.search", tracing.KindClient)
+	defer span.End()
+	span.SetString("db.system", "elasticsearch")
+	span.SetString("es.alias", svc.config.Alias)
+	span.SetString("es.index", svc.index(q))
+	query, err := svc.buildQuery(q)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	start := time.Now()
+	if svc.config.DownsamplePoints > 0 {
+		ts, err := svc.downsample(ctx, query, q)
+		span.SetInt("es.latency_ms", int64(time.Since(start)/time.Millisecond))
+		span.SetInt("es.series", int64(len(ts)))
+		span.SetError(err)
+		return ts, err
+	}
+	hits, err := svc.fetch(ctx, svc.index(q), query)
+	span.SetInt("es.latency_ms", int64(time.Since(start)/time.Millisecond))
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	span.SetInt("es.hits", int64(len(hits)))
+	svc.logger.Debug("Query returned results", zap.Int("hits", len(hits)))
+	ts, err := svc.createTimeseries(hits, q)
+	span.SetInt("es.series", int64(len(ts)))
+	span.SetError(err)
+	return ts, err
+}
+
+// index returns the indexes to search for q
+func (svc *ReadService) index(q *prompb.Query) string {
+	if svc.config.DataStream {
+		return svc.config.Alias
+	}
+	if svc.config.TenantLabel != "" {
+		for _, m := range q.Matchers {
+			if m.Type == prompb.LabelMatcher_EQ && m.Name == svc.config.TenantLabel && m.Value != "" {
+				// the tenant index and its daily indexes, the label filter
+				// excludes other tenants sharing the prefix
+				return TenantIndex(svc.config.Alias, m.Value) + "*"
+			}
+		}
+	}
+	return svc.config.Alias + "-*"
+}
+
+func (svc *ReadService) buildQuery(q *prompb.Query) (elastic.Query, error) {
 	query := elastic.NewBoolQuery()
 	for _, m := range q.Matchers {
 		switch m.Type {
 		case prompb.LabelMatcher_EQ:
-			query = query.Filter(elastic.NewTermQuery("label."+m.Name, m.Value))
+			// an empty value matches series without the label
+			if m.Value == "" {
+				query = query.MustNot(svc.labelExists(m.Name))
+			} else {
+				query = query.Filter(svc.labelQuery(m.Name, func(field string) elastic.Query {
+					return elastic.NewTermQuery(field, m.Value)
+				}))
+			}
 		case prompb.LabelMatcher_NEQ:
-			query = query.MustNot(elastic.NewTermQuery("label."+m.Name, m.Value))
+			if m.Value == "" {
+				query = query.Filter(svc.labelExists(m.Name))
+			} else {
+				query = query.MustNot(svc.labelQuery(m.Name, func(field string) elastic.Query {
+					return elastic.NewTermQuery(field, m.Value)
+				}))
+			}
 		case prompb.LabelMatcher_RE:
-			query = query.Filter(elastic.NewRegexpQuery("label."+m.Name, m.Value))
+			re, err := svc.regexpQuery(m.Name, m.Value)
+			if err != nil {
+				return nil, err
+			}
+			query = query.Filter(re)
 		case prompb.LabelMatcher_NRE:
-			query = query.MustNot(elastic.NewRegexpQuery("label."+m.Name, m.Value))
+			re, err := svc.regexpQuery(m.Name, m.Value)
+			if err != nil {
+				return nil, err
+			}
+			query = query.MustNot(re)
 		default:
-			svc.logger.Panic("unknown match", zap.String("type", m.Type.String()))
+			return nil, fmt.Errorf("unknown match type %s", m.Type.String())
 		}
 	}
 
-	query = query.Filter(elastic.NewRangeQuery("timestamp").Gte(q.StartTimestampMs).Lte(q.EndTimestampMs))
+	return query.Filter(svc.rangeQuery(q.StartTimestampMs, q.EndTimestampMs)), nil
+}
+
+// labelQuery applies value, built for the field holding a label value, to
+// the named label.  Nested labels match a single name and value pair.
+func (svc *ReadService) labelQuery(name string, value func(field string) elastic.Query) elastic.Query {
+	if !svc.config.Fields.Nested {
+		return value(svc.config.Fields.label(name))
+	}
+	return elastic.NewNestedQuery(svc.config.Fields.withDefaults().Label, elastic.NewBoolQuery().Filter(
+		elastic.NewTermQuery(svc.config.Fields.label("name"), name),
+		value(svc.config.Fields.label("value")),
+	))
+}
+
+// labelExists matches docs with the named label
+func (svc *ReadService) labelExists(name string) elastic.Query {
+	if !svc.config.Fields.Nested {
+		return elastic.NewExistsQuery(svc.config.Fields.label(name))
+	}
+	return elastic.NewNestedQuery(svc.config.Fields.withDefaults().Label,
+		elastic.NewTermQuery(svc.config.Fields.label("name"), name))
+}
+
+// rangeQuery bounds a search to the window from start to end in ms, both ends
+// inclusive as Prometheus expects
+func (svc *ReadService) rangeQuery(start, end int64) elastic.Query {
+	if svc.config.SeriesDocs {
+		// series docs overlapping the window, samples outside it are dropped
+		// by createTimeseries
+		return elastic.NewBoolQuery().Filter(
+			elastic.NewRangeQuery(svc.config.Fields.timestamp()).Lte(end).Format("epoch_millis"),
+			elastic.NewRangeQuery("end_timestamp").Gte(start).Format("epoch_millis"),
+		)
+	}
+	return elastic.NewRangeQuery(svc.config.Fields.timestamp()).
+		Gte(start).
+		Lte(end).
+		Format("epoch_millis")
+}
 
-	return svc.client.Search().
-		Index(svc.config.Alias+"-*").
-		Type(sampleType).
+// fetch scrolls through all docs of index matching query, in timestamp order,
+// up to the configured MaxResults
+func (svc *ReadService) fetch(ctx context.Context, index string, query elastic.Query) ([]*elastic.SearchHit, error) {
+	scroll := svc.client.Scroll(index).
+		Type(searchTypes(svc.config.Typeless)...).
 		Query(query).
 		Size(svc.config.MaxDocs).
-		Sort("timestamp", true)
+		Sort(svc.config.Fields.timestamp(), true)
+	defer scroll.Clear(context.Background())
+
+	var hits []*elastic.SearchHit
+	for {
+		res, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return hits, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		hits = append(hits, res.Hits.Hits...)
+		if max := svc.config.MaxResults; max > 0 && len(hits) >= max {
+			if res.Hits.TotalHits > int64(max) {
+				svc.logger.Warn("Query results truncated",
+					zap.Int64("hits", res.Hits.TotalHits),
+					zap.Int("max", max))
+				svc.truncated.Inc()
+			}
+			if len(hits) > max {
+				hits = hits[:max]
+			}
+			return hits, nil
+		}
+	}
 }
 
-func (svc *ReadService) createTimeseries(results *elastic.SearchHits) ([]*prompb.TimeSeries, error) {
-	tsMap := make(map[string]*prompb.TimeSeries)
-	for _, r := range results.Hits {
+// downsample averages matching samples per series into date_histogram buckets
+// sized from the query window, returning bucket start times as timestamps.
+// Only docs carrying a series fingerprint are included.
+func (svc *ReadService) downsample(ctx context.Context, query elastic.Query, q *prompb.Query) ([]*prompb.TimeSeries, error) {
+	interval := (q.EndTimestampMs - q.StartTimestampMs) / int64(svc.config.DownsamplePoints)
+	if interval < 1000 {
+		interval = 1000
+	}
+	samples := elastic.NewDateHistogramAggregation().
+		Field(svc.config.Fields.timestamp()).
+		Interval(fmt.Sprintf("%dms", interval)).
+		MinDocCount(1).
+		SubAggregation("value", elastic.NewAvgAggregation().Field("value"))
+	labels := elastic.NewTopHitsAggregation().
+		Size(1).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include(svc.config.Fields.withDefaults().Label))
+	series := elastic.NewTermsAggregation().
+		Field("fingerprint").
+		Size(maxDownsampleSeries).
+		SubAggregation("labels", labels).
+		SubAggregation("samples", samples)
+
+	res, err := svc.client.Search(svc.index(q)).
+		Type(searchTypes(svc.config.Typeless)...).
+		Query(query).
+		Size(0).
+		Aggregation("series", series).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	agg, ok := res.Aggregations.Terms("series")
+	if !ok {
+		return nil, nil
+	}
+	ret := make([]*prompb.TimeSeries, 0, len(agg.Buckets))
+	for _, b := range agg.Buckets {
+		top, ok := b.TopHits("labels")
+		if !ok || top.Hits == nil || len(top.Hits.Hits) == 0 {
+			continue
+		}
 		var s prometheusSample
-		if err := json.Unmarshal([]byte(*r.Source), &s); err != nil {
-			svc.logger.Fatal("Failed to unmarshal sample", zap.Error(err))
+		if err := svc.config.Fields.decode([]byte(*top.Hits.Hits[0].Source), &s); err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal sample: %s", err)
+		}
+		ts := &prompb.TimeSeries{Labels: toLabels(s.Labels)}
+		hist, ok := b.DateHistogram("samples")
+		if !ok {
+			continue
+		}
+		for _, h := range hist.Buckets {
+			avg, ok := h.Avg("value")
+			if !ok || avg.Value == nil {
+				continue
+			}
+			ts.Samples = append(ts.Samples, prompb.Sample{
+				Value:     *avg.Value,
+				Timestamp: int64(h.Key),
+			})
 		}
-		fingerprint := s.Labels.Fingerprint().String()
+		ret = append(ret, ts)
+	}
+	return ret, nil
+}
+
+// regexpQuery translates a Prometheus regex matcher on label name into a regexp
+// query on its keyword field.  Both Prometheus and Elasticsearch anchor the
+// pattern to the whole value, the RE2 syntax is translated by luceneRegexp.
+// A pattern matching the empty string also matches series without the label.
+func (svc *ReadService) regexpQuery(name, value string) (elastic.Query, error) {
+	re, err := regexp.Compile("^(?:" + value + ")$")
+	if err != nil {
+		return nil, &InvalidMatcherError{Name: name, Reason: err.Error()}
+	}
+	pattern, err := luceneRegexp(value)
+	if err != nil {
+		return nil, &InvalidMatcherError{Name: name, Reason: err.Error()}
+	}
+	query := svc.labelQuery(name, func(field string) elastic.Query {
+		return elastic.NewRegexpQuery(field, pattern)
+	})
+	if re.MatchString("") {
+		missing := elastic.NewBoolQuery().MustNot(svc.labelExists(name))
+		return elastic.NewBoolQuery().Should(query, missing).MinimumNumberShouldMatch(1), nil
+	}
+	return query, nil
+}
 
+func (svc *ReadService) createTimeseries(hits []*elastic.SearchHit, q *prompb.Query) ([]*prompb.TimeSeries, error) {
+	tsMap := make(map[string]*prompb.TimeSeries)
+	series := func(m model.Metric) *prompb.TimeSeries {
+		fingerprint := m.Fingerprint().String()
 		ts, ok := tsMap[fingerprint]
 		if !ok {
-			labels := make([]*prompb.Label, 0, len(s.Labels))
-			for k, v := range s.Labels {
-				labels = append(labels, &prompb.Label{
-					Name:  string(k),
-					Value: string(v),
-				})
-			}
 			ts = &prompb.TimeSeries{
-				Labels: labels,
+				Labels: toLabels(m),
 			}
 			tsMap[fingerprint] = ts
 		}
+		return ts
+	}
+	for _, r := range hits {
+		if svc.config.SeriesDocs {
+			var s prometheusSeries
+			if err := svc.config.Fields.decode([]byte(*r.Source), &s); err != nil {
+				return nil, fmt.Errorf("Failed to unmarshal series: %s", err)
+			}
+			ts := series(s.Labels)
+			for _, sample := range s.Samples {
+				if sample.Timestamp < q.StartTimestampMs || sample.Timestamp > q.EndTimestampMs {
+					continue
+				}
+				ts.Samples = append(ts.Samples, prompb.Sample{
+					Value:     sample.Value,
+					Timestamp: sample.Timestamp,
+				})
+			}
+			continue
+		}
+		var s prometheusSample
+		if err := svc.config.Fields.decode([]byte(*r.Source), &s); err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal sample: %s", err)
+		}
+		ts := series(s.Labels)
 		ts.Samples = append(ts.Samples, prompb.Sample{
 			Value:     s.Value,
 			Timestamp: s.Timestamp,
@@ -109,7 +482,27 @@ func (svc *ReadService) createTimeseries(results *elastic.SearchHits) ([]*prompb
 	ret := make([]*prompb.TimeSeries, 0, len(tsMap))
 
 	for _, s := range tsMap {
+		// hits are sorted by timestamp already, this keeps samples ordered
+		// regardless of how they were fetched
+		sort.SliceStable(s.Samples, func(i, j int) bool {
+			return s.Samples[i].Timestamp < s.Samples[j].Timestamp
+		})
 		ret = append(ret, s)
 	}
 	return ret, nil
 }
+
+// toLabels converts a metric to prompb labels sorted by name, as Prometheus expects
+func toLabels(m model.Metric) []*prompb.Label {
+	labels := make([]*prompb.Label, 0, len(m))
+	for k, v := range m {
+		labels = append(labels, &prompb.Label{
+			Name:  string(k),
+			Value: string(v),
+		})
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+	return labels
+}
@@ -0,0 +1,519 @@
+package elasticsearch
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"go.uber.org/zap"
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+// searchServer answers searches and scrolls with the next of pages, each
+// holding the sources of its hits, and aggs as the aggregations when set,
+// recording the path and body of each request but the scroll clears
+type searchServer struct {
+	mu     sync.Mutex
+	pages  [][]interface{}
+	aggs   string
+	paths  []string
+	bodies []string
+	// served counts the hits returned, as every page reports the total
+	served int
+}
+
+func (s *searchServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodDelete {
+		w.Write([]byte(`{"succeeded":true,"num_freed":1}`))
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paths = append(s.paths, r.URL.Path)
+	s.bodies = append(s.bodies, string(body))
+	total := s.served
+	for _, page := range s.pages {
+		total += len(page)
+	}
+	hits := []map[string]interface{}{}
+	if len(s.pages) > 0 {
+		for _, doc := range s.pages[0] {
+			hits = append(hits, map[string]interface{}{"_index": "prom-metrics-1", "_id": "1", "_source": doc})
+		}
+		s.served += len(s.pages[0])
+		s.pages = s.pages[1:]
+	}
+	res := map[string]interface{}{
+		"_scroll_id": "scroll-1",
+		"hits":       map[string]interface{}{"total": total, "hits": hits},
+	}
+	if s.aggs != "" {
+		res["aggregations"] = json.RawMessage(s.aggs)
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// docServer indexes the docs of bulk requests and answers searches with all
+// of them in a single scroll page, standing in for Elasticsearch in round
+// trips
+type docServer struct {
+	mu   sync.Mutex
+	docs []interface{}
+}
+
+func (s *docServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case r.Method == http.MethodDelete:
+		w.Write([]byte(`{"succeeded":true,"num_freed":1}`))
+	case strings.HasSuffix(r.URL.Path, "/_bulk"):
+		res := &elastic.BulkResponse{}
+		scanner := bufio.NewScanner(r.Body)
+		for line := 0; scanner.Scan(); line++ {
+			// odd lines are docs, even lines their action
+			if line%2 == 0 {
+				continue
+			}
+			var doc map[string]interface{}
+			json.Unmarshal(scanner.Bytes(), &doc)
+			s.docs = append(s.docs, doc)
+			res.Items = append(res.Items, map[string]*elastic.BulkResponseItem{"index": {Status: 201}})
+		}
+		json.NewEncoder(w).Encode(res)
+	case strings.HasSuffix(r.URL.Path, "/_search/scroll"):
+		w.Write([]byte(`{"_scroll_id":"scroll-1","hits":{"total":0,"hits":[]}}`))
+	default:
+		hits := []map[string]interface{}{}
+		for _, doc := range s.docs {
+			hits = append(hits, map[string]interface{}{"_index": "prom-metrics-1", "_id": "1", "_source": doc})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"_scroll_id": "scroll-1",
+			"hits":       map[string]interface{}{"total": len(hits), "hits": hits},
+		})
+	}
+}
+
+// roundTrip writes series through a WriteService configured by write and
+// reads everything back through a ReadService configured by read, returning
+// the series read sorted by their labels and the docs indexed
+func roundTrip(t *testing.T, write *WriteConfig, read *ReadConfig, series []*prompb.TimeSeries) ([]*prompb.TimeSeries, []interface{}) {
+	es := &docServer{}
+	client, srv := newTestClient(t, es)
+	defer srv.Close()
+	write.Alias = "prom-metrics"
+	write.MaxDocs = 100
+	write.MaxSize = 1 << 20
+	write.FlushWorkers = 1
+	write.Typeless = true
+	writeSvc, err := NewWriteService(context.Background(), zap.NewNop(), client, write)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writeSvc.Close()
+	if _, err := writeSvc.Write(series); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSvc.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	readSvc := newTestReadService(client, read)
+	res, err := readSvc.Read(context.Background(), []*prompb.Query{{StartTimestampMs: 0, EndTimestampMs: 10000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := res[0].Timeseries
+	sort.Slice(got, func(i, j int) bool {
+		return model.LabelsToSignature(labelMap(got[i].Labels)) < model.LabelsToSignature(labelMap(got[j].Labels))
+	})
+	return got, es.docs
+}
+
+func labelMap(labels []*prompb.Label) map[string]string {
+	m := make(map[string]string, len(labels))
+	for _, l := range labels {
+		m[l.Name] = l.Value
+	}
+	return m
+}
+
+// testSeries returns the series written by the round trip tests, sorted as
+// roundTrip sorts them
+func testSeries() []*prompb.TimeSeries {
+	series := []*prompb.TimeSeries{
+		{
+			Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "node"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}, {Value: 0, Timestamp: 2000}},
+		},
+		{
+			Labels:  []*prompb.Label{{Name: "__name__", Value: "scrape_duration_seconds"}, {Name: "job", Value: "node"}},
+			Samples: []prompb.Sample{{Value: 0.25, Timestamp: 1500}},
+		},
+	}
+	sort.Slice(series, func(i, j int) bool {
+		return model.LabelsToSignature(labelMap(series[i].Labels)) < model.LabelsToSignature(labelMap(series[j].Labels))
+	})
+	return series
+}
+
+func TestRoundTrip(t *testing.T) {
+	custom := FieldNames{Timestamp: "@ts", Label: "labels"}
+	tests := []struct {
+		name   string
+		series bool
+		fields FieldNames
+	}{
+		{"sample docs", false, FieldNames{}},
+		{"series docs", true, FieldNames{}},
+		{"sample docs with custom fields", false, custom},
+		{"series docs with custom fields", true, custom},
+		{"nested labels", false, FieldNames{Timestamp: "@ts", Label: "labels", Nested: true}},
+	}
+	for _, test := range tests {
+		want := testSeries()
+		got, docs := roundTrip(t,
+			&WriteConfig{SeriesDocs: test.series, Fields: test.fields},
+			&ReadConfig{SeriesDocs: test.series, Fields: test.fields},
+			testSeries())
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got series %v, want %v", test.name, got, want)
+		}
+		fields := test.fields.withDefaults()
+		for _, doc := range docs {
+			m := doc.(map[string]interface{})
+			if _, ok := m[fields.Timestamp]; !ok {
+				t.Errorf("%s: got doc %v, want the timestamp in %s", test.name, m, fields.Timestamp)
+			}
+			if _, ok := m[fields.Label]; !ok {
+				t.Errorf("%s: got doc %v, want the labels in %s", test.name, m, fields.Label)
+			}
+		}
+	}
+}
+
+func newTestReadService(client *elastic.Client, config *ReadConfig) *ReadService {
+	if config.Alias == "" {
+		config.Alias = "prom-metrics"
+	}
+	if config.MaxDocs == 0 {
+		config.MaxDocs = 1000
+	}
+	config.Typeless = true
+	return NewReadService(zap.NewNop(), client, config)
+}
+
+func TestReadRangeBounds(t *testing.T) {
+	tests := []struct {
+		name   string
+		series bool
+		want   string
+	}{
+		{
+			"samples",
+			false,
+			`{"query":{"bool":{"filter":{"range":{"timestamp":{"format":"epoch_millis","from":1000,"include_lower":true,"include_upper":true,"to":2000}}}}},"sort":[{"timestamp":{"order":"asc"}}]}`,
+		},
+		{
+			// series docs overlapping the window
+			"series",
+			true,
+			`{"query":{"bool":{"filter":{"bool":{"filter":[{"range":{"timestamp":{"format":"epoch_millis","from":null,"include_lower":true,"include_upper":true,"to":2000}}},{"range":{"end_timestamp":{"format":"epoch_millis","from":1000,"include_lower":true,"include_upper":true,"to":null}}}]}}}},"sort":[{"timestamp":{"order":"asc"}}]}`,
+		},
+	}
+	for _, test := range tests {
+		es := &searchServer{}
+		client, srv := newTestClient(t, es)
+		svc := newTestReadService(client, &ReadConfig{SeriesDocs: test.series})
+		_, err := svc.Read(context.Background(), []*prompb.Query{{StartTimestampMs: 1000, EndTimestampMs: 2000}})
+		srv.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if len(es.bodies) != 1 || es.paths[0] != "/prom-metrics-*/_search" {
+			t.Fatalf("%s: got requests to %v, want one search of prom-metrics-*", test.name, es.paths)
+		}
+		if es.bodies[0] != test.want {
+			t.Errorf("%s: got search body\n%s\nwant\n%s", test.name, es.bodies[0], test.want)
+		}
+	}
+}
+
+// upDocs returns sample docs of the up series at timestamps
+func upDocs(timestamps ...int64) []interface{} {
+	docs := make([]interface{}, len(timestamps))
+	for i, ts := range timestamps {
+		docs[i] = map[string]interface{}{"timestamp": ts, "value": 1, "label": map[string]string{"__name__": "up"}}
+	}
+	return docs
+}
+
+func TestReadScroll(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxResults int
+		want       int
+		searches   []string
+		truncated  float64
+	}{
+		{"all pages", 0, 5, []string{"/prom-metrics-*/_search", "/_search/scroll", "/_search/scroll", "/_search/scroll"}, 0},
+		{"max results", 3, 3, []string{"/prom-metrics-*/_search", "/_search/scroll"}, 1},
+	}
+	for _, test := range tests {
+		es := &searchServer{pages: [][]interface{}{upDocs(1, 2), upDocs(3, 4), upDocs(5)}}
+		client, srv := newTestClient(t, es)
+		svc := newTestReadService(client, &ReadConfig{MaxDocs: 2, MaxResults: test.maxResults})
+		res, err := svc.Read(context.Background(), []*prompb.Query{{StartTimestampMs: 0, EndTimestampMs: 10}})
+		srv.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if len(res[0].Timeseries) != 1 || len(res[0].Timeseries[0].Samples) != test.want {
+			t.Errorf("%s: got series %v, want one with %d samples", test.name, res[0].Timeseries, test.want)
+		}
+		if !reflect.DeepEqual(es.paths, test.searches) {
+			t.Errorf("%s: got requests to %v, want %v", test.name, es.paths, test.searches)
+		}
+		if got := counterValue(svc.truncated); got != test.truncated {
+			t.Errorf("%s: got %v truncated reads, want %v", test.name, got, test.truncated)
+		}
+	}
+}
+
+func TestReadDownsample(t *testing.T) {
+	es := &searchServer{aggs: `{"series":{"buckets":[{
+		"key":"fp1","doc_count":4,
+		"labels":{"hits":{"total":4,"hits":[{"_index":"prom-metrics-1","_id":"1","_source":{"label":{"__name__":"up","job":"node"}}}]}},
+		"samples":{"buckets":[
+			{"key":0,"doc_count":2,"value":{"value":1.5}},
+			{"key":10000,"doc_count":1,"value":{"value":null}},
+			{"key":20000,"doc_count":1,"value":{"value":3}}
+		]}
+	}]}}`}
+	client, srv := newTestClient(t, es)
+	defer srv.Close()
+	svc := newTestReadService(client, &ReadConfig{DownsamplePoints: 10})
+	res, err := svc.Read(context.Background(), []*prompb.Query{{StartTimestampMs: 0, EndTimestampMs: 100000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*prompb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "node"}},
+		Samples: []prompb.Sample{{Value: 1.5, Timestamp: 0}, {Value: 3, Timestamp: 20000}},
+	}}
+	if !reflect.DeepEqual(res[0].Timeseries, want) {
+		t.Errorf("got series %v, want %v", res[0].Timeseries, want)
+	}
+
+	var body struct {
+		Aggregations struct {
+			Series struct {
+				Terms map[string]interface{} `json:"terms"`
+				Aggs  struct {
+					Samples struct {
+						Histogram map[string]interface{} `json:"date_histogram"`
+					} `json:"samples"`
+				} `json:"aggregations"`
+			} `json:"series"`
+		} `json:"aggregations"`
+	}
+	if len(es.bodies) != 1 {
+		t.Fatalf("got %d searches, want one aggregation", len(es.bodies))
+	}
+	if err := json.Unmarshal([]byte(es.bodies[0]), &body); err != nil {
+		t.Fatal(err)
+	}
+	// 10 buckets of the 100s window
+	if got := body.Aggregations.Series.Aggs.Samples.Histogram["interval"]; got != "10000ms" {
+		t.Errorf("got interval %v, want 10000ms", got)
+	}
+	if got := body.Aggregations.Series.Terms["field"]; got != "fingerprint" {
+		t.Errorf("got series by %v, want fingerprint", got)
+	}
+}
+
+func TestReadBusy(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	es := &searchServer{}
+	client, srv := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			started <- struct{}{}
+			<-release
+		}
+		es.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	svc := newTestReadService(client, &ReadConfig{MaxConcurrent: 1})
+	query := []*prompb.Query{{StartTimestampMs: 0, EndTimestampMs: 10}}
+
+	done := make(chan error)
+	go func() {
+		_, err := svc.Read(context.Background(), query)
+		done <- err
+	}()
+	<-started
+	if _, err := svc.Read(context.Background(), query); err != ErrReadBusy {
+		t.Errorf("got error %v while a read is searching, want ErrReadBusy", err)
+	}
+	if got := atomic.LoadInt64(&svc.inFlight); got != 1 {
+		t.Errorf("got %d reads in flight, want 1", got)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.Read(context.Background(), query); err != nil {
+		t.Errorf("got error %v once the read finished, want the slot free", err)
+	}
+}
+
+func TestReadCache(t *testing.T) {
+	es := &searchServer{pages: [][]interface{}{upDocs(1, 2)}}
+	client, srv := newTestClient(t, es)
+	defer srv.Close()
+	svc := newTestReadService(client, &ReadConfig{CacheSize: 2, CacheTTL: time.Minute})
+	searches := func() int {
+		var n int
+		for _, path := range es.paths {
+			if path == "/prom-metrics-*/_search" {
+				n++
+			}
+		}
+		return n
+	}
+
+	steps := []struct {
+		name     string
+		query    *prompb.Query
+		samples  int
+		searches int
+	}{
+		{"first read", &prompb.Query{StartTimestampMs: 0, EndTimestampMs: 10}, 2, 1},
+		{"same query", &prompb.Query{StartTimestampMs: 0, EndTimestampMs: 10}, 2, 1},
+		{"other range", &prompb.Query{StartTimestampMs: 0, EndTimestampMs: 20}, 0, 2},
+	}
+	for _, step := range steps {
+		res, err := svc.Read(context.Background(), []*prompb.Query{step.query})
+		if err != nil {
+			t.Fatalf("%s: %s", step.name, err)
+		}
+		var samples int
+		for _, ts := range res[0].Timeseries {
+			samples += len(ts.Samples)
+		}
+		if samples != step.samples {
+			t.Errorf("%s: got %d samples, want %d", step.name, samples, step.samples)
+		}
+		if got := searches(); got != step.searches {
+			t.Errorf("%s: got %d searches in total, want %d", step.name, got, step.searches)
+		}
+	}
+	if got := counterValue(svc.cacheHits); got != 1 {
+		t.Errorf("got %v cache hits, want 1", got)
+	}
+}
+
+func TestReadTenantIndex(t *testing.T) {
+	tests := []struct {
+		name    string
+		matcher *prompb.LabelMatcher
+		want    string
+	}{
+		{"tenant", &prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "tenant", Value: "b"}, "/prom-metrics-tenant-b*/_search"},
+		{"tenant regex", &prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "tenant", Value: "b|c"}, "/prom-metrics-*/_search"},
+		{"other label", &prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "b"}, "/prom-metrics-*/_search"},
+	}
+	for _, test := range tests {
+		es := &searchServer{}
+		client, srv := newTestClient(t, es)
+		svc := newTestReadService(client, &ReadConfig{TenantLabel: "tenant"})
+		_, err := svc.Read(context.Background(), []*prompb.Query{{Matchers: []*prompb.LabelMatcher{test.matcher}}})
+		srv.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if len(es.paths) != 1 || es.paths[0] != test.want {
+			t.Errorf("%s: got searches %v, want %s", test.name, es.paths, test.want)
+		}
+	}
+}
+
+// poolServer holds each request until want are served concurrently, or a
+// second passed, recording the most served at once
+type poolServer struct {
+	next   http.Handler
+	want   int64
+	active int64
+	max    int64
+	once   sync.Once
+	full   chan struct{}
+}
+
+func newPoolServer(next http.Handler, want int) *poolServer {
+	return &poolServer{next: next, want: int64(want), full: make(chan struct{})}
+}
+
+func (s *poolServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := atomic.AddInt64(&s.active, 1)
+	defer atomic.AddInt64(&s.active, -1)
+	for {
+		max := atomic.LoadInt64(&s.max)
+		if n <= max || atomic.CompareAndSwapInt64(&s.max, max, n) {
+			break
+		}
+	}
+	if n >= s.want {
+		s.once.Do(func() { close(s.full) })
+	}
+	select {
+	case <-s.full:
+	case <-time.After(time.Second):
+	}
+	s.next.ServeHTTP(w, r)
+}
+
+func TestQueryWorkers(t *testing.T) {
+	tests := []struct {
+		name    string
+		workers int
+		queries int
+		want    int
+	}{
+		{"sequential", 1, 3, 1},
+		{"pool", 3, 5, 3},
+		{"fewer queries", 3, 2, 2},
+	}
+	for _, test := range tests {
+		es := newPoolServer(&searchServer{}, test.want)
+		client, srv := newTestClient(t, es)
+		svc := newTestReadService(client, &ReadConfig{QueryWorkers: test.workers})
+		req := make([]*prompb.Query, test.queries)
+		for i := range req {
+			req[i] = &prompb.Query{StartTimestampMs: int64(i), EndTimestampMs: int64(i + 1)}
+		}
+		_, err := svc.Read(context.Background(), req)
+		srv.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if got := atomic.LoadInt64(&es.max); got != int64(test.want) {
+			t.Errorf("%s: got %d concurrent searches, want %d", test.name, got, test.want)
+		}
+	}
+}
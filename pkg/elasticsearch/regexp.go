@@ -0,0 +1,179 @@
+package elasticsearch
+
+import (
+	"fmt"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// InvalidMatcherError is returned by Read for regex matchers that are not
+// valid RE2 or cannot be expressed as a Lucene regexp, callers should not
+// retry the query
+type InvalidMatcherError struct {
+	Name   string
+	Reason string
+}
+
+func (e *InvalidMatcherError) Error() string {
+	return fmt.Sprintf("invalid regex matcher for %s: %s", e.Name, e.Reason)
+}
+
+// luceneReserved are the characters with a meaning in Lucene regexps, with
+// all optional operators enabled as by Elasticsearch
+const luceneReserved = `.?+*|{}[]()"\#@&<>~^-`
+
+// luceneRegexp translates a Prometheus RE2 regex, anchored to the whole value,
+// into the equivalent Lucene regexp.  Perl classes such as \d and flags such
+// as (?i) are expanded into character classes and literals are escaped.
+// Anchors are only accepted at the start and end, where they have no effect,
+// and word boundaries are rejected.
+func luceneRegexp(value string) (string, error) {
+	re, err := syntax.Parse(value, syntax.Perl)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := writeLucene(&b, re, true, true); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// writeLucene writes re in Lucene syntax, atStart and atEnd telling whether
+// it begins or ends the pattern
+func writeLucene(b *strings.Builder, re *syntax.Regexp, atStart, atEnd bool) error {
+	switch re.Op {
+	case syntax.OpNoMatch:
+		// the empty language
+		b.WriteString("#")
+	case syntax.OpEmptyMatch:
+		b.WriteString("()")
+	case syntax.OpLiteral:
+		for _, r := range re.Rune {
+			if re.Flags&syntax.FoldCase != 0 && unicode.SimpleFold(r) != r {
+				writeFolded(b, r)
+				continue
+			}
+			writeRune(b, r)
+		}
+	case syntax.OpCharClass:
+		if len(re.Rune) == 0 {
+			b.WriteString("#")
+			break
+		}
+		b.WriteString("[")
+		for i := 0; i < len(re.Rune); i += 2 {
+			writeRune(b, re.Rune[i])
+			if re.Rune[i+1] != re.Rune[i] {
+				b.WriteString("-")
+				writeRune(b, re.Rune[i+1])
+			}
+		}
+		b.WriteString("]")
+	case syntax.OpAnyChar:
+		b.WriteString(".")
+	case syntax.OpAnyCharNotNL:
+		b.WriteString("[^\n]")
+	case syntax.OpBeginLine, syntax.OpBeginText:
+		if !atStart {
+			return fmt.Errorf("anchor %s is only supported at the start of the regex", re)
+		}
+	case syntax.OpEndLine, syntax.OpEndText:
+		if !atEnd {
+			return fmt.Errorf("anchor %s is only supported at the end of the regex", re)
+		}
+	case syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+		return fmt.Errorf("word boundaries are not supported")
+	case syntax.OpCapture:
+		if isAtom(re.Sub[0]) {
+			return writeLucene(b, re.Sub[0], atStart, atEnd)
+		}
+		b.WriteString("(")
+		if err := writeLucene(b, re.Sub[0], atStart, atEnd); err != nil {
+			return err
+		}
+		b.WriteString(")")
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		if isAtom(re.Sub[0]) {
+			if err := writeLucene(b, re.Sub[0], false, false); err != nil {
+				return err
+			}
+		} else {
+			b.WriteString("(")
+			if err := writeLucene(b, re.Sub[0], false, false); err != nil {
+				return err
+			}
+			b.WriteString(")")
+		}
+		switch re.Op {
+		case syntax.OpStar:
+			b.WriteString("*")
+		case syntax.OpPlus:
+			b.WriteString("+")
+		case syntax.OpQuest:
+			b.WriteString("?")
+		default:
+			b.WriteString("{" + strconv.Itoa(re.Min))
+			if re.Max != re.Min {
+				b.WriteString(",")
+				if re.Max >= 0 {
+					b.WriteString(strconv.Itoa(re.Max))
+				}
+			}
+			b.WriteString("}")
+		}
+	case syntax.OpConcat:
+		for i, sub := range re.Sub {
+			if err := writeLucene(b, sub, atStart && i == 0, atEnd && i == len(re.Sub)-1); err != nil {
+				return err
+			}
+		}
+	case syntax.OpAlternate:
+		b.WriteString("(")
+		for i, sub := range re.Sub {
+			if i > 0 {
+				b.WriteString("|")
+			}
+			if err := writeLucene(b, sub, atStart, atEnd); err != nil {
+				return err
+			}
+		}
+		b.WriteString(")")
+	default:
+		return fmt.Errorf("unsupported regex %s", re)
+	}
+	return nil
+}
+
+// isAtom reports whether re is written as a single Lucene atom which an
+// operator applies to without parentheses
+func isAtom(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpCharClass, syntax.OpAnyChar, syntax.OpAnyCharNotNL, syntax.OpAlternate, syntax.OpNoMatch, syntax.OpEmptyMatch, syntax.OpCapture:
+		// groups and alternations are written in parentheses
+		return true
+	case syntax.OpLiteral:
+		return len(re.Rune) == 1
+	}
+	return false
+}
+
+// writeRune writes r escaped when it is reserved in Lucene
+func writeRune(b *strings.Builder, r rune) {
+	if strings.ContainsRune(luceneReserved, r) {
+		b.WriteByte('\\')
+	}
+	b.WriteRune(r)
+}
+
+// writeFolded writes a class of r and the runes it case folds to
+func writeFolded(b *strings.Builder, r rune) {
+	b.WriteString("[")
+	writeRune(b, r)
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		writeRune(b, f)
+	}
+	b.WriteString("]")
+}
@@ -0,0 +1,49 @@
+package elasticsearch
+
+import "testing"
+
+func TestLuceneRegexp(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"prometheus|node", "(prometheus|node)"},
+		{"^api-.*$", `api\-[^` + "\n" + `]*`},
+		{`10\.0\.\d+\.\d+:9100`, `10\.0\.[0-9]+\.[0-9]+:9100`},
+		{"(?i)get", "[Gg][Ee][Tt]"},
+		{"user@example.com", `user\@example[^` + "\n" + `]com`},
+		{"a&b<c>~#", `a\&b\<c\>\~\#`},
+		{`\w+`, "[0-9A-Z_a-z]+"},
+		{"[[:alpha:]]{2,3}", "[A-Za-z]{2,3}"},
+		{"(foo|bar)?baz", "(foo|bar)?baz"},
+		{"(ab)+", "(ab)+"},
+		{"5..", "5[^\n][^\n]"},
+		{"", "()"},
+	}
+	for _, test := range tests {
+		got, err := luceneRegexp(test.value)
+		if err != nil {
+			t.Errorf("luceneRegexp(%q) failed: %s", test.value, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("luceneRegexp(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestLuceneRegexpUnsupported(t *testing.T) {
+	for _, value := range []string{`a\bb`, `\Bx`, "a^b", "a$b", "(a"} {
+		if got, err := luceneRegexp(value); err == nil {
+			t.Errorf("luceneRegexp(%q) = %q, want an error", value, got)
+		}
+	}
+}
+
+func TestRegexpQueryInvalidMatcher(t *testing.T) {
+	svc := &ReadService{config: &ReadConfig{}}
+	_, err := svc.regexpQuery("instance", `host\b`)
+	if _, ok := err.(*InvalidMatcherError); !ok {
+		t.Errorf("got error %v, want an InvalidMatcherError", err)
+	}
+}
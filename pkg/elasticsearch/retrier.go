@@ -0,0 +1,106 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+// Retrier retries requests that failed to reach Elasticsearch up to a
+// maximum number of times, doubling the wait after every attempt
+type Retrier struct {
+	maxRetries int
+	backoff    time.Duration
+}
+
+// NewRetrier returns a Retrier waiting backoff before the first retry
+func NewRetrier(maxRetries int, backoff time.Duration) *Retrier {
+	return &Retrier{
+		maxRetries: maxRetries,
+		backoff:    backoff,
+	}
+}
+
+var _ elastic.Retrier = (*Retrier)(nil)
+
+// Retry implements elastic.Retrier, retry starts at 1.  The client only calls
+// it when a request fails without a response, RetryTransport retries the
+// responses of an overloaded cluster.
+func (r *Retrier) Retry(ctx context.Context, retry int, req *http.Request, resp *http.Response, err error) (time.Duration, bool, error) {
+	if retry > r.maxRetries {
+		return 0, false, nil
+	}
+	return r.backoff << uint(retry-1), true, nil
+}
+
+// retryStatus reports whether a response status means Elasticsearch is
+// temporarily overloaded or unavailable and the request may be resent
+func retryStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// RetryTransport resends requests answered with 429, 502, 503 or 504 with
+// the backoff of Retrier, the last response is returned once it gives up
+type RetryTransport struct {
+	Next    http.RoundTripper
+	Retrier *Retrier
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.Next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	getBody := req.GetBody
+	if req.Body != nil && req.Body != http.NoBody && getBody == nil {
+		// the elastic client sets no GetBody, keep the body to resend it
+		buf, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		getBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(buf)), nil
+		}
+	}
+	for retry := 1; ; retry++ {
+		// RoundTrip must not modify req, each attempt sends a shallow copy
+		// with a fresh body
+		attempt := new(http.Request)
+		*attempt = *req
+		if getBody != nil {
+			body, err := getBody()
+			if err != nil {
+				return nil, err
+			}
+			attempt.Body = body
+		}
+		resp, err := next.RoundTrip(attempt)
+		if err != nil || !retryStatus(resp.StatusCode) {
+			return resp, err
+		}
+		wait, ok, _ := t.Retrier.Retry(req.Context(), retry, attempt, resp, nil)
+		if !ok {
+			return resp, nil
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package elasticsearch
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeTransport answers each request with the next of statuses, recording
+// the bodies it received
+type fakeTransport struct {
+	statuses []int
+	bodies   []string
+}
+
+func (t *fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	t.bodies = append(t.bodies, string(body))
+	status := t.statuses[0]
+	t.statuses = t.statuses[1:]
+	return &http.Response{
+		StatusCode: status,
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+func TestRetryTransport(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxRetries int
+		statuses   []int
+		want       int
+		attempts   int
+	}{
+		{"retried after 503", 1, []int{503, 200}, 200, 2},
+		{"retried after 429", 2, []int{429, 429, 200}, 200, 3},
+		{"gives up", 1, []int{503, 503}, 503, 2},
+		{"client error not retried", 3, []int{400}, 400, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := &fakeTransport{statuses: test.statuses}
+			transport := &RetryTransport{
+				Next:    fake,
+				Retrier: NewRetrier(test.maxRetries, time.Millisecond),
+			}
+			req, err := http.NewRequest("POST", "http://es:9200/_bulk", strings.NewReader("{}\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// like requests of the elastic client
+			req.GetBody = nil
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.want {
+				t.Errorf("got status %d, want %d", resp.StatusCode, test.want)
+			}
+			if len(fake.bodies) != test.attempts {
+				t.Fatalf("got %d attempts, want %d", len(fake.bodies), test.attempts)
+			}
+			for i, body := range fake.bodies {
+				if body != "{}\n" {
+					t.Errorf("attempt %d sent body %q", i+1, body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+// ClusterInfo identifies the software and version a cluster runs
+type ClusterInfo struct {
+	Version string
+	// Distribution is opensearch for OpenSearch clusters, empty for Elasticsearch
+	Distribution string
+}
+
+// GetClusterInfo fetches the version from the root endpoint of the cluster
+func GetClusterInfo(ctx context.Context, client *elastic.Client) (*ClusterInfo, error) {
+	res, err := client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "GET",
+		Path:   "/",
+	})
+	if err != nil {
+		return nil, err
+	}
+	var body struct {
+		Version struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+	if err := json.Unmarshal(res.Body, &body); err != nil {
+		return nil, fmt.Errorf("decoding cluster info: %s", err)
+	}
+	return &ClusterInfo{
+		Version:      body.Version.Number,
+		Distribution: body.Version.Distribution,
+	}, nil
+}
+
+// IsOpenSearch reports whether the cluster runs OpenSearch
+func (i *ClusterInfo) IsOpenSearch() bool {
+	return i.Distribution == "opensearch"
+}
+
+// Typeless reports whether the cluster has removed mapping types, true for
+// every OpenSearch version as it forked from Elasticsearch 7.10
+func (i *ClusterInfo) Typeless() (bool, error) {
+	if i.IsOpenSearch() {
+		return true, nil
+	}
+	major, err := MajorVersion(i.Version)
+	if err != nil {
+		return false, err
+	}
+	return IsTypeless(major), nil
+}
+
+// ComposableTemplates reports whether the cluster supports composable index
+// templates, added in Elasticsearch 7.8 and in every OpenSearch version
+func (i *ClusterInfo) ComposableTemplates() (bool, error) {
+	if i.IsOpenSearch() {
+		return true, nil
+	}
+	major, err := MajorVersion(i.Version)
+	if err != nil {
+		return false, err
+	}
+	if major != 7 {
+		return major > 7, nil
+	}
+	parts := strings.SplitN(i.Version, ".", 3)
+	if len(parts) < 2 {
+		return false, fmt.Errorf("invalid Elasticsearch version %q", i.Version)
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false, fmt.Errorf("invalid Elasticsearch version %q", i.Version)
+	}
+	return minor >= 8, nil
+}
+
+// String returns the version, prefixed by the distribution for OpenSearch
+func (i *ClusterInfo) String() string {
+	if i.Distribution != "" {
+		return i.Distribution + " " + i.Version
+	}
+	return i.Version
+}
+
+// MajorVersion returns the major component of an Elasticsearch version
+// string eg 6 for 6.8.2
+func MajorVersion(version string) (int, error) {
+	major, err := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid Elasticsearch version %q", version)
+	}
+	return major, nil
+}
+
+// IsTypeless reports whether the given major version has removed mapping types
+func IsTypeless(major int) bool {
+	return major >= 7
+}
+
+// docType returns the mapping type samples are indexed with
+func docType(typeless bool) string {
+	if typeless {
+		return "_doc"
+	}
+	return sampleType
+}
+
+// searchTypes returns the mapping types to restrict searches to, none when typeless
+func searchTypes(typeless bool) []string {
+	if typeless {
+		return nil
+	}
+	return []string{sampleType}
+}
+
+// CompatTransport adapts requests from the v6 client for newer clusters.
+// Once enabled it asks for search hit totals to be rendered as integers,
+// Elasticsearch 7 otherwise returns an object the v6 client cannot decode.
+type CompatTransport struct {
+	Next    http.RoundTripper
+	enabled int32
+}
+
+// Enable turns on the Elasticsearch 7 compatibility behaviour
+func (t *CompatTransport) Enable() {
+	atomic.StoreInt32(&t.enabled, 1)
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *CompatTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.Next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if atomic.LoadInt32(&t.enabled) == 0 || !isSearch(req) {
+		return next.RoundTrip(req)
+	}
+	u := *req.URL
+	q := u.Query()
+	q.Set("rest_total_hits_as_int", "true")
+	u.RawQuery = q.Encode()
+	r := req.WithContext(req.Context())
+	r.URL = &u
+	return next.RoundTrip(r)
+}
+
+// isSearch reports whether req is a search or scroll request
+func isSearch(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		return false
+	}
+	return strings.HasSuffix(req.URL.Path, "/_search") || strings.HasSuffix(req.URL.Path, "/_search/scroll")
+}
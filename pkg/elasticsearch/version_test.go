@@ -0,0 +1,103 @@
+package elasticsearch
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+// recorded root endpoint responses of each distribution
+const (
+	elasticsearch6Root = `{
+  "name" : "es-node1",
+  "cluster_name" : "docker-cluster",
+  "cluster_uuid" : "g0Ou3PDFQ4K-SlVpRJ8iMw",
+  "version" : {
+    "number" : "6.8.23",
+    "build_flavor" : "default",
+    "build_type" : "docker",
+    "build_hash" : "4f67856",
+    "build_date" : "2022-01-06T21:30:50.087716Z",
+    "build_snapshot" : false,
+    "lucene_version" : "7.7.3",
+    "minimum_wire_compatibility_version" : "5.6.0",
+    "minimum_index_compatibility_version" : "5.0.0"
+  },
+  "tagline" : "You Know, for Search"
+}`
+	elasticsearch7Root = `{
+  "name" : "es-node1",
+  "cluster_name" : "docker-cluster",
+  "cluster_uuid" : "Xc8wRn0dQ8mEfcS2m6lOFw",
+  "version" : {
+    "number" : "7.17.9",
+    "build_flavor" : "default",
+    "build_type" : "docker",
+    "build_hash" : "ef48222227ee6b9e70e502f0f0daa52435ee634d",
+    "build_date" : "2023-01-31T05:34:43.305517834Z",
+    "build_snapshot" : false,
+    "lucene_version" : "8.11.1",
+    "minimum_wire_compatibility_version" : "6.8.0",
+    "minimum_index_compatibility_version" : "6.0.0-beta1"
+  },
+  "tagline" : "You Know, for Search"
+}`
+	openSearchRoot = `{
+  "name" : "opensearch-node1",
+  "cluster_name" : "opensearch-cluster",
+  "cluster_uuid" : "W0B8gPotTAajhMPbC9D4ww",
+  "version" : {
+    "distribution" : "opensearch",
+    "number" : "1.3.13",
+    "build_type" : "tar",
+    "build_hash" : "a6b1ec6ee9e9e3f9d0d7f5d2a6cf2e1aa4e36d87",
+    "build_date" : "2023-09-15T01:25:13.574383Z",
+    "build_snapshot" : false,
+    "lucene_version" : "8.10.1",
+    "minimum_wire_compatibility_version" : "6.8.0",
+    "minimum_index_compatibility_version" : "6.0.0-beta1"
+  },
+  "tagline" : "The OpenSearch Project: https://opensearch.org/"
+}`
+)
+
+func TestGetClusterInfo(t *testing.T) {
+	tests := []struct {
+		name       string
+		root       string
+		str        string
+		opensearch bool
+		typeless   bool
+		composable bool
+	}{
+		{"elasticsearch 6", elasticsearch6Root, "6.8.23", false, false, false},
+		{"elasticsearch 7", elasticsearch7Root, "7.17.9", false, true, true},
+		// OpenSearch 1 forked from Elasticsearch 7.10
+		{"opensearch", openSearchRoot, "opensearch 1.3.13", true, true, true},
+	}
+	for _, test := range tests {
+		client, srv := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				t.Errorf("%s: got request to %s, want the root endpoint", test.name, r.URL.Path)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(test.root))
+		}))
+		info, err := GetClusterInfo(context.Background(), client)
+		srv.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if info.String() != test.str || info.IsOpenSearch() != test.opensearch {
+			t.Errorf("%s: got %s, OpenSearch %t, want %s, %t", test.name, info, info.IsOpenSearch(), test.str, test.opensearch)
+		}
+		typeless, err := info.Typeless()
+		if err != nil || typeless != test.typeless {
+			t.Errorf("%s: got typeless %t, %v, want %t", test.name, typeless, err, test.typeless)
+		}
+		composable, err := info.ComposableTemplates()
+		if err != nil || composable != test.composable {
+			t.Errorf("%s: got composable templates %t, %v, want %t", test.name, composable, err, test.composable)
+		}
+	}
+}
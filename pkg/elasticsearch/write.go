@@ -2,21 +2,59 @@ package elasticsearch
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/prompb"
+	"github.com/pwillie/prometheus-es-adapter/pkg/tracing"
 	"go.uber.org/zap"
 	elastic "gopkg.in/olivere/elastic.v6"
 )
 
+// ErrUnavailable is returned by Write while samples cannot be delivered to
+// Elasticsearch, callers should retry later
+var ErrUnavailable = errors.New("elasticsearch is unavailable")
+
+// ErrQueueFull is returned by Write when the samples of a request would
+// exceed MaxQueued waiting to be committed, callers should slow down
+var ErrQueueFull = errors.New("too many samples queued")
+
+// unavailableFor is how long writes are rejected after a bulk commit fails
+const unavailableFor = 5 * time.Second
+
 type prometheusSample struct {
-	Labels    model.Metric `json:"label"`
-	Value     float64      `json:"value"`
-	Timestamp int64        `json:"timestamp"`
+	Labels      model.Metric `json:"label"`
+	Value       float64      `json:"value"`
+	Timestamp   int64        `json:"timestamp"`
+	Fingerprint string       `json:"fingerprint,omitempty"`
+	// DataStreamTimestamp duplicates Timestamp as data streams require @timestamp
+	DataStreamTimestamp int64 `json:"@timestamp,omitempty"`
+}
+
+// prometheusSeries holds the samples of one series from a remote write
+// request, indexed instead of prometheusSample when SeriesDocs is enabled.
+// Timestamp and EndTimestamp bound the samples.
+type prometheusSeries struct {
+	Labels       model.Metric   `json:"label"`
+	Fingerprint  string         `json:"fingerprint,omitempty"`
+	Timestamp    int64          `json:"timestamp"`
+	EndTimestamp int64          `json:"end_timestamp"`
+	Samples      []seriesSample `json:"samples"`
+	// DataStreamTimestamp duplicates Timestamp as data streams require @timestamp
+	DataStreamTimestamp int64 `json:"@timestamp,omitempty"`
+}
+
+type seriesSample struct {
+	Value     float64 `json:"value"`
+	Timestamp int64   `json:"timestamp"`
 }
 
 // WriteService will proxy Prometheus write requests to Elasticsearch
@@ -24,6 +62,46 @@ type WriteService struct {
 	config    *WriteConfig
 	logger    *zap.Logger
 	processor *elastic.BulkProcessor
+	// client and ctx resend the bulk items answered with a retryable status
+	// after the backoff wait
+	client    *elastic.Client
+	ctx       context.Context
+	backoff   elastic.Backoff
+	latency   prometheus.Histogram
+	started   sync.Map
+	dead      *deadLetterWriter
+	deadCount prometheus.Counter
+	dropped   prometheus.Counter
+	received  prometheus.Counter
+	sent      prometheus.Counter
+	failed    prometheus.Counter
+	// failedAt is the time in unix ns of the last failed bulk commit
+	failedAt int64
+	// rejectedAt is the time in unix ns of the last commit with at least
+	// RejectLimit items rejected
+	rejectedAt int64
+	closed     int32
+	// queued is the number of samples added but not yet committed
+	queued      int64
+	queuedGauge prometheus.GaugeFunc
+	dryRun      prometheus.Counter
+	// labelNames is the set of label names indexed when MaxLabelNames is set
+	labelMu      sync.Mutex
+	labelNames   map[model.LabelName]struct{}
+	labelDropped prometheus.Counter
+	// metadata is the last MetricMetadata stored per metric name
+	metadata   sync.Map
+	flushes    *prometheus.CounterVec
+	outOfRange *prometheus.CounterVec
+	sampledOut prometheus.Counter
+	rejected   prometheus.Counter
+	duplicates prometheus.Counter
+	// filter holds the active *Filter, swapped by SetFilter
+	filter atomic.Value
+	// recovering is 1 while MissingAlias runs
+	recovering int32
+	// spans holds the tracing span of each commit in progress
+	spans sync.Map
 }
 
 // WriteConfig is used to configure WriteService
@@ -33,81 +111,737 @@ type WriteConfig struct {
 	MaxAge  int
 	MaxDocs int
 	MaxSize int
-	Workers int
-	Stats   bool
+	// FlushWorkers is the number of bulk processor workers, each batching
+	// and committing requests on its own.  Reads are not affected, see
+	// ReadConfig.QueryWorkers.
+	FlushWorkers int
+	Stats        bool
+	// DeadLetterFile receives samples that failed to index.  Failed samples
+	// are dropped when empty.
+	DeadLetterFile string
+	Typeless       bool
+	// DataStream indexes into a data stream named after the alias
+	DataStream bool
+	// Filter skips series before they are queued, nil indexes everything.
+	// SetFilter replaces it at runtime.
+	Filter *Filter
+	// Sampler indexes a fraction of the series passing Filter, nil indexes
+	// all of them
+	Sampler *Sampler
+	// SanitizeLabels replaces characters outside [a-zA-Z0-9_] in label names
+	// with underscores so each label maps to a single flat field
+	SanitizeLabels bool
+	// DailyLayout is the Go time layout appended to the alias to name daily
+	// indexes, defaults to 2006-01-02
+	DailyLayout string
+	// DailyUTC names daily indexes after the UTC day of samples instead of
+	// the local one
+	DailyUTC bool
+	// Pipeline is the ingest pipeline samples are indexed through, if any
+	Pipeline string
+	// MaxQueued bounds the samples waiting to be committed, however many
+	// docs hold them, 0 for no limit
+	MaxQueued int64
+	// DryRun logs the bulk requests at debug level instead of indexing them
+	DryRun bool
+	// Name identifies the bulk processor, eg in its worker logs
+	Name string
+	// SeriesDocs indexes the samples of each series in a request as one doc
+	// with nested samples, instead of one doc per sample
+	SeriesDocs bool
+	// MaxLabelNames bounds the distinct label names indexed, each becoming a
+	// mapped field, series introducing more are dropped.  0 for no limit.
+	MaxLabelNames int
+	// Metadata stores metric metadata in MetadataIndex(Alias)
+	Metadata bool
+	// Exemplars stores exemplars in ExemplarIndex(Alias)
+	Exemplars bool
+	// Fields names the timestamp and label fields of indexed docs
+	Fields FieldNames
+	// TenantLabel routes series to an index per value of this label, see
+	// TenantIndex.  Series without the label are written to Alias.
+	TenantLabel string
+	// MaxSampleAge and MaxFutureSkew flag samples older than, or ahead of
+	// the adapter clock by more than, these durations.  0 disables either
+	// check.
+	MaxSampleAge  time.Duration
+	MaxFutureSkew time.Duration
+	// DropOutOfRange drops flagged samples instead of indexing them
+	DropOutOfRange bool
+	// BackoffMin and BackoffMax bound the exponential wait between retries
+	// of a bulk commit and of its items answered with 408, 429, 503 or 507,
+	// the defaults of the bulk processor are used when zero
+	BackoffMin time.Duration
+	BackoffMax time.Duration
+	// RejectLimit is the number of items rejected with 429 in a commit after
+	// which writes are refused with ErrQueueFull for RejectPause, letting
+	// Elasticsearch drain its write queue.  0 never pauses.
+	RejectLimit int
+	RejectPause time.Duration
+	// DedupIDs derives the doc _id from the series fingerprint and sample
+	// timestamps, so samples sent again overwrite their doc instead of
+	// duplicating it
+	DedupIDs bool
+	// MissingAlias is called, at most once at a time, when bulk items fail
+	// because the index written to does not exist, eg after the alias was
+	// deleted with auto index creation disabled
+	MissingAlias func()
+	// PrecreateLead creates the next daily index this long before midnight
+	// when Daily is set, 0 leaves it to the first write of the day
+	PrecreateLead time.Duration
+	// Tracer records a span per bulk commit, nil for none
+	Tracer *tracing.Tracer
 }
 
 // NewWriteService creates and returns a new elasticsearch WriteService
 func NewWriteService(ctx context.Context, logger *zap.Logger, client *elastic.Client, config *WriteConfig) (*WriteService, error) {
 	svc := &WriteService{
-		config: config,
-		logger: logger,
+		config:       config,
+		logger:       logger,
+		client:       client,
+		ctx:          ctx,
+		backoff:      elastic.NewExponentialBackoff(200*time.Millisecond, 10*time.Second),
+		latency:      newBulkLatency(),
+		deadCount:    newDeadLetterCounter(),
+		dropped:      newDroppedCounter(),
+		received:     newReceivedCounter(),
+		sent:         newSentCounter(),
+		failed:       newFailedCounter(),
+		dryRun:       newDryRunCounter(),
+		labelNames:   make(map[model.LabelName]struct{}),
+		labelDropped: newLabelLimitCounter(),
+		flushes:      newFlushCounter(),
+		outOfRange:   newOutOfRangeCounter(),
+		sampledOut:   newSampledOutCounter(),
+		rejected:     newRejectedCounter(),
+		duplicates:   newDuplicateCounter(),
+	}
+	svc.filter.Store(config.Filter)
+	svc.queuedGauge = newQueuedGauge(func() float64 {
+		return float64(atomic.LoadInt64(&svc.queued))
+	})
+	if config.DeadLetterFile != "" {
+		dead, err := newDeadLetterWriter(config.DeadLetterFile)
+		if err != nil {
+			return nil, fmt.Errorf("opening dead letter file: %s", err)
+		}
+		svc.dead = dead
+	}
+	if config.BackoffMin > 0 && config.BackoffMax > 0 {
+		svc.backoff = elastic.NewExponentialBackoff(config.BackoffMin, config.BackoffMax)
 	}
+	// the processor would resend retryable items itself but then calls
+	// "after" with the first requests and the last response, items are
+	// resent by "after" instead so each response pairs with its requests
 	b, err := client.BulkProcessor().
-		Workers(config.Workers).                                   // # of workers
+		Backoff(svc.backoff).
+		RetryItemStatusCodes().
+		Name(config.Name).
+		Workers(config.FlushWorkers).                              // # of workers
 		BulkActions(config.MaxDocs).                               // # of queued requests before committed
 		BulkSize(config.MaxSize).                                  // # of bytes in requests before committed
 		FlushInterval(time.Duration(config.MaxAge) * time.Second). // autocommit every # seconds
 		Stats(config.Stats).                                       // gather statistics
+		Before(svc.before).                                        // call "before" before every commit
 		After(svc.after).                                          // call "after" after every commit
 		Do(ctx)
 	if err != nil {
 		return nil, err
 	}
 	svc.processor = b
+	if config.Daily && config.PrecreateLead > 0 && !config.DryRun {
+		go svc.precreate(ctx, client)
+	}
 	if config.Stats {
 		prometheus.MustRegister(svc)
 	}
 	return svc, nil
 }
 
-// Close will close the underlying elasticsearch BulkProcessor
+// Close will close the underlying elasticsearch BulkProcessor, committing
+// the pending requests first.  It does nothing once the service is closed.
 func (svc *WriteService) Close() error {
-	return svc.processor.Close()
+	if !atomic.CompareAndSwapInt32(&svc.closed, 0, 1) {
+		return nil
+	}
+	return svc.closeDeadLetter(svc.processor.Close())
+}
+
+// CloseNow rejects later writes as Close does but abandons the pending
+// requests instead of waiting for their commit, eg once a flush timed out
+func (svc *WriteService) CloseNow() error {
+	if !atomic.CompareAndSwapInt32(&svc.closed, 0, 1) {
+		return nil
+	}
+	return svc.closeDeadLetter(nil)
+}
+
+// closeDeadLetter closes the dead letter file, if any, returning err or the
+// error closing it
+func (svc *WriteService) closeDeadLetter(err error) error {
+	if svc.dead != nil {
+		if cerr := svc.dead.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// SetFilter replaces the filter of later writes, writes in progress finish
+// with the previous one.  Nil indexes everything.
+func (svc *WriteService) SetFilter(f *Filter) {
+	svc.filter.Store(f)
+}
+
+func (svc *WriteService) activeFilter() *Filter {
+	return svc.filter.Load().(*Filter)
+}
+
+// dailyIndex returns the daily index of base for a sample timestamp in ms.
+// Days start at local midnight, or midnight UTC with DailyUTC, and the name
+// is lower cased as Elasticsearch requires.
+func (svc *WriteService) dailyIndex(base string, timestamp int64) string {
+	layout := svc.config.DailyLayout
+	if layout == "" {
+		layout = defaultDailyLayout
+	}
+	day := time.Unix(timestamp/1000, 0).In(svc.dailyLocation()).Format(layout)
+	return base + "-" + strings.ToLower(day)
+}
+
+// dailyLocation returns the time zone whose days name daily indexes
+func (svc *WriteService) dailyLocation() *time.Location {
+	if svc.config.DailyUTC {
+		return time.UTC
+	}
+	return time.Local
+}
+
+// TenantIndex returns the index samples with tenant label value are written
+// to, the value lower cased with any character not valid in index names
+// replaced by an underscore
+func TenantIndex(alias, tenant string) string {
+	b := []byte(strings.ToLower(tenant))
+	for i, c := range b {
+		if !(c == '_' || c == '-' || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9')) {
+			b[i] = '_'
+		}
+	}
+	return alias + "-tenant-" + string(b)
+}
+
+// sanitizeLabelName replaces any character which is not valid in a Prometheus
+// label name, notably dots which Elasticsearch treats as object paths, with an
+// underscore.  Valid names, including __name__, are returned unchanged.
+func sanitizeLabelName(name string) string {
+	if model.LabelName(name).IsValid() {
+		return name
+	}
+	if name == "" {
+		return "_"
+	}
+	b := []byte(name)
+	for i, c := range b {
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9' && i > 0)) {
+			b[i] = '_'
+		}
+	}
+	return string(b)
 }
 
-// Write will enqueue Prometheus sample data to be batch written to Elasticsearch
-func (svc *WriteService) Write(req []*prompb.TimeSeries) {
-	index := svc.config.Alias
+// Flush will commit all pending bulk requests to Elasticsearch, giving up
+// when ctx is done
+func (svc *WriteService) Flush(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- svc.processor.Flush()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// paused reports whether writes are refused after a commit had RejectLimit
+// items rejected
+func (svc *WriteService) paused() bool {
+	if svc.config.RejectLimit <= 0 {
+		return false
+	}
+	rejectedAt := atomic.LoadInt64(&svc.rejectedAt)
+	return time.Since(time.Unix(0, rejectedAt)) < svc.config.RejectPause
+}
+
+// Write will enqueue Prometheus sample data to be batch written to Elasticsearch.
+// ErrUnavailable is returned without queueing anything once the service is
+// closed or shortly after a bulk commit failed, so senders retry instead of
+// having their samples dropped, and ErrQueueFull when MaxQueued is exceeded.
+// It returns the number of samples queued, without those dropped by the
+// filters, the label guards, the timestamp bounds or for invalid values.
+func (svc *WriteService) Write(req []*prompb.TimeSeries) (int, error) {
+	if atomic.LoadInt32(&svc.closed) == 1 {
+		return 0, ErrUnavailable
+	}
+	if failedAt := atomic.LoadInt64(&svc.failedAt); time.Since(time.Unix(0, failedAt)) < unavailableFor {
+		return 0, ErrUnavailable
+	}
+	if svc.paused() {
+		return 0, ErrQueueFull
+	}
+	if svc.config.MaxQueued > 0 {
+		// series docs hold many samples, the samples are counted either way
+		var n int64
+		for _, ts := range req {
+			n += int64(len(ts.Samples))
+		}
+		// a request larger than MaxQueued is still accepted once the queue
+		// is empty, it would be rejected forever otherwise
+		if queued := atomic.LoadInt64(&svc.queued); queued > 0 && queued+n > svc.config.MaxQueued {
+			return 0, ErrQueueFull
+		}
+	}
+	written := 0
 	for _, ts := range req {
+		svc.received.Add(float64(len(ts.Samples)))
 		metric := make(model.Metric, len(ts.Labels))
 		for _, l := range ts.Labels {
-			metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+			name := l.Name
+			if svc.config.SanitizeLabels {
+				name = sanitizeLabelName(name)
+			}
+			metric[model.LabelName(name)] = model.LabelValue(l.Value)
+		}
+		if svc.activeFilter().Drop(metric) {
+			svc.dropped.Add(float64(len(ts.Samples)))
+			continue
+		}
+		if svc.config.Sampler.Drop(metric) {
+			svc.sampledOut.Add(float64(len(ts.Samples)))
+			continue
 		}
-		for _, s := range ts.Samples {
+		if !svc.allowLabels(metric) {
+			svc.labelDropped.Add(float64(len(ts.Samples)))
+			continue
+		}
+		samples := svc.checkTimestamps(metric, ts.Samples)
+		fingerprint := metric.Fingerprint().String()
+		if svc.config.SeriesDocs {
+			written += svc.writeSeries(metric, fingerprint, samples)
+			continue
+		}
+		for _, s := range samples {
 			v := float64(s.Value)
 			if math.IsNaN(v) || math.IsInf(v, 0) {
 				svc.logger.Debug(fmt.Sprintf("invalid value %+v, skipping sample %+v", v, s))
 				continue
 			}
 			sample := prometheusSample{
-				metric,
-				v,
-				s.Timestamp,
+				Labels:      metric,
+				Value:       v,
+				Timestamp:   s.Timestamp,
+				Fingerprint: fingerprint,
 			}
-			if svc.config.Daily {
-				index = svc.config.Alias + "-" + time.Unix(s.Timestamp/1000, 0).Format("2006-01-02")
+			if svc.config.DataStream {
+				sample.DataStreamTimestamp = s.Timestamp
 			}
-			r := elastic.
-				NewBulkIndexRequest().
-				Index(index).
-				Type(sampleType).
-				Doc(sample)
-			svc.processor.Add(r)
+			svc.add(svc.index(metric, s.Timestamp), svc.docID(fingerprint, s.Timestamp, s.Timestamp), sample, 1)
+			written++
+		}
+	}
+	return written, nil
+}
+
+// checkTimestamps counts and logs the samples of metric outside the range set
+// by MaxSampleAge and MaxFutureSkew, returning the samples to index
+func (svc *WriteService) checkTimestamps(metric model.Metric, samples []prompb.Sample) []prompb.Sample {
+	if svc.config.MaxSampleAge <= 0 && svc.config.MaxFutureSkew <= 0 {
+		return samples
+	}
+	now := time.Now()
+	var oldest, newest int64
+	if svc.config.MaxSampleAge > 0 {
+		oldest = now.Add(-svc.config.MaxSampleAge).UnixNano() / int64(time.Millisecond)
+	}
+	if svc.config.MaxFutureSkew > 0 {
+		newest = now.Add(svc.config.MaxFutureSkew).UnixNano() / int64(time.Millisecond)
+	}
+	var tooOld, future int
+	kept := make([]prompb.Sample, 0, len(samples))
+	for _, s := range samples {
+		if oldest > 0 && s.Timestamp < oldest {
+			tooOld++
+			continue
 		}
+		if newest > 0 && s.Timestamp > newest {
+			future++
+			continue
+		}
+		kept = append(kept, s)
+	}
+	if tooOld+future == 0 {
+		return samples
+	}
+	svc.outOfRange.WithLabelValues("too_old").Add(float64(tooOld))
+	svc.outOfRange.WithLabelValues("future").Add(float64(future))
+	svc.logger.Warn("Samples outside the accepted time range",
+		zap.String("series", metric.String()),
+		zap.Int("too_old", tooOld),
+		zap.Int("future", future),
+		zap.Bool("dropped", svc.config.DropOutOfRange))
+	if svc.config.DropOutOfRange {
+		return kept
 	}
+	return samples
 }
 
+// allowLabels records the label names of metric, reporting false without
+// recording any when they would exceed MaxLabelNames
+func (svc *WriteService) allowLabels(metric model.Metric) bool {
+	if svc.config.MaxLabelNames <= 0 {
+		return true
+	}
+	svc.labelMu.Lock()
+	defer svc.labelMu.Unlock()
+	var added []model.LabelName
+	for name := range metric {
+		if _, ok := svc.labelNames[name]; !ok {
+			added = append(added, name)
+		}
+	}
+	if len(added) == 0 {
+		return true
+	}
+	if len(svc.labelNames)+len(added) > svc.config.MaxLabelNames {
+		svc.logger.Warn("Dropping series exceeding the label name limit",
+			zap.String("series", metric.String()),
+			zap.Int("max", svc.config.MaxLabelNames))
+		return false
+	}
+	for _, name := range added {
+		svc.labelNames[name] = struct{}{}
+	}
+	return true
+}
+
+// writeSeries queues the samples of a series as one doc per index, returning
+// the number of samples queued
+func (svc *WriteService) writeSeries(metric model.Metric, fingerprint string, samples []prompb.Sample) int {
+	docs := make(map[string]*prometheusSeries)
+	var order []string
+	for _, s := range samples {
+		v := float64(s.Value)
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			svc.logger.Debug(fmt.Sprintf("invalid value %+v, skipping sample %+v", v, s))
+			continue
+		}
+		index := svc.index(metric, s.Timestamp)
+		doc, ok := docs[index]
+		if !ok {
+			doc = &prometheusSeries{
+				Labels:       metric,
+				Fingerprint:  fingerprint,
+				Timestamp:    s.Timestamp,
+				EndTimestamp: s.Timestamp,
+			}
+			docs[index] = doc
+			order = append(order, index)
+		}
+		if s.Timestamp < doc.Timestamp {
+			doc.Timestamp = s.Timestamp
+		}
+		if s.Timestamp > doc.EndTimestamp {
+			doc.EndTimestamp = s.Timestamp
+		}
+		doc.Samples = append(doc.Samples, seriesSample{Value: v, Timestamp: s.Timestamp})
+	}
+	written := 0
+	for _, index := range order {
+		doc := docs[index]
+		if svc.config.DataStream {
+			doc.DataStreamTimestamp = doc.Timestamp
+		}
+		svc.add(index, svc.docID(fingerprint, doc.Timestamp, doc.EndTimestamp), doc, len(doc.Samples))
+		written += len(doc.Samples)
+	}
+	return written
+}
+
+// docID returns the _id of the doc of a series holding samples from start to
+// end in ms when DedupIDs is set, otherwise "" for Elasticsearch to generate
+// one
+func (svc *WriteService) docID(fingerprint string, start, end int64) string {
+	if !svc.config.DedupIDs {
+		return ""
+	}
+	if start == end {
+		return fingerprint + "-" + strconv.FormatInt(start, 10)
+	}
+	return fingerprint + "-" + strconv.FormatInt(start, 10) + "-" + strconv.FormatInt(end, 10)
+}
+
+// index returns the index a sample of metric with timestamp in ms is written to
+func (svc *WriteService) index(metric model.Metric, timestamp int64) string {
+	base := svc.config.Alias
+	if svc.config.TenantLabel != "" {
+		if tenant, ok := metric[model.LabelName(svc.config.TenantLabel)]; ok && tenant != "" {
+			base = TenantIndex(svc.config.Alias, string(tenant))
+		}
+	}
+	if svc.config.Daily {
+		return svc.dailyIndex(base, timestamp)
+	}
+	return base
+}
+
+// sampleRequest is the bulk request of a sample or series doc, tagged with
+// the number of samples it holds and its size in the bulk body.  Metadata and
+// exemplar docs are not sample requests, they are neither counted as samples
+// nor queued.
+type sampleRequest struct {
+	*elastic.BulkIndexRequest
+	samples int
+	size    int
+}
+
+// newSampleRequest tags r with the samples it holds, measuring its size once.
+// The lines are cached by r so the bulk processor reuses them.
+func newSampleRequest(r *elastic.BulkIndexRequest, samples int) *sampleRequest {
+	req := &sampleRequest{BulkIndexRequest: r, samples: samples}
+	if lines, err := r.Source(); err == nil {
+		for _, line := range lines {
+			// each line is followed by a newline in the bulk body
+			req.size += len(line) + 1
+		}
+	}
+	return req
+}
+
+// requestSamples returns the number of samples r indexes
+func requestSamples(r elastic.BulkableRequest) int {
+	if s, ok := r.(*sampleRequest); ok {
+		return s.samples
+	}
+	return 0
+}
+
+// queuedSamples returns the number of samples requests index
+func queuedSamples(requests []elastic.BulkableRequest) int64 {
+	var n int64
+	for _, r := range requests {
+		n += int64(requestSamples(r))
+	}
+	return n
+}
+
+// add queues doc holding samples for indexing into index, with id unless it
+// is empty
+func (svc *WriteService) add(index, id string, doc interface{}, samples int) {
+	r := elastic.
+		NewBulkIndexRequest().
+		Index(index).
+		Type(docType(svc.config.Typeless)).
+		Doc(svc.config.Fields.encode(doc))
+	if id != "" {
+		r.Id(id)
+	}
+	if svc.config.Pipeline != "" {
+		r.Pipeline(svc.config.Pipeline)
+	}
+	if svc.config.DataStream {
+		// data streams are append only and reject the index op type
+		r.OpType("create")
+	}
+	if svc.config.DryRun {
+		svc.dryRun.Add(float64(samples))
+		svc.logDryRun(r)
+		return
+	}
+	atomic.AddInt64(&svc.queued, int64(samples))
+	svc.processor.Add(newSampleRequest(r, samples))
+}
+
+// logDryRun logs a bulk request that would have been committed
+func (svc *WriteService) logDryRun(r *elastic.BulkIndexRequest) {
+	if ce := svc.logger.Check(zap.DebugLevel, "Dry run bulk request"); ce != nil {
+		lines, err := r.Source()
+		if err != nil {
+			svc.logger.Error("Failed to encode bulk request", zap.Error(err))
+			return
+		}
+		ce.Write(zap.Strings("request", lines))
+	}
+}
+
+// before is invoked by bulk processor before every commit.
+func (svc *WriteService) before(id int64, requests []elastic.BulkableRequest) {
+	if svc.config.Stats {
+		svc.started.Store(id, time.Now())
+		svc.flushes.WithLabelValues(svc.flushReason(requests)).Inc()
+	}
+	if svc.config.Tracer != nil {
+		// flushes batch many remote writes, their spans start new traces
+		_, span := svc.config.Tracer.Start(context.Background(), "elasticsearch.bulk", tracing.KindClient)
+		span.SetString("db.system", "elasticsearch")
+		span.SetString("es.alias", svc.config.Alias)
+		span.SetInt("es.bulk.docs", int64(len(requests)))
+		svc.spans.Store(id, span)
+	}
+}
+
+// flushReason infers which threshold triggered a commit the same way the
+// bulk processor checks them, commits below both were due to the flush
+// interval or an explicit Flush.  The size is estimated from the sizes
+// measured when the sample requests were added, metadata and exemplar docs
+// are left out.
+func (svc *WriteService) flushReason(requests []elastic.BulkableRequest) string {
+	if svc.config.MaxDocs > 0 && len(requests) >= svc.config.MaxDocs {
+		return "docs"
+	}
+	if svc.config.MaxSize > 0 {
+		var size int
+		for _, r := range requests {
+			if s, ok := r.(*sampleRequest); ok {
+				size += s.size
+			}
+		}
+		if size >= svc.config.MaxSize {
+			return "size"
+		}
+	}
+	return "age"
+}
+
+// retryItemStatus holds the statuses of bulk items resent after a backoff,
+// the defaults of the bulk processor
+var retryItemStatus = map[int]bool{408: true, 429: true, 503: true, 507: true}
+
 // after is invoked by bulk processor after every commit.
 // The err variable indicates success or failure.
 func (svc *WriteService) after(id int64, requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
+	// resent items stay queued until their last attempt
+	defer atomic.AddInt64(&svc.queued, -queuedSamples(requests))
+	if start, ok := svc.started.Load(id); ok {
+		svc.started.Delete(id)
+		svc.latency.Observe(time.Since(start.(time.Time)).Seconds())
+	}
+	var span *tracing.Span
+	if v, ok := svc.spans.Load(id); ok {
+		svc.spans.Delete(id)
+		span = v.(*tracing.Span)
+		defer span.End()
+		if response != nil {
+			// Elasticsearch's own time for the first attempt
+			span.SetInt("es.took_ms", int64(response.Took))
+		}
+	}
+	pending := requests
+	rejected := 0
+	failed := 0
+	for attempt := 1; err == nil; attempt++ {
+		wait, retry := svc.backoff.Next(attempt)
+		var resend []elastic.BulkableRequest
+		// response items are 1 to 1 with pending in the same order
+		for n, i := range response.Items {
+			if n >= len(pending) {
+				break
+			}
+			// items are keyed by op type, index or create for data streams
+			for _, item := range i {
+				if retry && retryItemStatus[item.Status] {
+					resend = append(resend, pending[n])
+					continue
+				}
+				if item.Status == 429 {
+					rejected++
+				}
+				if !svc.itemDone(pending[n], item) {
+					failed++
+				}
+			}
+		}
+		if len(resend) == 0 {
+			break
+		}
+		time.Sleep(wait)
+		pending = resend
+		response, err = svc.client.Bulk().Add(resend...).Do(svc.ctx)
+	}
 	if err != nil {
 		svc.logger.Error(err.Error())
-	} else {
-		for _, i := range response.Items {
-			if i["index"].Status != 201 {
-				svc.logger.Error(fmt.Sprintf("%+v", i["index"].Error))
-			}
+		atomic.StoreInt64(&svc.failedAt, time.Now().UnixNano())
+		failed += len(pending)
+		for _, r := range pending {
+			svc.failed.Add(float64(requestSamples(r)))
+			svc.deadLetter(r, err.Error())
+		}
+		span.SetError(err)
+	}
+	span.SetInt("es.bulk.failed", int64(failed))
+	svc.checkRejected(rejected)
+}
+
+// itemDone accounts for the last attempt of a bulk item, returning false if
+// it failed
+func (svc *WriteService) itemDone(r elastic.BulkableRequest, item *elastic.BulkResponseItem) bool {
+	// metadata docs are overwritten, answered with 200
+	if item.Status == 200 || item.Status == 201 {
+		if m, ok := r.(*metadataRequest); ok {
+			svc.metadata.Store(m.md.Metric, m.md)
 		}
+		svc.sent.Add(float64(requestSamples(r)))
+		return true
+	}
+	// data streams only create docs, a sample sent again with DedupIDs
+	// conflicts with the doc already indexed
+	if item.Status == 409 && svc.config.DedupIDs {
+		svc.duplicates.Inc()
+		return true
+	}
+	svc.failed.Add(float64(requestSamples(r)))
+	svc.logger.Error(fmt.Sprintf("%+v", item.Error))
+	if item.Error != nil && item.Error.Type == "index_not_found_exception" {
+		svc.missingAlias()
+	}
+	svc.deadLetter(r, fmt.Sprintf("%+v", item.Error))
+	return false
+}
+
+// checkRejected counts the items of a commit still rejected with 429 once
+// the retries gave up, pausing writes when there are at least RejectLimit
+func (svc *WriteService) checkRejected(rejected int) {
+	if rejected == 0 {
+		return
+	}
+	svc.rejected.Add(float64(rejected))
+	if svc.config.RejectLimit > 0 && rejected >= svc.config.RejectLimit {
+		atomic.StoreInt64(&svc.rejectedAt, time.Now().UnixNano())
+		svc.logger.Warn("Elasticsearch rejected bulk items, pausing writes",
+			zap.Int("rejected", rejected), zap.Duration("pause", svc.config.RejectPause))
+	}
+}
+
+// missingAlias runs MissingAlias in the background unless it is already
+// running
+func (svc *WriteService) missingAlias() {
+	if svc.config.MissingAlias == nil || !atomic.CompareAndSwapInt32(&svc.recovering, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&svc.recovering, 0)
+		svc.config.MissingAlias()
+	}()
+}
+
+// deadLetter records a request that could not be indexed
+func (svc *WriteService) deadLetter(r elastic.BulkableRequest, reason string) {
+	if svc.dead == nil {
+		return
+	}
+	if err := svc.dead.Write(r, reason); err != nil {
+		svc.logger.Error("Failed to write dead letter", zap.Error(err))
+		return
 	}
+	svc.deadCount.Add(float64(requestSamples(r)))
 }
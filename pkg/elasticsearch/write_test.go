@@ -0,0 +1,935 @@
+package elasticsearch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/pwillie/prometheus-es-adapter/pkg/tracing"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+func counterValue(c prometheus.Counter) float64 {
+	var m dto.Metric
+	c.Write(&m)
+	return m.GetCounter().GetValue()
+}
+
+// newTestWriteService returns a WriteService without a bulk processor,
+// resending items to client
+func newTestWriteService(client *elastic.Client, backoff elastic.Backoff) *WriteService {
+	return &WriteService{
+		config:     &WriteConfig{},
+		logger:     zap.NewNop(),
+		client:     client,
+		ctx:        context.Background(),
+		backoff:    backoff,
+		deadCount:  newDeadLetterCounter(),
+		sent:       newSentCounter(),
+		failed:     newFailedCounter(),
+		rejected:   newRejectedCounter(),
+		duplicates: newDuplicateCounter(),
+	}
+}
+
+func testRequests(names ...string) []elastic.BulkableRequest {
+	var requests []elastic.BulkableRequest
+	for _, name := range names {
+		r := elastic.NewBulkIndexRequest().
+			Index("prom-metrics").
+			Type("_doc").
+			Doc(map[string]string{"name": name})
+		requests = append(requests, newSampleRequest(r, 1))
+	}
+	return requests
+}
+
+// testResponse returns a bulk response with an index item of each status
+func testResponse(statuses ...int) *elastic.BulkResponse {
+	res := &elastic.BulkResponse{}
+	for _, status := range statuses {
+		item := &elastic.BulkResponseItem{Index: "prom-metrics", Status: status}
+		if status >= 300 {
+			res.Errors = true
+			item.Error = &elastic.ErrorDetails{Type: fmt.Sprintf("error_%d", status)}
+		}
+		res.Items = append(res.Items, map[string]*elastic.BulkResponseItem{"index": item})
+	}
+	return res
+}
+
+// bulkServer answers bulk requests with the next of responses, recording
+// the names of the docs of each request
+type bulkServer struct {
+	responses []*elastic.BulkResponse
+	names     [][]string
+}
+
+func (s *bulkServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var names []string
+	scanner := bufio.NewScanner(r.Body)
+	for line := 0; scanner.Scan(); line++ {
+		// odd lines are docs, even lines their action
+		if line%2 == 1 {
+			var doc map[string]string
+			json.Unmarshal(scanner.Bytes(), &doc)
+			names = append(names, doc["name"])
+		}
+	}
+	s.names = append(s.names, names)
+	res := s.responses[0]
+	s.responses = s.responses[1:]
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// newTestClient returns a client of an Elasticsearch served by handler, the
+// server must be closed
+func newTestClient(t *testing.T, handler http.Handler) (*elastic.Client, *httptest.Server) {
+	srv := httptest.NewServer(handler)
+	client, err := elastic.NewClient(elastic.SetURL(srv.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	return client, srv
+}
+
+func TestAfterResendsRetryableItems(t *testing.T) {
+	es := &bulkServer{responses: []*elastic.BulkResponse{testResponse(201)}}
+	client, srv := newTestClient(t, es)
+	defer srv.Close()
+	svc := newTestWriteService(client, elastic.NewConstantBackoff(time.Millisecond))
+	svc.queued = 3
+	svc.after(1, testRequests("a", "b", "c"), testResponse(201, 429, 400), nil)
+
+	if len(es.names) != 1 || strings.Join(es.names[0], ",") != "b" {
+		t.Errorf("got resent docs %v, want [[b]]", es.names)
+	}
+	if got := counterValue(svc.sent); got != 2 {
+		t.Errorf("got %g sent, want 2", got)
+	}
+	if got := counterValue(svc.failed); got != 1 {
+		t.Errorf("got %g failed, want 1", got)
+	}
+	if got := counterValue(svc.rejected); got != 0 {
+		t.Errorf("got %g rejected, want 0", got)
+	}
+	if svc.queued != 0 {
+		t.Errorf("got %d queued, want 0", svc.queued)
+	}
+}
+
+func TestAfterGivesUpRetrying(t *testing.T) {
+	svc := newTestWriteService(nil, elastic.StopBackoff{})
+	svc.after(1, testRequests("a", "b"), testResponse(429, 201), nil)
+
+	if got := counterValue(svc.sent); got != 1 {
+		t.Errorf("got %g sent, want 1", got)
+	}
+	if got := counterValue(svc.failed); got != 1 {
+		t.Errorf("got %g failed, want 1", got)
+	}
+	if got := counterValue(svc.rejected); got != 1 {
+		t.Errorf("got %g rejected, want 1", got)
+	}
+}
+
+func TestAfterFailedCommit(t *testing.T) {
+	svc := newTestWriteService(nil, elastic.StopBackoff{})
+	svc.after(1, testRequests("a", "b"), nil, fmt.Errorf("connection refused"))
+
+	if got := counterValue(svc.failed); got != 2 {
+		t.Errorf("got %g failed, want 2", got)
+	}
+	if got := counterValue(svc.sent); got != 0 {
+		t.Errorf("got %g sent, want 0", got)
+	}
+}
+
+func TestFlushCommitsBufferedDocs(t *testing.T) {
+	es := &bulkServer{responses: []*elastic.BulkResponse{testResponse(201, 201)}}
+	client, srv := newTestClient(t, es)
+	defer srv.Close()
+	svc, err := NewWriteService(context.Background(), zap.NewNop(), client, &WriteConfig{
+		Alias:        "prom-metrics",
+		MaxDocs:      100,
+		MaxSize:      1 << 20,
+		FlushWorkers: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	_, err = svc.Write([]*prompb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}, {Value: 1, Timestamp: 2000}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es.names) != 0 {
+		t.Fatalf("got %d bulk requests before the flush, want the docs buffered", len(es.names))
+	}
+	if err := svc.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(es.names) != 1 || len(es.names[0]) != 2 {
+		t.Fatalf("got bulk requests %v, want one of 2 docs", es.names)
+	}
+	if got := counterValue(svc.sent); got != 2 {
+		t.Errorf("got %g sent, want 2", got)
+	}
+}
+
+func TestDedupIDs(t *testing.T) {
+	var ids []string
+	client, srv := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := &elastic.BulkResponse{}
+		scanner := bufio.NewScanner(r.Body)
+		for line := 0; scanner.Scan(); line++ {
+			if line%2 == 1 {
+				continue
+			}
+			var action map[string]struct {
+				ID string `json:"_id"`
+			}
+			json.Unmarshal(scanner.Bytes(), &action)
+			ids = append(ids, action["index"].ID)
+			res.Items = append(res.Items, map[string]*elastic.BulkResponseItem{"index": {Status: 201}})
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	defer srv.Close()
+	svc, err := NewWriteService(context.Background(), zap.NewNop(), client, &WriteConfig{
+		Alias:        "prom-metrics",
+		MaxDocs:      100,
+		MaxSize:      1 << 20,
+		FlushWorkers: 1,
+		DedupIDs:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	up := []*prompb.Label{{Name: "__name__", Value: "up"}}
+	for _, ts := range []*prompb.TimeSeries{
+		{Labels: up, Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}}},
+		// sent again
+		{Labels: up, Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}}},
+		{Labels: up, Samples: []prompb.Sample{{Value: 1, Timestamp: 2000}}},
+		{Labels: []*prompb.Label{{Name: "__name__", Value: "down"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}}},
+	} {
+		if _, err := svc.Write([]*prompb.TimeSeries{ts}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := svc.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ids) != 4 {
+		t.Fatalf("got ids %v, want 4", ids)
+	}
+	if ids[0] == "" || ids[0] != ids[1] {
+		t.Errorf("got ids %q and %q for the same sample, want the same", ids[0], ids[1])
+	}
+	seen := map[string]bool{}
+	for _, id := range []string{ids[0], ids[2], ids[3]} {
+		if seen[id] {
+			t.Errorf("got id %q for different samples, want distinct ids", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestSampleCounters(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		sent   float64
+		failed float64
+	}{
+		{"stored", 201, 3, 0},
+		{"failed", 400, 0, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// three samples and one metadata doc committed together
+			es := &bulkServer{responses: []*elastic.BulkResponse{testResponse(test.status, test.status, test.status, test.status)}}
+			client, srv := newTestClient(t, es)
+			defer srv.Close()
+			svc, err := NewWriteService(context.Background(), zap.NewNop(), client, &WriteConfig{
+				Alias:        "prom-metrics",
+				Metadata:     true,
+				MaxDocs:      100,
+				MaxSize:      1 << 20,
+				FlushWorkers: 1,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer svc.Close()
+
+			_, err = svc.Write([]*prompb.TimeSeries{
+				{
+					Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}},
+					Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}, {Value: 1, Timestamp: 2000}},
+				},
+				{
+					Labels:  []*prompb.Label{{Name: "__name__", Value: "down"}},
+					Samples: []prompb.Sample{{Value: 0, Timestamp: 1000}},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			svc.WriteMetadata([]MetricMetadata{{Metric: "up", Type: "gauge"}})
+			if got := counterValue(svc.received); got != 3 {
+				t.Errorf("got %g received, want 3", got)
+			}
+			if got := svc.queued; got != 3 {
+				t.Errorf("got %d queued, want 3", got)
+			}
+			if err := svc.Flush(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(es.names) != 1 || len(es.names[0]) != 4 {
+				t.Fatalf("got bulk requests %v, want one of 4 docs", es.names)
+			}
+			if got := counterValue(svc.sent); got != test.sent {
+				t.Errorf("got %g sent, want %g", got, test.sent)
+			}
+			if got := counterValue(svc.failed); got != test.failed {
+				t.Errorf("got %g failed, want %g", got, test.failed)
+			}
+			if got := svc.queued; got != 0 {
+				t.Errorf("got %d queued, want 0", got)
+			}
+		})
+	}
+}
+
+func TestFlushReason(t *testing.T) {
+	// each test request is 64 bytes in the bulk body
+	tests := []struct {
+		name     string
+		requests []elastic.BulkableRequest
+		want     string
+	}{
+		{"docs", testRequests("a", "b", "c"), "docs"},
+		{"size", testRequests("a", "b"), "size"},
+		{"age", testRequests("a"), "age"},
+		{"metadata not sized", []elastic.BulkableRequest{
+			testRequests("a")[0],
+			&metadataRequest{BulkIndexRequest: elastic.NewBulkIndexRequest().Index("prom-metrics_metadata").Type("_doc").Doc(MetricMetadata{Metric: "up"})},
+		}, "age"},
+	}
+	for _, test := range tests {
+		svc := newTestWriteService(nil, nil)
+		svc.config = &WriteConfig{MaxDocs: 3, MaxSize: 100, Stats: true}
+		svc.flushes = newFlushCounter()
+		svc.before(1, test.requests)
+
+		for _, reason := range []string{"age", "docs", "size"} {
+			want := 0.0
+			if reason == test.want {
+				want = 1
+			}
+			if got := counterValue(svc.flushes.WithLabelValues(reason)); got != want {
+				t.Errorf("%s: got %g %s flushes, want %g", test.name, got, reason, want)
+			}
+		}
+	}
+}
+
+func TestBulkSpan(t *testing.T) {
+	var spans []struct {
+		TraceID      string `json:"traceId"`
+		ParentSpanID string `json:"parentSpanId"`
+		Name         string `json:"name"`
+		Attributes   []struct {
+			Key   string `json:"key"`
+			Value struct {
+				IntValue string `json:"intValue"`
+			} `json:"value"`
+		} `json:"attributes"`
+	}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans json.RawMessage `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			return
+		}
+		json.Unmarshal(req.ResourceSpans[0].ScopeSpans[0].Spans, &spans)
+	}))
+	defer collector.Close()
+	tracer := tracing.NewTracer(zap.NewNop(), collector.URL, "test")
+	svc := newTestWriteService(nil, elastic.StopBackoff{})
+	svc.config = &WriteConfig{Alias: "prom-metrics", Tracer: tracer}
+	response := testResponse(201, 400, 201)
+	response.Took = 7
+	svc.before(1, testRequests("a", "b", "c"))
+	svc.after(1, testRequests("a", "b", "c"), response, nil)
+	tracer.Close()
+
+	if len(spans) != 1 || spans[0].Name != "elasticsearch.bulk" {
+		t.Fatalf("got spans %+v, want one elasticsearch.bulk span", spans)
+	}
+	// commits batch many remote writes, none of which is the parent
+	if spans[0].ParentSpanID != "" || spans[0].TraceID == "" {
+		t.Errorf("got trace %s and parent %s, want a new trace", spans[0].TraceID, spans[0].ParentSpanID)
+	}
+	got := map[string]string{}
+	for _, a := range spans[0].Attributes {
+		if a.Value.IntValue != "" {
+			got[a.Key] = a.Value.IntValue
+		}
+	}
+	want := map[string]string{"es.bulk.docs": "3", "es.bulk.failed": "1", "es.took_ms": "7"}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("got %s %q, want %q", key, got[key], value)
+		}
+	}
+	if _, ok := svc.spans.Load(int64(1)); ok {
+		t.Error("the span of the commit is still held after it")
+	}
+}
+
+func TestDailyIndex(t *testing.T) {
+	local := time.Local
+	defer func() { time.Local = local }()
+	time.Local = time.FixedZone("UTC+10", 10*60*60)
+	// 2019-06-01T20:00:00Z, already the 2nd ten hours ahead
+	ts := time.Date(2019, 6, 1, 20, 0, 0, 0, time.UTC).UnixNano() / int64(time.Millisecond)
+	tests := []struct {
+		name   string
+		config WriteConfig
+		want   string
+	}{
+		{"local day", WriteConfig{}, "prom-metrics-2019-06-02"},
+		{"utc day", WriteConfig{DailyUTC: true}, "prom-metrics-2019-06-01"},
+		{"layout lower cased", WriteConfig{DailyUTC: true, DailyLayout: "2006-Jan-02"}, "prom-metrics-2019-jun-01"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			svc := &WriteService{config: &test.config}
+			if got := svc.dailyIndex("prom-metrics", ts); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNextDay(t *testing.T) {
+	now := time.Date(2019, 6, 1, 20, 0, 0, 0, time.UTC)
+	if got, want := nextDay(now, time.UTC), time.Date(2019, 6, 2, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	zone := time.FixedZone("UTC+10", 10*60*60)
+	if got, want := nextDay(now, zone), time.Date(2019, 6, 3, 0, 0, 0, 0, zone); !got.Equal(want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestPrecreateWait(t *testing.T) {
+	day := time.Date(2019, 6, 2, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		now  time.Time
+		want time.Duration
+	}{
+		{"before the lead", time.Date(2019, 6, 1, 20, 0, 0, 0, time.UTC), 3 * time.Hour},
+		{"within the lead", time.Date(2019, 6, 1, 23, 30, 0, 0, time.UTC), 0},
+		{"after midnight", time.Date(2019, 6, 2, 0, 5, 0, 0, time.UTC), 0},
+	}
+	for _, test := range tests {
+		if got := precreateWait(test.now, day, time.Hour); got != test.want {
+			t.Errorf("%s: got wait %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPrecreate(t *testing.T) {
+	tomorrow := "/prom-metrics-" + nextDay(time.Now(), time.UTC).Format(defaultDailyLayout)
+	created := make(chan struct{})
+	var once sync.Once
+	var requests []string
+	var mu sync.Mutex
+	client, srv := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"acknowledged":true}`))
+		once.Do(func() { close(created) })
+	}))
+	defer srv.Close()
+	// with a day of lead the next day is always due, the one after is not
+	svc := &WriteService{
+		config: &WriteConfig{Alias: "prom-metrics", Daily: true, DailyUTC: true, PrecreateLead: 24 * time.Hour},
+		logger: zap.NewNop(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		svc.precreate(ctx, client)
+		close(done)
+	}()
+	select {
+	case <-created:
+	case <-time.After(5 * time.Second):
+		t.Fatal("got no daily index created")
+	}
+	cancel()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"HEAD " + tomorrow, "PUT " + tomorrow}
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("got requests %v, want %v", requests, want)
+	}
+}
+
+func TestCloseNow(t *testing.T) {
+	release := make(chan struct{})
+	client, srv := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"items":[]}`))
+	}))
+	defer srv.Close()
+	defer close(release)
+	svc, err := NewWriteService(context.Background(), zap.NewNop(), client, &WriteConfig{
+		Alias:        "prom-metrics",
+		MaxDocs:      1,
+		FlushWorkers: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.Write([]*prompb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := svc.Flush(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got flush error %v, want a timeout while the commit is stuck", err)
+	}
+
+	closed := make(chan error)
+	go func() {
+		if err := svc.CloseNow(); err != nil {
+			closed <- err
+			return
+		}
+		// the later Close does nothing rather than waiting for the commit
+		closed <- svc.Close()
+	}()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("closing waited for the pending commit")
+	}
+	if _, err := svc.Write(nil); err != ErrUnavailable {
+		t.Errorf("got write error %v after CloseNow, want ErrUnavailable", err)
+	}
+}
+
+// startWriteService returns a WriteService committing to handler only when
+// flushed, and a func closing both
+func startWriteService(t *testing.T, handler http.Handler, config *WriteConfig) (*WriteService, func()) {
+	client, srv := newTestClient(t, handler)
+	config.Alias = "prom-metrics"
+	config.MaxDocs = 100
+	config.MaxSize = 1 << 20
+	config.FlushWorkers = 1
+	svc, err := NewWriteService(context.Background(), zap.NewNop(), client, config)
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	return svc, func() {
+		svc.Close()
+		srv.Close()
+	}
+}
+
+func TestOutOfRangeSamples(t *testing.T) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	hour := int64(time.Hour / time.Millisecond)
+	tests := []struct {
+		name string
+		drop bool
+		docs int
+	}{
+		{"flagged", false, 3},
+		{"dropped", true, 1},
+	}
+	for _, test := range tests {
+		es := &docServer{}
+		svc, stop := startWriteService(t, es, &WriteConfig{
+			MaxSampleAge:   time.Hour,
+			MaxFutureSkew:  10 * time.Minute,
+			DropOutOfRange: test.drop,
+		})
+		written, err := svc.Write([]*prompb.TimeSeries{{
+			Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: now - 2*hour}, {Value: 1, Timestamp: now}, {Value: 1, Timestamp: now + hour}},
+		}})
+		if err == nil {
+			err = svc.Flush(context.Background())
+		}
+		stop()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if len(es.docs) != test.docs || written != test.docs {
+			t.Errorf("%s: got %d docs, %d samples written, want %d", test.name, len(es.docs), written, test.docs)
+		}
+		for _, reason := range []string{"too_old", "future"} {
+			if got := counterValue(svc.outOfRange.WithLabelValues(reason)); got != 1 {
+				t.Errorf("%s: got %g %s samples, want 1", test.name, got, reason)
+			}
+		}
+	}
+}
+
+func TestMaxLabelNames(t *testing.T) {
+	es := &docServer{}
+	svc, stop := startWriteService(t, es, &WriteConfig{MaxLabelNames: 3})
+	series := func(labels ...string) *prompb.TimeSeries {
+		ts := &prompb.TimeSeries{Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}}}
+		for _, name := range labels {
+			ts.Labels = append(ts.Labels, &prompb.Label{Name: name, Value: "v"})
+		}
+		return ts
+	}
+	_, err := svc.Write([]*prompb.TimeSeries{
+		series("__name__", "job"),
+		// a fourth name would exceed the limit
+		series("__name__", "job", "pod", "container"),
+		series("__name__", "pod"),
+		series("__name__", "job", "pod"),
+		series("__name__", "container"),
+	})
+	if err == nil {
+		err = svc.Flush(context.Background())
+	}
+	stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es.docs) != 3 {
+		t.Errorf("got %d docs, want the 3 series within the limit", len(es.docs))
+	}
+	if got := counterValue(svc.labelDropped); got != 2 {
+		t.Errorf("got %g samples dropped, want 2", got)
+	}
+	if len(svc.labelNames) != 3 {
+		t.Errorf("got label names %v, want the 3 of the indexed series", svc.labelNames)
+	}
+}
+
+func TestRejectPause(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int
+		pause  time.Duration
+		paused bool
+	}{
+		{"limit reached", 2, time.Minute, true},
+		{"below limit", 3, time.Minute, false},
+		{"pause over", 2, time.Nanosecond, false},
+		{"disabled", 0, time.Minute, false},
+	}
+	for _, test := range tests {
+		svc := newTestWriteService(nil, elastic.StopBackoff{})
+		svc.config.RejectLimit = test.limit
+		svc.config.RejectPause = test.pause
+		svc.after(1, testRequests("a", "b", "c"), testResponse(429, 429, 201), nil)
+		// lets the shortest pause end
+		time.Sleep(time.Millisecond)
+		if got := svc.paused(); got != test.paused {
+			t.Errorf("%s: got paused %t, want %t", test.name, got, test.paused)
+		}
+		if test.paused {
+			if _, err := svc.Write(nil); err != ErrQueueFull {
+				t.Errorf("%s: got error %v writing while paused, want ErrQueueFull", test.name, err)
+			}
+		}
+	}
+}
+
+func TestMaxQueued(t *testing.T) {
+	for _, seriesDocs := range []bool{false, true} {
+		testMaxQueued(t, seriesDocs)
+	}
+}
+
+// testMaxQueued checks MaxQueued counts samples, not the docs holding them
+func testMaxQueued(t *testing.T, seriesDocs bool) {
+	es := &docServer{}
+	svc, stop := startWriteService(t, es, &WriteConfig{MaxQueued: 3, SeriesDocs: seriesDocs})
+	defer stop()
+	samples := func(n int) []*prompb.TimeSeries {
+		ts := &prompb.TimeSeries{Labels: []*prompb.Label{{Name: "__name__", Value: "up"}}}
+		for i := 0; i < n; i++ {
+			ts.Samples = append(ts.Samples, prompb.Sample{Value: 1, Timestamp: int64(i)})
+		}
+		return []*prompb.TimeSeries{ts}
+	}
+
+	steps := []struct {
+		name    string
+		samples int
+		flush   bool
+		err     error
+		queued  int64
+	}{
+		{"room left", 2, false, nil, 2},
+		{"over the limit", 2, false, ErrQueueFull, 2},
+		{"up to the limit", 1, false, nil, 3},
+		{"full", 1, false, ErrQueueFull, 3},
+		// a request larger than the limit is accepted when nothing is queued
+		{"flushed", 5, true, nil, 5},
+	}
+	for _, step := range steps {
+		if step.flush {
+			if err := svc.Flush(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := svc.Write(samples(step.samples)); err != step.err {
+			t.Errorf("%s, series docs %t: got error %v, want %v", step.name, seriesDocs, err, step.err)
+		}
+		if got := atomic.LoadInt64(&svc.queued); got != step.queued {
+			t.Errorf("%s, series docs %t: got %d queued, want %d", step.name, seriesDocs, got, step.queued)
+		}
+	}
+}
+
+// indexServer answers bulk requests with every item indexed, recording the
+// index of each item
+type indexServer struct {
+	indexes []string
+}
+
+func (s *indexServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	res := &elastic.BulkResponse{}
+	scanner := bufio.NewScanner(r.Body)
+	for line := 0; scanner.Scan(); line++ {
+		if line%2 == 1 {
+			continue
+		}
+		var action map[string]struct {
+			Index string `json:"_index"`
+		}
+		json.Unmarshal(scanner.Bytes(), &action)
+		s.indexes = append(s.indexes, action["index"].Index)
+		res.Items = append(res.Items, map[string]*elastic.BulkResponseItem{"index": {Status: 201}})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func TestTenantIndex(t *testing.T) {
+	tests := []struct {
+		name   string
+		daily  bool
+		tenant *prompb.Label
+		want   string
+	}{
+		{"tenant", false, &prompb.Label{Name: "tenant", Value: "b"}, "prom-metrics-tenant-b"},
+		{"sanitized", false, &prompb.Label{Name: "tenant", Value: "Team A"}, "prom-metrics-tenant-team_a"},
+		{"empty tenant", false, &prompb.Label{Name: "tenant", Value: ""}, "prom-metrics"},
+		{"no tenant", false, nil, "prom-metrics"},
+		{"daily tenant", true, &prompb.Label{Name: "tenant", Value: "b"}, "prom-metrics-tenant-b-1970-01-01"},
+		{"daily without tenant", true, nil, "prom-metrics-1970-01-01"},
+	}
+	for _, test := range tests {
+		es := &indexServer{}
+		svc, stop := startWriteService(t, es, &WriteConfig{TenantLabel: "tenant", Daily: test.daily, DailyUTC: true})
+		ts := &prompb.TimeSeries{
+			Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+		}
+		if test.tenant != nil {
+			ts.Labels = append(ts.Labels, test.tenant)
+		}
+		_, err := svc.Write([]*prompb.TimeSeries{ts})
+		if err == nil {
+			err = svc.Flush(context.Background())
+		}
+		stop()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if len(es.indexes) != 1 || es.indexes[0] != test.want {
+			t.Errorf("%s: got indexes %v, want %s", test.name, es.indexes, test.want)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	var bulks int
+	svc, stop := startWriteService(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bulks++
+		w.WriteHeader(http.StatusInternalServerError)
+	}), &WriteConfig{DryRun: true})
+	var logs bytes.Buffer
+	// the bulk processor workers log concurrently
+	svc.logger = zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.Lock(zapcore.AddSync(&logs)), zap.DebugLevel))
+	_, err := svc.Write([]*prompb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}, {Value: 1, Timestamp: 2000}, {Value: 1, Timestamp: 3000}},
+	}})
+	if err == nil {
+		err = svc.Flush(context.Background())
+	}
+	stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bulks != 0 {
+		t.Errorf("got %d bulk requests, want none", bulks)
+	}
+	if got := counterValue(svc.dryRun); got != 3 {
+		t.Errorf("got %g dry run samples, want 3", got)
+	}
+	if got := strings.Count(logs.String(), `"msg":"Dry run bulk request"`); got != 3 {
+		t.Errorf("got %d dry run requests logged, want 3", got)
+	}
+	if svc.queued != 0 {
+		t.Errorf("got %d queued, want none", svc.queued)
+	}
+}
+
+// errorLog records the messages of the elastic client error log
+type errorLog struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *errorLog) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func (l *errorLog) contains(s string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, m := range l.messages {
+		if strings.Contains(m, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestProcessorName(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"unavailable"}`, http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	errs := &errorLog{}
+	client, err := elastic.NewClient(elastic.SetURL(srv.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false), elastic.SetErrorLog(errs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc, err := NewWriteService(context.Background(), zap.NewNop(), client, &WriteConfig{
+		Alias:        "prom-metrics",
+		Name:         "adapter-a",
+		MaxDocs:      100,
+		FlushWorkers: 1,
+		BackoffMin:   time.Millisecond,
+		BackoffMax:   2 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+	_, err = svc.Write([]*prompb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// the processor names itself when its commits fail
+	if !errs.contains(`bulk processor "adapter-a"`) {
+		t.Errorf("got errors %q, want them to name the processor adapter-a", errs.messages)
+	}
+}
+
+func TestFlushWorkers(t *testing.T) {
+	for _, workers := range []int{1, 3} {
+		es := newPoolServer(&docServer{}, workers)
+		client, srv := newTestClient(t, es)
+		svc, err := NewWriteService(context.Background(), zap.NewNop(), client, &WriteConfig{
+			Alias:        "prom-metrics",
+			MaxDocs:      1,
+			FlushWorkers: workers,
+		})
+		if err != nil {
+			srv.Close()
+			t.Fatal(err)
+		}
+		// each doc is its own commit, taken by the next idle worker
+		for i := 0; i < 2*workers; i++ {
+			_, err := svc.Write([]*prompb.TimeSeries{{
+				Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: int64(1000 + i)}},
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		svc.Close()
+		srv.Close()
+		if got := atomic.LoadInt64(&es.max); got != int64(workers) {
+			t.Errorf("got %d concurrent bulk requests with %d workers, want %d", got, workers, workers)
+		}
+	}
+}
@@ -2,43 +2,204 @@ package handlers
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gogo/protobuf/proto"
 	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
 	"github.com/prometheus/prometheus/prompb"
+	"github.com/pwillie/prometheus-es-adapter/pkg/elasticsearch"
+	"go.uber.org/zap"
 )
 
+var errBodyTooLarge = errors.New("request body too large")
+
+// errUnsupportedEncoding is returned by decodeBody for encodings other than
+// snappy and zstd
+var errUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+
+// errDecodedTooLarge is returned when a request body would decompress to
+// more than maxDecodedBytes
+var errDecodedTooLarge = errors.New("decoded request body too large")
+
+// zstdDecoder decodes zstd request bodies, DecodeAll is safe for concurrent
+// use.  Decoded bodies are capped at maxDecodedBytes like snappy ones.
+var zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecodedBytes))
+
+// maxDecodedBytes caps the size of a decompressed request body, a few bytes
+// of snappy can declare a length of 4GiB
+const maxDecodedBytes = 1 << 30
+
+// decodeSnappy decodes a snappy block body, checking the length it declares
+// before allocating it
+func decodeSnappy(compressed []byte) ([]byte, error) {
+	n, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("decoding snappy body: %s", err)
+	}
+	if n > maxDecodedBytes {
+		return nil, errDecodedTooLarge
+	}
+	b, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, fmt.Errorf("decoding snappy body: %s", err)
+	}
+	return b, nil
+}
+
+// readBody reads the request body, failing with errBodyTooLarge past limit
+// bytes when limit is positive
+func readBody(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, error) {
+	if limit > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil && limit > 0 && int64(len(b)) >= limit {
+		return nil, errBodyTooLarge
+	}
+	return b, err
+}
+
+// errorResponse is the JSON body of failed remote read and write requests,
+// Code repeating the HTTP status
+type errorResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeError answers a remote read or write request with status and a JSON
+// errorResponse
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Code: status, Message: message})
+}
+
+// bodyError answers a request whose body could not be read or decoded
+// within the limits
+func bodyError(w http.ResponseWriter, err error) {
+	if err == errBodyTooLarge || err == errDecodedTooLarge {
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err.Error())
+}
+
+// decodeBody decompresses a remote write body by its Content-Encoding,
+// snappy when none is given as Prometheus always compresses them
+func decodeBody(r *http.Request, compressed []byte) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "snappy":
+		return decodeSnappy(compressed)
+	case "zstd":
+		b, err := zstdDecoder.DecodeAll(compressed, nil)
+		// the window of single segment frames is their declared size
+		if err == zstd.ErrDecoderSizeExceeded || err == zstd.ErrWindowSizeExceeded {
+			return nil, errDecodedTooLarge
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decoding zstd body: %s", err)
+		}
+		return b, nil
+	default:
+		return nil, errUnsupportedEncoding
+	}
+}
+
 type writeService interface {
-	Write([]*prompb.TimeSeries)
+	Write([]*prompb.TimeSeries) (int, error)
+	WriteMetadata([]elasticsearch.MetricMetadata)
+	WriteExemplars([]elasticsearch.Exemplar)
 }
 
-func writeHandler(svc writeService) http.HandlerFunc {
+// remoteWrite is a decoded remote write request of either version
+type remoteWrite struct {
+	Series    []*prompb.TimeSeries
+	Metadata  []elasticsearch.MetricMetadata
+	Exemplars []elasticsearch.Exemplar
+}
+
+// writeHandler indexes remote write requests, decoding the exemplars of 1.0
+// requests only when exemplars is set as that takes a second pass
+func writeHandler(svc writeService, maxBodyBytes int64, exemplars bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
-		compressed, err := ioutil.ReadAll(r.Body)
+		version, err := writeVersion(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		compressed, err := readBody(w, r, maxBodyBytes)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			bodyError(w, err)
 			return
 		}
 
-		reqBuf, err := snappy.Decode(nil, compressed)
+		reqBuf, err := decodeBody(r, compressed)
+		if err == errUnsupportedEncoding {
+			writeError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("%s %q, expected snappy or zstd", err, r.Header.Get("Content-Encoding")))
+			return
+		}
+		if err == errDecodedTooLarge {
+			bodyError(w, err)
+			return
+		}
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, err.Error())
 			return
 		}
 
-		var req prompb.WriteRequest
-		if err := proto.Unmarshal(reqBuf, &req); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		req := &remoteWrite{}
+		v2 := isWriteV2(r, version)
+		if v2 {
+			req, err = decodeWriteV2(reqBuf)
+		} else {
+			var v1 prompb.WriteRequest
+			err = proto.Unmarshal(reqBuf, &v1)
+			req.Series = v1.Timeseries
+			if err == nil && exemplars {
+				req.Exemplars, err = decodeExemplarsV1(reqBuf)
+			}
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "unmarshalling write request: "+err.Error())
 			return
 		}
 
-		svc.Write(req.Timeseries)
+		// 5xx responses are retried by Prometheus, other 4xx are dropped
+		samples, err := svc.Write(req.Series)
 		if err != nil {
-			http.Error(w, "Error sending samples to remote storage", http.StatusInternalServerError)
+			status := http.StatusInternalServerError
+			switch err {
+			case elasticsearch.ErrUnavailable:
+				status = http.StatusServiceUnavailable
+			case elasticsearch.ErrQueueFull:
+				// retried by Prometheus 2.26+ with retry_on_http_429 enabled
+				status = http.StatusTooManyRequests
+			}
+			writeError(w, status, "Error sending samples to remote storage: "+err.Error())
+			return
+		}
+		svc.WriteMetadata(req.Metadata)
+		svc.WriteExemplars(req.Exemplars)
+		if v2 {
+			// remote write 2.0 senders account for data loss with the written
+			// counts, samples dropped by the write service are not written.
+			// Histograms are not supported yet.
+			written := 0
+			if exemplars {
+				written = len(req.Exemplars)
+			}
+			w.Header().Set("X-Prometheus-Remote-Write-Samples-Written", strconv.Itoa(samples))
+			w.Header().Set("X-Prometheus-Remote-Write-Histograms-Written", "0")
+			w.Header().Set("X-Prometheus-Remote-Write-Exemplars-Written", strconv.Itoa(written))
 		}
 	}
 }
@@ -47,38 +208,52 @@ type readService interface {
 	Read(context.Context, []*prompb.Query) ([]*prompb.QueryResult, error)
 }
 
-func readHandler(svc readService) http.HandlerFunc {
+// readHandler answers remote read requests, logging the reads failing in
+// Elasticsearch as errors and their queries at debug level
+func readHandler(svc readService, maxBodyBytes int64, logger *zap.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
-		compressed, err := ioutil.ReadAll(r.Body)
+		compressed, err := readBody(w, r, maxBodyBytes)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			bodyError(w, err)
 			return
 		}
 
-		reqBuf, err := snappy.Decode(nil, compressed)
+		reqBuf, err := decodeSnappy(compressed)
+		if err == errDecodedTooLarge {
+			bodyError(w, err)
+			return
+		}
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, err.Error())
 			return
 		}
 
 		var req prompb.ReadRequest
 		if err := proto.Unmarshal(reqBuf, &req); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, "unmarshalling read request: "+err.Error())
 			return
 		}
 
 		resp, err := svc.Read(r.Context(), req.Queries)
+		if err == elasticsearch.ErrReadBusy {
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		if _, ok := err.(*elasticsearch.InvalidMatcherError); ok {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
 		if err != nil {
-
-			fmt.Printf("Error executing query: %s", req.String())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("Error executing query", zap.Error(err))
+			logger.Debug("Failed query", zap.String("query", req.String()))
+			writeError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
 
 		data, err := proto.Marshal(&prompb.ReadResponse{Results: resp})
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
 
@@ -87,7 +262,7 @@ func readHandler(svc readService) http.HandlerFunc {
 
 		compressed = snappy.Encode(nil, data)
 		if _, err := w.Write(compressed); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
 	}
@@ -0,0 +1,352 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/pwillie/prometheus-es-adapter/pkg/elasticsearch"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// fakeReader is a readService answering every read with results or err,
+// recording the queries read
+type fakeReader struct {
+	results []*prompb.QueryResult
+	err     error
+	queries []*prompb.Query
+}
+
+func (f *fakeReader) Read(ctx context.Context, queries []*prompb.Query) ([]*prompb.QueryResult, error) {
+	f.queries = append(f.queries, queries...)
+	return f.results, f.err
+}
+
+// decodeError returns the JSON error body of rec, failing the test if it
+// is not one
+func decodeError(t *testing.T, rec *httptest.ResponseRecorder) errorResponse {
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("got Content-Type %q, want application/json", got)
+	}
+	var res errorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatalf("got invalid JSON error body: %s", err)
+	}
+	if res.Code != rec.Code {
+		t.Errorf("got code %d in the body of a %d", res.Code, rec.Code)
+	}
+	return res
+}
+
+func TestErrorResponses(t *testing.T) {
+	write := encode(t, &prompb.WriteRequest{})
+	read := encode(t, &prompb.ReadRequest{Queries: []*prompb.Query{{}}})
+	tests := []struct {
+		name    string
+		handler http.Handler
+		body    []byte
+		status  int
+		message string
+	}{
+		{
+			name:    "write not snappy",
+			handler: writeHandler(&fakeWriter{}, 0, false),
+			body:    []byte("not snappy"),
+			status:  http.StatusBadRequest,
+			message: "decoding snappy body",
+		},
+		{
+			name:    "write not protobuf",
+			handler: writeHandler(&fakeWriter{}, 0, false),
+			body:    encodeRaw([]byte{0xff, 0xff}),
+			status:  http.StatusBadRequest,
+			message: "unmarshalling write request",
+		},
+		{
+			name:    "write failing in Elasticsearch",
+			handler: writeHandler(&fakeWriter{err: errors.New("bulk processor closed")}, 0, false),
+			body:    write,
+			status:  http.StatusInternalServerError,
+			message: "Error sending samples to remote storage: bulk processor closed",
+		},
+		{
+			name:    "read not protobuf",
+			handler: readHandler(&fakeReader{}, 0, zap.NewNop()),
+			body:    encodeRaw([]byte{0xff, 0xff}),
+			status:  http.StatusBadRequest,
+			message: "unmarshalling read request",
+		},
+		{
+			name:    "read failing in Elasticsearch",
+			handler: readHandler(&fakeReader{err: errors.New("search_phase_execution_exception")}, 0, zap.NewNop()),
+			body:    read,
+			status:  http.StatusInternalServerError,
+			message: "search_phase_execution_exception",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			test.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(test.body)))
+			if rec.Code != test.status {
+				t.Fatalf("got status %d, want %d", rec.Code, test.status)
+			}
+			if res := decodeError(t, rec); !strings.Contains(res.Message, test.message) {
+				t.Errorf("got message %q, want it to contain %q", res.Message, test.message)
+			}
+		})
+	}
+}
+
+func TestReadErrorLogged(t *testing.T) {
+	tests := []struct {
+		name    string
+		level   zapcore.Level
+		entries int
+	}{
+		{"info", zap.InfoLevel, 1},
+		{"debug", zap.DebugLevel, 2},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		handler := readHandler(&fakeReader{err: errors.New("timeout")}, 0, bufferLogger(&buf, test.level))
+		query := &prompb.ReadRequest{Queries: []*prompb.Query{{StartTimestampMs: 1000}}}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/read", bytes.NewReader(encode(t, query))))
+
+		var entries []map[string]interface{}
+		dec := json.NewDecoder(&buf)
+		for dec.More() {
+			var entry map[string]interface{}
+			if err := dec.Decode(&entry); err != nil {
+				t.Fatalf("%s: got log %q, want JSON entries", test.name, buf.String())
+			}
+			entries = append(entries, entry)
+		}
+		if len(entries) != test.entries {
+			t.Fatalf("%s: got %d log entries, want %d", test.name, len(entries), test.entries)
+		}
+		if e := entries[0]; e["level"] != "error" || e["msg"] != "Error executing query" || e["error"] != "timeout" || e["query"] != nil {
+			t.Errorf("%s: got log entry %v", test.name, e)
+		}
+		if test.entries < 2 {
+			continue
+		}
+		if q, _ := entries[1]["query"].(string); entries[1]["level"] != "debug" || !strings.Contains(q, "start_timestamp_ms:1000") {
+			t.Errorf("%s: got log entry %v, want the failed query at debug", test.name, entries[1])
+		}
+	}
+}
+
+func TestBasicAuthErrorResponse(t *testing.T) {
+	handler := NewBasicAuthHandler("prometheus", "secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/write", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("got status %d, want 401", rec.Code)
+	}
+	if res := decodeError(t, rec); res.Message != "Unauthorized" {
+		t.Errorf("got message %q, want Unauthorized", res.Message)
+	}
+}
+
+func TestWriteMalformedBody(t *testing.T) {
+	series := &prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+	}}}
+	valid := encode(t, series)
+	raw, err := proto.Marshal(series)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		body    []byte
+		message string
+	}{
+		{"empty body", nil, "decoding snappy body: snappy: corrupt input"},
+		{"truncated snappy", valid[:len(valid)/2], "decoding snappy body: snappy: corrupt input"},
+		{"snappy declaring more bytes", append([]byte{0x7f}, valid[1:]...), "decoding snappy body: snappy: corrupt input"},
+		{"garbage protobuf", encodeRaw([]byte("garbage, not a write request")), "unmarshalling write request: "},
+		{"truncated protobuf", encodeRaw(raw[:len(raw)-3]), "unmarshalling write request: "},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writes := &fakeWriter{}
+			rec := httptest.NewRecorder()
+			writeHandler(writes, 0, false).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/write", bytes.NewReader(test.body)))
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("got status %d, want 400", rec.Code)
+			}
+			if res := decodeError(t, rec); !strings.HasPrefix(res.Message, test.message) {
+				t.Errorf("got message %q, want it to start with %q", res.Message, test.message)
+			}
+			if len(writes.series) != 0 {
+				t.Errorf("got %d series written from a malformed body", len(writes.series))
+			}
+		})
+	}
+}
+
+func TestWriteStatus(t *testing.T) {
+	write := encode(t, &prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+	}}})
+	tests := []struct {
+		name   string
+		body   []byte
+		err    error
+		status int
+	}{
+		{"stored", write, nil, http.StatusOK},
+		{"Elasticsearch unavailable", write, elasticsearch.ErrUnavailable, http.StatusServiceUnavailable},
+		{"queue full", write, elasticsearch.ErrQueueFull, http.StatusTooManyRequests},
+		{"other failure", write, errors.New("bulk processor closed"), http.StatusInternalServerError},
+		{"malformed while unavailable", []byte("not snappy"), elasticsearch.ErrUnavailable, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writes := &fakeWriter{err: test.err}
+			rec := httptest.NewRecorder()
+			writeHandler(writes, 0, false).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/write", bytes.NewReader(test.body)))
+			if rec.Code != test.status {
+				t.Fatalf("got status %d, want %d", rec.Code, test.status)
+			}
+			if test.status == http.StatusOK {
+				if rec.Body.Len() != 0 || len(writes.series) != 1 {
+					t.Errorf("got body %q and %d series written, want an empty 200 and the series", rec.Body, len(writes.series))
+				}
+				return
+			}
+			if res := decodeError(t, rec); test.err != nil && test.status != http.StatusBadRequest && !strings.HasSuffix(res.Message, test.err.Error()) {
+				t.Errorf("got message %q, want it to end with %q", res.Message, test.err)
+			}
+		})
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	write := encode(t, &prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+	}}})
+	read := encode(t, &prompb.ReadRequest{Queries: []*prompb.Query{{}}})
+	limit := int64(len(write))
+	if int64(len(read)) > limit {
+		t.Fatalf("got a read request of %d bytes, want it within the %d bytes limit", len(read), limit)
+	}
+	writes := writeHandler(&fakeWriter{}, limit, false)
+	reads := readHandler(&fakeReader{}, limit, zap.NewNop())
+	tests := []struct {
+		name    string
+		handler http.Handler
+		body    []byte
+		status  int
+	}{
+		{"write at the limit", writes, write, http.StatusOK},
+		{"write over the limit", writes, append(write, 0), http.StatusRequestEntityTooLarge},
+		{"read within the limit", reads, read, http.StatusOK},
+		{"read over the limit", reads, bytes.Repeat([]byte{0}, int(limit)+1), http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			test.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(test.body)))
+			if rec.Code != test.status {
+				t.Fatalf("got status %d, want %d", rec.Code, test.status)
+			}
+			if test.status == http.StatusRequestEntityTooLarge {
+				if res := decodeError(t, rec); res.Message != "request body too large" {
+					t.Errorf("got message %q, want request body too large", res.Message)
+				}
+			}
+		})
+	}
+	// without a limit the same oversized body reaches the decoder
+	rec := httptest.NewRecorder()
+	writeHandler(&fakeWriter{}, 0, false).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(append(write, 0))))
+	if rec.Code == http.StatusRequestEntityTooLarge {
+		t.Errorf("got 413 without a limit")
+	}
+}
+
+// zstdBomb and zstdWindowBomb are zstd frames declaring 2GiB of content,
+// the latter as a single segment whose window is that size
+var (
+	zstdBomb       = []byte{0x28, 0xb5, 0x2f, 0xfd, 0xc0, 0x00, 0, 0, 0, 0x80, 0, 0, 0, 0, 0x01, 0, 0}
+	zstdWindowBomb = []byte{0x28, 0xb5, 0x2f, 0xfd, 0xe0, 0, 0, 0, 0x80, 0, 0, 0, 0, 0x01, 0, 0}
+)
+
+func TestWriteContentEncoding(t *testing.T) {
+	raw, err := proto.Marshal(&prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zstdBody := enc.EncodeAll(raw, nil)
+	enc.Close()
+	// a snappy length varint of 2GiB and no data
+	snappyBomb := []byte{0x80, 0x80, 0x80, 0x80, 0x08}
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		limit    int64
+		status   int
+		message  string
+	}{
+		{"snappy by default", "", encodeRaw(raw), 0, http.StatusOK, ""},
+		{"snappy", "snappy", encodeRaw(raw), 0, http.StatusOK, ""},
+		{"zstd", "zstd", zstdBody, 0, http.StatusOK, ""},
+		{"zstd any case", " ZSTD ", zstdBody, 0, http.StatusOK, ""},
+		{"zstd corrupt", "zstd", zstdBody[:len(zstdBody)-4], 0, http.StatusBadRequest, "decoding zstd body: "},
+		{"zstd sent as snappy", "snappy", zstdBody, 0, http.StatusBadRequest, "decoding snappy body: "},
+		{"gzip", "gzip", encodeRaw(raw), 0, http.StatusUnsupportedMediaType, `unsupported Content-Encoding "gzip", expected snappy or zstd`},
+		{"identity", "identity", raw, 0, http.StatusUnsupportedMediaType, `unsupported Content-Encoding "identity", expected snappy or zstd`},
+		{"zstd over the body limit", "zstd", zstdBody, int64(len(zstdBody)) - 1, http.StatusRequestEntityTooLarge, "request body too large"},
+		{"zstd decoding too large", "zstd", zstdBomb, 0, http.StatusRequestEntityTooLarge, "decoded request body too large"},
+		{"zstd window too large", "zstd", zstdWindowBomb, 0, http.StatusRequestEntityTooLarge, "decoded request body too large"},
+		{"snappy decoding too large", "snappy", snappyBomb, 0, http.StatusRequestEntityTooLarge, "decoded request body too large"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writes := &fakeWriter{}
+			req := httptest.NewRequest(http.MethodPost, "/write", bytes.NewReader(test.body))
+			if test.encoding != "" {
+				req.Header.Set("Content-Encoding", test.encoding)
+			}
+			rec := httptest.NewRecorder()
+			writeHandler(writes, test.limit, false).ServeHTTP(rec, req)
+			if rec.Code != test.status {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, test.status, rec.Body)
+			}
+			if test.status == http.StatusOK {
+				if len(writes.series) != 1 || writes.series[0].Labels[0].Value != "up" {
+					t.Errorf("got series %v, want the decoded up series", writes.series)
+				}
+				return
+			}
+			if res := decodeError(t, rec); !strings.HasPrefix(res.Message, test.message) {
+				t.Errorf("got message %q, want it to start with %q", res.Message, test.message)
+			}
+		})
+	}
+}
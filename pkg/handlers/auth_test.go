@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouterBasicAuth(t *testing.T) {
+	router := NewRouter(nil, nil, &RouterConfig{AuthUser: "prometheus", AuthPassword: "secret"})
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		auth     bool
+		status   int
+	}{
+		{"missing", "", "", false, http.StatusUnauthorized},
+		{"wrong password", "prometheus", "wrong", true, http.StatusUnauthorized},
+		{"longer password", "prometheus", "secret-and-more", true, http.StatusUnauthorized},
+		{"wrong user", "grafana", "secret", true, http.StatusUnauthorized},
+		{"empty password", "prometheus", "", true, http.StatusUnauthorized},
+		// the handler is reached and rejects the body
+		{"correct", "prometheus", "secret", true, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, path := range []string{"/write", "/read"} {
+				req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader([]byte("not snappy")))
+				if test.auth {
+					req.SetBasicAuth(test.user, test.password)
+				}
+				rec := httptest.NewRecorder()
+				router.ServeHTTP(rec, req)
+				if rec.Code != test.status {
+					t.Fatalf("got %s status %d, want %d", path, rec.Code, test.status)
+				}
+				challenge := rec.Header().Get("WWW-Authenticate")
+				if test.status == http.StatusUnauthorized && challenge != `Basic realm="prometheus-es-adapter"` {
+					t.Errorf("got %s WWW-Authenticate %q, want a basic auth challenge", path, challenge)
+				}
+				if test.status != http.StatusUnauthorized && challenge != "" {
+					t.Errorf("got %s WWW-Authenticate %q once authenticated", path, challenge)
+				}
+			}
+		})
+	}
+}
+
+func TestRouterWithoutAuth(t *testing.T) {
+	router := NewRouter(nil, nil, &RouterConfig{})
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/write", bytes.NewReader([]byte("not snappy"))))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d without auth configured, want the handler's 400", rec.Code)
+	}
+}
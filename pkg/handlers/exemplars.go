@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/pwillie/prometheus-es-adapter/pkg/elasticsearch"
+)
+
+// The vendored prompb predates exemplars, the messages below declare the
+// remote write 1.0 fields holding them so they can be unmarshalled from the
+// same request in a second pass.
+
+type exemplarsV1Request struct {
+	Timeseries []exemplarsV1Series `protobuf:"bytes,1,rep,name=timeseries"`
+}
+
+func (m *exemplarsV1Request) Reset()         { *m = exemplarsV1Request{} }
+func (m *exemplarsV1Request) String() string { return proto.CompactTextString(m) }
+func (*exemplarsV1Request) ProtoMessage()    {}
+
+type exemplarsV1Series struct {
+	Labels    []*prompb.Label `protobuf:"bytes,1,rep,name=labels"`
+	Exemplars []exemplarV1    `protobuf:"bytes,3,rep,name=exemplars"`
+}
+
+func (m *exemplarsV1Series) Reset()         { *m = exemplarsV1Series{} }
+func (m *exemplarsV1Series) String() string { return proto.CompactTextString(m) }
+func (*exemplarsV1Series) ProtoMessage()    {}
+
+type exemplarV1 struct {
+	Labels    []*prompb.Label `protobuf:"bytes,1,rep,name=labels"`
+	Value     float64         `protobuf:"fixed64,2,opt,name=value"`
+	Timestamp int64           `protobuf:"varint,3,opt,name=timestamp"`
+}
+
+func (m *exemplarV1) Reset()         { *m = exemplarV1{} }
+func (m *exemplarV1) String() string { return proto.CompactTextString(m) }
+func (*exemplarV1) ProtoMessage()    {}
+
+// decodeExemplarsV1 unmarshals the exemplars of a remote write 1.0 request
+func decodeExemplarsV1(buf []byte) ([]elasticsearch.Exemplar, error) {
+	var req exemplarsV1Request
+	if err := proto.Unmarshal(buf, &req); err != nil {
+		return nil, err
+	}
+	var exemplars []elasticsearch.Exemplar
+	for _, s := range req.Timeseries {
+		if len(s.Exemplars) == 0 {
+			continue
+		}
+		series := toMetric(s.Labels)
+		for _, e := range s.Exemplars {
+			exemplars = append(exemplars, elasticsearch.Exemplar{
+				Series:    series,
+				Labels:    toMetric(e.Labels),
+				Value:     e.Value,
+				Timestamp: e.Timestamp,
+			})
+		}
+	}
+	return exemplars, nil
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/pwillie/prometheus-es-adapter/pkg/elasticsearch"
+)
+
+func TestWriteExemplarsV1(t *testing.T) {
+	labels := []*prompb.Label{{Name: "__name__", Value: "http_request_duration_seconds_bucket"}, {Name: "le", Value: "0.5"}}
+	series, err := proto.Marshal(&prompb.TimeSeries{
+		Labels:  labels,
+		Samples: []prompb.Sample{{Value: 3, Timestamp: 1000}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exemplar, err := proto.Marshal(&exemplarV1{
+		Labels:    []*prompb.Label{{Name: "trace_id", Value: "abc123"}},
+		Value:     0.42,
+		Timestamp: 990,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the vendored prompb.TimeSeries has no exemplars, field 3 is appended
+	body := message(1, append(series, message(3, exemplar)...))
+
+	tests := []struct {
+		name      string
+		exemplars bool
+		want      []elasticsearch.Exemplar
+	}{
+		{"decoded", true, []elasticsearch.Exemplar{{
+			Series:    model.Metric{"__name__": "http_request_duration_seconds_bucket", "le": "0.5"},
+			Labels:    model.Metric{"trace_id": "abc123"},
+			Value:     0.42,
+			Timestamp: 990,
+		}}},
+		{"disabled", false, nil},
+	}
+	for _, test := range tests {
+		fw := &fakeWriter{}
+		rec := httptest.NewRecorder()
+		writeHandler(fw, 0, test.exemplars).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/write", bytes.NewReader(encodeRaw(body))))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d: %s", test.name, rec.Code, rec.Body)
+		}
+		if len(fw.series) != 1 || !reflect.DeepEqual(fw.series[0].Samples, []prompb.Sample{{Value: 3, Timestamp: 1000}}) {
+			t.Errorf("%s: got series %v, want the sample alongside the exemplar", test.name, fw.series)
+		}
+		if !reflect.DeepEqual(fw.exemplars, test.want) {
+			t.Errorf("%s: got exemplars %+v, want %+v", test.name, fw.exemplars, test.want)
+		}
+	}
+}
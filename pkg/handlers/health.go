@@ -1,19 +1,39 @@
 package handlers
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/heptiolabs/healthcheck"
 	elastic "gopkg.in/olivere/elastic.v6"
 )
 
-func healthzHandler(client *elastic.Client) http.Handler {
+func healthzHandler(client *elastic.Client, alias string) healthcheck.Handler {
 	health := healthcheck.NewHandler()
 	health.AddReadinessCheck("elasticsearch", esCheck(client))
+	if alias != "" {
+		health.AddReadinessCheck("alias", aliasCheck(client, alias))
+	}
 	return health
 }
 
+// verboseReadyHandler serves the readiness checks, always including the
+// per-check results in the JSON body
+func verboseReadyHandler(health healthcheck.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		q.Set("full", "1")
+		u := *r.URL
+		u.RawQuery = q.Encode()
+		req := r.WithContext(r.Context())
+		req.URL = &u
+		health.ReadyEndpoint(w, req)
+	}
+}
+
 func esCheck(client *elastic.Client) healthcheck.Check {
 	return func() error {
 		if client == nil {
@@ -27,3 +47,21 @@ func esCheck(client *elastic.Client) healthcheck.Check {
 		return nil
 	}
 }
+
+func aliasCheck(client *elastic.Client, alias string) healthcheck.Check {
+	return func() error {
+		if client == nil {
+			return errors.New("Elasticsearch client is nil")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		exists, err := client.IndexExists(alias).Do(ctx)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("alias %s does not exist", alias)
+		}
+		return nil
+	}
+}
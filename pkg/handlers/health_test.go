@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// healthServer is an Elasticsearch whose cluster health times out unless
+// green and whose alias exists when alias is set
+type healthServer struct {
+	green bool
+	alias bool
+}
+
+func (s *healthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/_cluster/health"):
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "red", "timed_out": !s.green})
+	case r.URL.Path == "/prom-metrics" && s.alias:
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestHealthzChecksAlias(t *testing.T) {
+	tests := []struct {
+		name   string
+		es     *healthServer
+		status int
+		checks map[string]string
+	}{
+		{"ready", &healthServer{green: true, alias: true}, http.StatusOK, map[string]string{
+			"elasticsearch": "OK",
+			"alias":         "OK",
+		}},
+		{"missing alias", &healthServer{green: true}, http.StatusServiceUnavailable, map[string]string{
+			"elasticsearch": "OK",
+			"alias":         "alias prom-metrics does not exist",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, srv := newTestClient(t, test.es)
+			defer srv.Close()
+			rec := httptest.NewRecorder()
+			verboseReadyHandler(healthzHandler(client, "prom-metrics")).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			if rec.Code != test.status {
+				t.Errorf("got status %d, want %d", rec.Code, test.status)
+			}
+			var checks map[string]string
+			if err := json.NewDecoder(rec.Body).Decode(&checks); err != nil {
+				t.Fatalf("got invalid JSON body: %s", err)
+			}
+			for name, want := range test.checks {
+				if checks[name] != want {
+					t.Errorf("got %s check %q, want %q", name, checks[name], want)
+				}
+			}
+		})
+	}
+}
+
+func TestHealthzUnavailable(t *testing.T) {
+	client, srv := newTestClient(t, &healthServer{alias: true})
+	defer srv.Close()
+	rec := httptest.NewRecorder()
+	verboseReadyHandler(healthzHandler(client, "prom-metrics")).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want 503", rec.Code)
+	}
+	var checks map[string]string
+	if err := json.NewDecoder(rec.Body).Decode(&checks); err != nil {
+		t.Fatalf("got invalid JSON body: %s", err)
+	}
+	if checks["elasticsearch"] == "OK" || checks["elasticsearch"] == "" {
+		t.Errorf("got elasticsearch check %q, want the cluster health failure", checks["elasticsearch"])
+	}
+}
+
+func TestHealthzWithoutAlias(t *testing.T) {
+	client, srv := newTestClient(t, &healthServer{green: true})
+	defer srv.Close()
+	rec := httptest.NewRecorder()
+	// daily indexes have no alias to check
+	verboseReadyHandler(healthzHandler(client, "")).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("got status %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if strings.Contains(rec.Body.String(), "alias") {
+		t.Errorf("got body %s, want no alias check", rec.Body)
+	}
+}
+
+func TestLivenessSkipsElasticsearch(t *testing.T) {
+	var requests int
+	client, srv := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	router := NewAdminRouter(client, &AdminConfig{Alias: "prom-metrics"})
+	for _, path := range []string{"/-/healthy", "/live"} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("got %s status %d during an Elasticsearch outage, want 200", path, rec.Code)
+		}
+	}
+	if requests != 0 {
+		t.Errorf("got %d Elasticsearch requests, want none from liveness", requests)
+	}
+	// readiness does fail
+	if got := serve(router, "/ready", "", ""); got != http.StatusServiceUnavailable {
+		t.Errorf("got /ready status %d, want 503", got)
+	}
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pwillie/prometheus-es-adapter/pkg/elasticsearch"
+)
+
+func TestActiveIndex(t *testing.T) {
+	tests := []struct {
+		name    string
+		aliases string
+		status  int
+		want    elasticsearch.IndexInfo
+	}{
+		{
+			name:    "single index",
+			aliases: `{"prom-metrics-000001":{"aliases":{"prom-metrics":{}}}}`,
+			status:  http.StatusOK,
+			want:    elasticsearch.IndexInfo{Index: "prom-metrics-000001", Docs: 1000, SizeBytes: 8192},
+		},
+		{
+			name: "rolled over",
+			aliases: `{"prom-metrics-000001":{"aliases":{"prom-metrics":{"is_write_index":false}}},` +
+				`"prom-metrics-000002":{"aliases":{"prom-metrics":{"is_write_index":true}}}}`,
+			status: http.StatusOK,
+			want:   elasticsearch.IndexInfo{Index: "prom-metrics-000002", Docs: 10, SizeBytes: 1024},
+		},
+		{
+			name: "no write index",
+			aliases: `{"prom-metrics-000001":{"aliases":{"prom-metrics":{}}},` +
+				`"prom-metrics-000002":{"aliases":{"prom-metrics":{}}}}`,
+			status: http.StatusInternalServerError,
+		},
+	}
+	for _, test := range tests {
+		client, srv := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch {
+			case strings.HasSuffix(r.URL.Path, "/_alias"):
+				w.Write([]byte(test.aliases))
+			case r.URL.Path == "/prom-metrics-000001/_stats/docs,store":
+				w.Write([]byte(`{"indices":{"prom-metrics-000001":{"primaries":{"docs":{"count":1000}},"total":{"store":{"size_in_bytes":8192}}}}}`))
+			case r.URL.Path == "/prom-metrics-000002/_stats/docs,store":
+				w.Write([]byte(`{"indices":{"prom-metrics-000002":{"primaries":{"docs":{"count":10}},"total":{"store":{"size_in_bytes":1024}}}}}`))
+			default:
+				t.Errorf("%s: unexpected request to %s", test.name, r.URL.Path)
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		router := NewAdminRouter(client, &AdminConfig{Alias: "prom-metrics"})
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/active-index", nil))
+		srv.Close()
+
+		if rec.Code != test.status {
+			t.Errorf("%s: got status %d, want %d: %s", test.name, rec.Code, test.status, rec.Body)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		var got elasticsearch.IndexInfo
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
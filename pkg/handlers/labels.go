@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+type labelService interface {
+	LabelNames(ctx context.Context, start, end int64) ([]string, error)
+	LabelValues(ctx context.Context, name string, start, end int64) ([]string, error)
+}
+
+// apiResponse is the envelope of Prometheus HTTP API responses
+type apiResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+func writeAPIResponse(w http.ResponseWriter, status int, res apiResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, errorType string, err error) {
+	writeAPIResponse(w, status, apiResponse{Status: "error", ErrorType: errorType, Error: err.Error()})
+}
+
+// parseTime parses a Prometheus API timestamp, RFC3339 or unix seconds, into
+// ms, returning def when s is empty
+func parseTime(s string, def int64) (int64, error) {
+	if s == "" {
+		return def, nil
+	}
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		return int64(math.Round(t * 1000)), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.UnixNano() / int64(time.Millisecond), nil
+	}
+	return 0, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+// parseRange returns the start and end params in ms, defaulting to all time
+// up to now
+func parseRange(r *http.Request) (int64, int64, error) {
+	start, err := parseTime(r.FormValue("start"), 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parseTime(r.FormValue("end"), time.Now().UnixNano()/int64(time.Millisecond))
+	if err != nil {
+		return 0, 0, err
+	}
+	if end < start {
+		return 0, 0, fmt.Errorf("end timestamp must not be before start time")
+	}
+	return start, end, nil
+}
+
+// labelNamesHandler answers /api/v1/labels like the Prometheus HTTP API
+func labelNamesHandler(svc labelService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start, end, err := parseRange(r)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_data", err)
+			return
+		}
+		names, err := svc.LabelNames(r.Context(), start, end)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "execution", err)
+			return
+		}
+		writeAPIResponse(w, http.StatusOK, apiResponse{Status: "success", Data: names})
+	}
+}
+
+// labelValuesHandler answers /api/v1/label/<name>/values like the Prometheus
+// HTTP API
+func labelValuesHandler(svc labelService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/api/v1/label/")
+		if !strings.HasSuffix(name, "/values") {
+			http.NotFound(w, r)
+			return
+		}
+		name = strings.TrimSuffix(name, "/values")
+		if !model.LabelName(name).IsValid() {
+			writeAPIError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("invalid label name: %q", name))
+			return
+		}
+		start, end, err := parseRange(r)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_data", err)
+			return
+		}
+		values, err := svc.LabelValues(r.Context(), name, start, end)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "execution", err)
+			return
+		}
+		writeAPIResponse(w, http.StatusOK, apiResponse{Status: "success", Data: values})
+	}
+}
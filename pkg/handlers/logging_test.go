@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// bufferLogger returns a logger writing JSON entries of level or above to buf
+func bufferLogger(buf *bytes.Buffer, level zapcore.Level) *zap.Logger {
+	return zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(buf), level))
+}
+
+func TestLoggingHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		status  float64
+		bytes   float64
+	}{
+		{"explicit status", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte("slow down"))
+		}, 429, 9},
+		{"implicit status", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}, 200, 2},
+		{"no body", func(w http.ResponseWriter, r *http.Request) {}, 200, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			h := NewLoggingHandler(bufferLogger(&buf, zap.DebugLevel), test.handler)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/write", strings.NewReader("secret-payload")))
+			if rec.Code != int(test.status) {
+				t.Errorf("got status %d passed through, want %g", rec.Code, test.status)
+			}
+
+			var entry map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+				t.Fatalf("got log %q, want one JSON entry", buf.String())
+			}
+			want := map[string]interface{}{
+				"level":          "debug",
+				"msg":            "Handled request",
+				"method":         "POST",
+				"path":           "/write",
+				"status":         test.status,
+				"request_bytes":  float64(len("secret-payload")),
+				"response_bytes": test.bytes,
+			}
+			for key, value := range want {
+				if entry[key] != value {
+					t.Errorf("got %s %v, want %v", key, entry[key], value)
+				}
+			}
+			if _, ok := entry["duration"]; !ok {
+				t.Error("got no duration")
+			}
+			if strings.Contains(buf.String(), "secret-payload") {
+				t.Error("the request body was logged")
+			}
+		})
+	}
+}
+
+func TestLoggingHandlerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	h := NewLoggingHandler(bufferLogger(&buf, zap.InfoLevel), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/read", nil))
+	if buf.Len() != 0 {
+		t.Errorf("got %q logged above debug level", buf.String())
+	}
+}
@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// writeDuration is registered by the router when RouterConfig.Stats is set
+var writeDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "es_adapter",
+		Name:      "write_request_duration_seconds",
+		Help:      "Latency of remote write requests from decoding to queueing the samples",
+		Buckets:   []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	},
+	[]string{"code"},
+)
+
+// registerWriteDuration registers writeDuration once however many routers
+// are built with stats
+func registerWriteDuration() {
+	if err := prometheus.Register(writeDuration); err != nil {
+		if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+			panic(err)
+		}
+	}
+}
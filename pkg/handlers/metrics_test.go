@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scrape returns the status and body of a GET /metrics on h
+func scrape(t *testing.T, h http.Handler) (int, string) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	b, err := ioutil.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, string(b)
+}
+
+func TestAdminMetrics(t *testing.T) {
+	samples := prometheus.NewCounter(prometheus.CounterOpts{Name: "es_adapter_test_samples_total", Help: "Test counter"})
+	prometheus.MustRegister(samples)
+	defer prometheus.Unregister(samples)
+	samples.Add(3)
+
+	status, body := scrape(t, NewAdminRouter(nil, &AdminConfig{Metrics: true}))
+	if status != http.StatusOK {
+		t.Fatalf("got /metrics status %d with stats enabled, want 200", status)
+	}
+	if !strings.Contains(body, "es_adapter_test_samples_total 3") {
+		t.Errorf("got /metrics without the registered collector:\n%s", body)
+	}
+	if status, body = scrape(t, NewAdminRouter(nil, &AdminConfig{})); status != http.StatusNotFound {
+		t.Errorf("got /metrics status %d with stats disabled, want 404", status)
+	}
+	if strings.Contains(body, "es_adapter_test_samples_total") {
+		t.Errorf("got metrics served with stats disabled:\n%s", body)
+	}
+}
+
+func TestRouterMetricsStaysOffWebPort(t *testing.T) {
+	router := NewRouter(nil, nil, &RouterConfig{Stats: true})
+	defer prometheus.Unregister(writeDuration)
+	// as when the single port and web routers are both built
+	NewSinglePortRouter(nil, nil, &RouterConfig{Stats: true}, nil, &AdminConfig{})
+	if status, _ := scrape(t, router); status != http.StatusNotFound {
+		t.Errorf("got /metrics status %d on the web router, want 404", status)
+	}
+
+	// other tests write through the same histogram
+	writeDuration.Reset()
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/write", bytes.NewReader([]byte("not snappy"))))
+	_, body := scrape(t, NewAdminRouter(nil, &AdminConfig{Metrics: true}))
+	if !strings.Contains(body, `es_adapter_write_request_duration_seconds_count{code="400"} 1`) {
+		t.Errorf("got admin /metrics without the write latency registered by stats:\n%s", body)
+	}
+}
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPprofRoutes(t *testing.T) {
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/debug/pprof/", http.StatusOK, "goroutine"},
+		{"/debug/pprof/goroutine?debug=1", http.StatusOK, "goroutine profile"},
+		{"/debug/pprof/cmdline", http.StatusOK, ""},
+		{"/debug/pprof/symbol", http.StatusOK, "num_symbols"},
+	}
+	enabled := NewAdminRouter(nil, &AdminConfig{Pprof: true})
+	disabled := NewAdminRouter(nil, &AdminConfig{})
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		enabled.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, test.path, nil))
+		if rec.Code != test.status || !strings.Contains(rec.Body.String(), test.body) {
+			t.Errorf("got %s status %d, want %d with %q", test.path, rec.Code, test.status, test.body)
+		}
+		rec = httptest.NewRecorder()
+		disabled.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, test.path, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("got %s status %d with pprof disabled, want 404", test.path, rec.Code)
+		}
+	}
+}
+
+func TestPprofAdminAuth(t *testing.T) {
+	router := NewAdminRouter(nil, &AdminConfig{Pprof: true, AuthUser: "admin", AuthPassword: "secret"})
+	if got := serve(router, "/debug/pprof/", "", ""); got != http.StatusUnauthorized {
+		t.Errorf("got status %d without credentials, want 401", got)
+	}
+	if got := serve(router, "/debug/pprof/", "admin", "secret"); got != http.StatusOK {
+		t.Errorf("got status %d with credentials, want 200", got)
+	}
+}
@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/pwillie/prometheus-es-adapter/pkg/elasticsearch"
+)
+
+// lookbackDelta is how far back a selector finds the latest sample of a
+// series at each evaluation time, as in Prometheus
+const lookbackDelta = 5 * time.Minute
+
+// maxQueryPoints caps the evaluation times of a range query, as in Prometheus
+const maxQueryPoints = 11000
+
+// queryData is the data of a successful query API response
+type queryData struct {
+	ResultType model.ValueType `json:"resultType"`
+	Result     model.Value     `json:"result"`
+}
+
+// parseDuration parses a Prometheus API duration, such as 15s or 15
+// seconds, into ms
+func parseDuration(s string) (int64, error) {
+	if d, err := strconv.ParseFloat(s, 64); err == nil {
+		return int64(math.Round(d * 1000)), nil
+	}
+	if d, err := model.ParseDuration(s); err == nil {
+		return int64(time.Duration(d) / time.Millisecond), nil
+	}
+	return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+}
+
+// selectSeries reads the series matching matchers with samples between start
+// minus the lookback delta and end, in ms
+func selectSeries(svc readService, r *http.Request, matchers []*prompb.LabelMatcher, start, end int64) ([]*prompb.TimeSeries, error) {
+	res, err := svc.Read(r.Context(), []*prompb.Query{{
+		StartTimestampMs: start - int64(lookbackDelta/time.Millisecond),
+		EndTimestampMs:   end,
+		Matchers:         matchers,
+	}})
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, nil
+	}
+	return res[0].Timeseries, nil
+}
+
+// sampleAt returns the latest of the time ordered samples at or before t in
+// ms and within the lookback delta, starting the search at i.  The index of
+// the sample is returned so successive calls with increasing t are linear.
+func sampleAt(samples []prompb.Sample, i int, t int64) (prompb.Sample, int, bool) {
+	for i+1 < len(samples) && samples[i+1].Timestamp <= t {
+		i++
+	}
+	if i >= len(samples) || samples[i].Timestamp > t || t-samples[i].Timestamp > int64(lookbackDelta/time.Millisecond) {
+		return prompb.Sample{}, i, false
+	}
+	return samples[i], i, true
+}
+
+func toMetric(labels []*prompb.Label) model.Metric {
+	m := make(model.Metric, len(labels))
+	for _, l := range labels {
+		m[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+	}
+	return m
+}
+
+// queryError answers a query API request which failed searching
+func queryError(w http.ResponseWriter, err error) {
+	if _, ok := err.(*elasticsearch.InvalidMatcherError); ok {
+		writeAPIError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	switch err {
+	case elasticsearch.ErrReadBusy:
+		writeAPIError(w, http.StatusServiceUnavailable, "unavailable", err)
+	default:
+		writeAPIError(w, http.StatusInternalServerError, "execution", err)
+	}
+}
+
+// queryRangeHandler answers /api/v1/query_range for selector queries,
+// evaluating them at each step like Prometheus does
+func queryRangeHandler(svc readService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start, err := parseTime(r.FormValue("start"), 0)
+		if err == nil && r.FormValue("start") == "" {
+			err = errors.New("start is required")
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_data", err)
+			return
+		}
+		end, err := parseTime(r.FormValue("end"), 0)
+		if err == nil && r.FormValue("end") == "" {
+			err = errors.New("end is required")
+		}
+		if err == nil && end < start {
+			err = errors.New("end timestamp must not be before start time")
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_data", err)
+			return
+		}
+		step, err := parseDuration(r.FormValue("step"))
+		if err == nil && step <= 0 {
+			err = errors.New("zero or negative query resolution step widths are not accepted")
+		}
+		if err == nil && (end-start)/step >= maxQueryPoints {
+			err = fmt.Errorf("exceeded maximum resolution of %d points per timeseries", maxQueryPoints)
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_data", err)
+			return
+		}
+		matchers, err := parseSelector(r.FormValue("query"))
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_data", err)
+			return
+		}
+		series, err := selectSeries(svc, r, matchers, start, end)
+		if err != nil {
+			queryError(w, err)
+			return
+		}
+		matrix := model.Matrix{}
+		for _, ts := range series {
+			stream := &model.SampleStream{Metric: toMetric(ts.Labels)}
+			i := 0
+			for t := start; t <= end; t += step {
+				var s prompb.Sample
+				var ok bool
+				if s, i, ok = sampleAt(ts.Samples, i, t); ok {
+					stream.Values = append(stream.Values, model.SamplePair{
+						Timestamp: model.Time(t),
+						Value:     model.SampleValue(s.Value),
+					})
+				}
+			}
+			if len(stream.Values) > 0 {
+				matrix = append(matrix, stream)
+			}
+		}
+		writeAPIResponse(w, http.StatusOK, apiResponse{Status: "success", Data: queryData{ResultType: model.ValMatrix, Result: matrix}})
+	}
+}
+
+// queryHandler answers /api/v1/query for selector queries evaluated at the
+// time param, defaulting to now
+func queryHandler(svc readService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, err := parseTime(r.FormValue("time"), time.Now().UnixNano()/int64(time.Millisecond))
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_data", err)
+			return
+		}
+		matchers, err := parseSelector(r.FormValue("query"))
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_data", err)
+			return
+		}
+		series, err := selectSeries(svc, r, matchers, t, t)
+		if err != nil {
+			queryError(w, err)
+			return
+		}
+		vector := model.Vector{}
+		for _, ts := range series {
+			if s, _, ok := sampleAt(ts.Samples, 0, t); ok {
+				vector = append(vector, &model.Sample{
+					Metric:    toMetric(ts.Labels),
+					Timestamp: model.Time(t),
+					Value:     model.SampleValue(s.Value),
+				})
+			}
+		}
+		writeAPIResponse(w, http.StatusOK, apiResponse{Status: "success", Data: queryData{ResultType: model.ValVector, Result: vector}})
+	}
+}
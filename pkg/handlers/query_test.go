@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/pwillie/prometheus-es-adapter/pkg/elasticsearch"
+)
+
+func TestQueryRange(t *testing.T) {
+	reader := &fakeReader{results: []*prompb.QueryResult{{Timeseries: []*prompb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "node"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 0}, {Value: 2, Timestamp: 30000}, {Value: 3, Timestamp: 400000}},
+	}}}}}
+	rec := httptest.NewRecorder()
+	queryRangeHandler(reader).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, `/api/v1/query_range?query=up{job="node"}&start=60&end=420&step=60`, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	var res struct {
+		Status string
+		Data   struct {
+			ResultType string
+			Result     []struct {
+				Metric map[string]string
+				Values [][]interface{}
+			}
+		}
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != "success" || res.Data.ResultType != "matrix" || len(res.Data.Result) != 1 {
+		t.Fatalf("got response %+v, want a matrix of one series", res)
+	}
+	if want := map[string]string{"__name__": "up", "job": "node"}; !reflect.DeepEqual(res.Data.Result[0].Metric, want) {
+		t.Errorf("got metric %v, want %v", res.Data.Result[0].Metric, want)
+	}
+	// each step takes the latest sample within the lookback delta, none is
+	// left at 360s
+	want := [][]interface{}{{60.0, "2"}, {120.0, "2"}, {180.0, "2"}, {240.0, "2"}, {300.0, "2"}, {420.0, "3"}}
+	if !reflect.DeepEqual(res.Data.Result[0].Values, want) {
+		t.Errorf("got values %v, want %v", res.Data.Result[0].Values, want)
+	}
+
+	if len(reader.queries) != 1 {
+		t.Fatalf("got %d queries read, want 1", len(reader.queries))
+	}
+	q := reader.queries[0]
+	if q.StartTimestampMs != 60000-300000 || q.EndTimestampMs != 420000 {
+		t.Errorf("got range %d to %d, want the lookback delta before the start to the end", q.StartTimestampMs, q.EndTimestampMs)
+	}
+	matchers := map[string]string{}
+	for _, m := range q.Matchers {
+		if m.Type != prompb.LabelMatcher_EQ {
+			t.Errorf("got matcher %v, want equality", m)
+		}
+		matchers[m.Name] = m.Value
+	}
+	if want := map[string]string{"__name__": "up", "job": "node"}; !reflect.DeepEqual(matchers, want) {
+		t.Errorf("got matchers %v, want %v", matchers, want)
+	}
+}
+
+func TestQueryRangeErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		err    error
+		status int
+	}{
+		{"missing start", "query=up&end=60&step=15", nil, http.StatusBadRequest},
+		{"end before start", "query=up&start=60&end=0&step=15", nil, http.StatusBadRequest},
+		{"zero step", "query=up&start=0&end=60&step=0", nil, http.StatusBadRequest},
+		{"too many points", "query=up&start=0&end=86400&step=1", nil, http.StatusBadRequest},
+		{"functions", "query=rate(up[5m])&start=0&end=60&step=15", nil, http.StatusBadRequest},
+		{"busy", "query=up&start=0&end=60&step=15", elasticsearch.ErrReadBusy, http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		queryRangeHandler(&fakeReader{err: test.err}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query_range?"+test.query, nil))
+		if rec.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, rec.Code, test.status)
+		}
+	}
+}
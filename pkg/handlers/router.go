@@ -2,25 +2,160 @@ package handlers
 
 import (
 	"net/http"
+	"net/http/pprof"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/pwillie/prometheus-es-adapter/pkg/elasticsearch"
+	"github.com/pwillie/prometheus-es-adapter/pkg/tracing"
+	"go.uber.org/zap"
 	"gopkg.in/olivere/elastic.v6"
 )
 
+// RouterConfig configures the remote read and write router
+type RouterConfig struct {
+	// MaxBodyBytes rejects larger compressed request bodies with 413, 0 for
+	// no limit
+	MaxBodyBytes int64
+	// AuthUser and AuthPassword are required as basic auth when AuthUser is set
+	AuthUser     string
+	AuthPassword string
+	// Exemplars decodes the exemplars of remote write requests to store them
+	Exemplars bool
+	// Stats registers the remote write latency histogram
+	Stats bool
+	// Tracer records a span per remote read and write request, nil for none
+	Tracer *tracing.Tracer
+	// Logger logs the remote reads failing in Elasticsearch, nil for none
+	Logger *zap.Logger
+}
+
+// protect wraps h with the configured basic auth, if any
+func (config *RouterConfig) protect(h http.Handler) http.Handler {
+	if config.AuthUser == "" {
+		return h
+	}
+	return NewBasicAuthHandler(config.AuthUser, config.AuthPassword, h)
+}
+
 // NewRouter returns a configured http router
-func NewRouter(w *elasticsearch.WriteService, r *elasticsearch.ReadService) *http.ServeMux {
+func NewRouter(w *elasticsearch.WriteService, r *elasticsearch.ReadService, config *RouterConfig) *http.ServeMux {
+	mux := http.NewServeMux()
+	addRoutes(mux, w, r, config)
+	return mux
+}
+
+func addRoutes(mux *http.ServeMux, w *elasticsearch.WriteService, r *elasticsearch.ReadService, config *RouterConfig) {
+	if config.Stats {
+		registerWriteDuration()
+	}
+	logger := config.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	mux.Handle("/read", config.protect(traceHandler(config.Tracer, "remote_read", readHandler(r, config.MaxBodyBytes, logger))))
+	mux.Handle("/write", config.protect(traceHandler(config.Tracer, "remote_write", promhttp.InstrumentHandlerDuration(writeDuration, writeHandler(w, config.MaxBodyBytes, config.Exemplars)))))
+	mux.Handle("/api/v1/query", config.protect(queryHandler(r)))
+	mux.Handle("/api/v1/query_range", config.protect(queryRangeHandler(r)))
+	mux.Handle("/api/v1/labels", config.protect(labelNamesHandler(r)))
+	mux.Handle("/api/v1/label/", config.protect(labelValuesHandler(r)))
+}
+
+// AdminConfig configures the admin router
+type AdminConfig struct {
+	// Alias is the write alias required by readiness, skipped when empty
+	Alias   string
+	Version VersionInfo
+	// Pprof exposes the Go profiling endpoints under /debug/pprof/
+	Pprof bool
+	// Metrics exposes Prometheus metrics under /metrics
+	Metrics bool
+	// MetricsAuth protects /metrics like the other admin endpoints, otherwise
+	// it is public as the probes are
+	MetricsAuth bool
+	// Index enables POST /rollover and /reindex when set
+	Index *elasticsearch.IndexService
+	// MetadataIndex enables /metadata listing the metadata stored in it
+	MetadataIndex string
+	// Reload enables POST /reload, reloading the write filter rules
+	Reload func() error
+	// AuthUser and AuthPassword are required as basic auth by every admin
+	// endpoint but the probes when AuthUser is set, independently of the
+	// remote read and write auth
+	AuthUser     string
+	AuthPassword string
+}
+
+// protect wraps h with the admin basic auth, if any
+func (config *AdminConfig) protect(h http.Handler) http.Handler {
+	if config.AuthUser == "" {
+		return h
+	}
+	return NewBasicAuthHandler(config.AuthUser, config.AuthPassword, h)
+}
+
+// NewAdminRouter returns a configured http router for prom metrics, health checks
+// and version information
+func NewAdminRouter(client *elastic.Client, config *AdminConfig) *http.ServeMux {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/read", readHandler(r))
-	mux.HandleFunc("/write", writeHandler(w))
+	addAdminRoutes(mux, client, config, func(h http.Handler) http.Handler { return h })
 	return mux
 }
 
-// NewAdminRouter returns a configured http router for prom metrics and health checks
-func NewAdminRouter(client *elastic.Client) *http.ServeMux {
+// NewSinglePortRouter returns a router serving both the remote read and write
+// and the admin endpoints.  Unless the admin endpoints have their own basic
+// auth, that of the remote endpoints, if any, protects every admin endpoint
+// but the probes.  The pprof endpoints are never served on it.
+func NewSinglePortRouter(w *elasticsearch.WriteService, r *elasticsearch.ReadService, config *RouterConfig, client *elastic.Client, adminConfig *AdminConfig) *http.ServeMux {
 	mux := http.NewServeMux()
-	mux.Handle("/metrics", prometheus.Handler())
-	// creates /live and /ready endpoints
-	mux.Handle("/", healthzHandler(client))
+	addRoutes(mux, w, r, config)
+	public := *adminConfig
+	public.Pprof = false
+	addAdminRoutes(mux, client, &public, config.protect)
 	return mux
 }
+
+// addAdminRoutes registers the admin endpoints, wrapping all but the probes,
+// and /metrics unless MetricsAuth is set, with the admin auth when set, or
+// with protect otherwise
+func addAdminRoutes(mux *http.ServeMux, client *elastic.Client, config *AdminConfig, protect func(http.Handler) http.Handler) {
+	if config.AuthUser != "" {
+		protect = config.protect
+	}
+	if config.Metrics {
+		// admin routes are served compressed, which would gzip the metrics twice
+		var metrics http.Handler = promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{DisableCompression: true})
+		metrics = prometheus.InstrumentHandler("prometheus", metrics)
+		if config.MetricsAuth {
+			metrics = protect(metrics)
+		}
+		mux.Handle("/metrics", metrics)
+	}
+	mux.Handle("/version", protect(versionHandler(config.Version)))
+	if config.Alias != "" {
+		mux.Handle("/active-index", protect(activeIndexHandler(client, config.Alias)))
+	}
+	if config.MetadataIndex != "" {
+		mux.Handle("/metadata", protect(metadataHandler(client, config.MetadataIndex)))
+	}
+	if config.Index != nil {
+		mux.Handle("/rollover", protect(rolloverHandler(config.Index)))
+		mux.Handle("/reindex", protect(migrateHandler(config.Index)))
+	}
+	if config.Reload != nil {
+		mux.Handle("/reload", protect(reloadHandler(config.Reload)))
+	}
+	if config.Pprof {
+		mux.Handle("/debug/pprof/", protect(http.HandlerFunc(pprof.Index)))
+		mux.Handle("/debug/pprof/cmdline", protect(http.HandlerFunc(pprof.Cmdline)))
+		mux.Handle("/debug/pprof/profile", protect(http.HandlerFunc(pprof.Profile)))
+		mux.Handle("/debug/pprof/symbol", protect(http.HandlerFunc(pprof.Symbol)))
+		mux.Handle("/debug/pprof/trace", protect(http.HandlerFunc(pprof.Trace)))
+	}
+	health := healthzHandler(client, config.Alias)
+	mux.Handle("/healthz", verboseReadyHandler(health))
+	// liveness never contacts Elasticsearch so ES outages don't restart the adapter
+	mux.HandleFunc("/-/healthy", health.LiveEndpoint)
+	// creates /live and /ready endpoints
+	mux.Handle("/", health)
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pwillie/prometheus-es-adapter/pkg/elasticsearch"
+)
+
+// serve returns the status of a GET of path on h, with the basic auth
+// credentials user and password unless user is empty
+func serve(h http.Handler, path, user, password string) int {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestSinglePortMetricsAuth(t *testing.T) {
+	tests := []struct {
+		name   string
+		admin  AdminConfig
+		user   string
+		status int
+	}{
+		{"protected without credentials", AdminConfig{MetricsAuth: true}, "", http.StatusUnauthorized},
+		{"protected with web credentials", AdminConfig{MetricsAuth: true}, "web", http.StatusOK},
+		{"public", AdminConfig{}, "", http.StatusOK},
+		{"admin auth with web credentials", AdminConfig{MetricsAuth: true, AuthUser: "admin", AuthPassword: "admin"}, "web", http.StatusUnauthorized},
+		{"admin auth with admin credentials", AdminConfig{MetricsAuth: true, AuthUser: "admin", AuthPassword: "admin"}, "admin", http.StatusOK},
+		{"public despite admin auth", AdminConfig{AuthUser: "admin", AuthPassword: "admin"}, "", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			admin := test.admin
+			admin.Metrics = true
+			router := NewSinglePortRouter(nil, nil, &RouterConfig{AuthUser: "web", AuthPassword: "web"}, nil, &admin)
+			if got := serve(router, "/metrics", test.user, test.user); got != test.status {
+				t.Errorf("got /metrics status %d, want %d", got, test.status)
+			}
+			// the probes are public and remote write keeps the web auth
+			if got := serve(router, "/-/healthy", "", ""); got != http.StatusOK {
+				t.Errorf("got /-/healthy status %d, want 200", got)
+			}
+			if got := serve(router, "/write", "", ""); got != http.StatusUnauthorized {
+				t.Errorf("got /write status %d, want 401", got)
+			}
+		})
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	reloadErr := errors.New("invalid rules")
+	var reloads int
+	config := &AdminConfig{
+		Alias:         "prom-metrics",
+		Metrics:       true,
+		MetricsAuth:   true,
+		Pprof:         true,
+		Index:         &elasticsearch.IndexService{},
+		MetadataIndex: "prom-metrics_metadata",
+		Reload: func() error {
+			reloads++
+			if reloads > 1 {
+				return reloadErr
+			}
+			return nil
+		},
+		AuthUser:     "admin",
+		AuthPassword: "secret",
+	}
+	router := NewAdminRouter(nil, config)
+
+	protected := []string{"/metrics", "/version", "/active-index", "/metadata", "/rollover", "/reindex", "/reload", "/debug/pprof/", "/debug/pprof/cmdline"}
+	for _, path := range protected {
+		if _, pattern := router.Handler(httptest.NewRequest(http.MethodGet, path, nil)); pattern != path {
+			t.Errorf("got %s routed to %q, want it registered", path, pattern)
+		}
+		if got := serve(router, path, "", ""); got != http.StatusUnauthorized {
+			t.Errorf("got %s status %d without credentials, want 401", path, got)
+		}
+		if got := serve(router, path, "admin", "wrong"); got != http.StatusUnauthorized {
+			t.Errorf("got %s status %d with a wrong password, want 401", path, got)
+		}
+	}
+	// the probes never require auth, readiness fails without a client
+	probes := map[string]int{
+		"/-/healthy": http.StatusOK,
+		"/live":      http.StatusOK,
+		"/ready":     http.StatusServiceUnavailable,
+		"/healthz":   http.StatusServiceUnavailable,
+	}
+	for path, want := range probes {
+		if got := serve(router, path, "", ""); got != want {
+			t.Errorf("got %s status %d, want %d", path, got, want)
+		}
+	}
+
+	if got := serve(router, "/version", "admin", "secret"); got != http.StatusOK {
+		t.Errorf("got /version status %d, want 200", got)
+	}
+	for _, path := range []string{"/rollover", "/reindex", "/reload"} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.SetBasicAuth("admin", "secret")
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != http.MethodPost {
+			t.Errorf("got GET %s status %d and Allow %q, want 405 allowing POST", path, rec.Code, rec.Header().Get("Allow"))
+		}
+	}
+	for _, want := range []int{http.StatusNoContent, http.StatusInternalServerError} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/reload", nil)
+		req.SetBasicAuth("admin", "secret")
+		router.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("got POST /reload status %d, want %d", rec.Code, want)
+		}
+	}
+}
+
+func TestAdminRoutesOptional(t *testing.T) {
+	router := NewAdminRouter(nil, &AdminConfig{})
+	for _, path := range []string{"/metrics", "/active-index", "/metadata", "/rollover", "/reindex", "/reload", "/debug/pprof/"} {
+		if _, pattern := router.Handler(httptest.NewRequest(http.MethodGet, path, nil)); pattern != "/" {
+			t.Errorf("got %s routed to %q, want it left to the health handler", path, pattern)
+		}
+	}
+	// without admin auth nothing is protected
+	if got := serve(router, "/version", "", ""); got != http.StatusOK {
+		t.Errorf("got /version status %d, want 200", got)
+	}
+}
+
+func TestSinglePortRoutes(t *testing.T) {
+	router := NewSinglePortRouter(nil, nil, &RouterConfig{}, nil, &AdminConfig{Alias: "prom-metrics", Metrics: true, Pprof: true})
+	for _, path := range []string{"/read", "/write", "/api/v1/query", "/api/v1/labels", "/metrics", "/healthz", "/-/healthy", "/version", "/active-index"} {
+		if _, pattern := router.Handler(httptest.NewRequest(http.MethodGet, path, nil)); pattern != path {
+			t.Errorf("got %s routed to %q, want it registered", path, pattern)
+		}
+	}
+	// pprof stays off the web listener
+	if _, pattern := router.Handler(httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)); pattern != "/" {
+		t.Errorf("got /debug/pprof/ routed to %q on the single port", pattern)
+	}
+}
@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// parseSelector parses a PromQL instant vector selector such as
+// up{job="prometheus",instance=~"a.*"} into remote read matchers.  Functions,
+// operators, range selectors and offsets are not supported.
+func parseSelector(input string) ([]*prompb.LabelMatcher, error) {
+	p := &selectorParser{input: strings.TrimSpace(input)}
+	matchers, err := p.parse()
+	if err != nil {
+		return nil, fmt.Errorf("unsupported selector %q: %s", input, err)
+	}
+	for _, m := range matchers {
+		empty, err := matchesEmpty(m)
+		if err != nil {
+			return nil, err
+		}
+		if !empty {
+			return matchers, nil
+		}
+	}
+	return nil, fmt.Errorf("selector %q must contain at least one matcher not matching the empty string", input)
+}
+
+// matchesEmpty reports whether m matches series without its label, which
+// Prometheus rejects as the only kind of matcher in a selector
+func matchesEmpty(m *prompb.LabelMatcher) (bool, error) {
+	switch m.Type {
+	case prompb.LabelMatcher_EQ:
+		return m.Value == "", nil
+	case prompb.LabelMatcher_NEQ:
+		return m.Value != "", nil
+	}
+	re, err := regexp.Compile("^(?:" + m.Value + ")$")
+	if err != nil {
+		return false, fmt.Errorf("invalid regex matcher for %s: %s", m.Name, err)
+	}
+	return re.MatchString("") == (m.Type == prompb.LabelMatcher_RE), nil
+}
+
+type selectorParser struct {
+	input string
+	pos   int
+}
+
+func (p *selectorParser) parse() ([]*prompb.LabelMatcher, error) {
+	var matchers []*prompb.LabelMatcher
+	if name := p.identifier(true); name != "" {
+		matchers = append(matchers, &prompb.LabelMatcher{
+			Type:  prompb.LabelMatcher_EQ,
+			Name:  model.MetricNameLabel,
+			Value: name,
+		})
+	}
+	p.skipSpace()
+	if p.pos == len(p.input) {
+		if len(matchers) == 0 {
+			return nil, fmt.Errorf("expected a metric name or label matchers")
+		}
+		return matchers, nil
+	}
+	if !p.consume("{") {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.input[p.pos:], p.pos)
+	}
+	for {
+		p.skipSpace()
+		if p.consume("}") {
+			break
+		}
+		m, err := p.matcher()
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+		p.skipSpace()
+		if p.consume("}") {
+			break
+		}
+		if !p.consume(",") {
+			return nil, fmt.Errorf("expected , or } at position %d", p.pos)
+		}
+	}
+	p.skipSpace()
+	if p.pos != len(p.input) {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.input[p.pos:], p.pos)
+	}
+	return matchers, nil
+}
+
+func (p *selectorParser) matcher() (*prompb.LabelMatcher, error) {
+	name := p.identifier(false)
+	if name == "" {
+		return nil, fmt.Errorf("expected a label name at position %d", p.pos)
+	}
+	p.skipSpace()
+	var op prompb.LabelMatcher_Type
+	switch {
+	case p.consume("=~"):
+		op = prompb.LabelMatcher_RE
+	case p.consume("!~"):
+		op = prompb.LabelMatcher_NRE
+	case p.consume("!="):
+		op = prompb.LabelMatcher_NEQ
+	case p.consume("="):
+		op = prompb.LabelMatcher_EQ
+	default:
+		return nil, fmt.Errorf("expected a match operator at position %d", p.pos)
+	}
+	p.skipSpace()
+	value, err := p.str()
+	if err != nil {
+		return nil, err
+	}
+	return &prompb.LabelMatcher{Type: op, Name: name, Value: value}, nil
+}
+
+// identifier consumes a label name, or a metric name which may contain colons
+func (p *selectorParser) identifier(metric bool) string {
+	start := p.pos
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (metric && c == ':') || (c >= '0' && c <= '9' && p.pos > start) {
+			p.pos++
+			continue
+		}
+		break
+	}
+	return p.input[start:p.pos]
+}
+
+// str consumes a double, single or back quoted string
+func (p *selectorParser) str() (string, error) {
+	if p.pos == len(p.input) {
+		return "", fmt.Errorf("expected a quoted string at position %d", p.pos)
+	}
+	quote := p.input[p.pos]
+	if quote != '"' && quote != '\'' && quote != '`' {
+		return "", fmt.Errorf("expected a quoted string at position %d", p.pos)
+	}
+	start := p.pos
+	p.pos++
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		if c == '\\' && quote != '`' {
+			p.pos += 2
+			continue
+		}
+		p.pos++
+		if c == quote {
+			raw := p.input[start:p.pos]
+			if quote == '\'' {
+				// requote as a Go string, escaping double quotes
+				inner := strings.Replace(raw[1:len(raw)-1], `\'`, `'`, -1)
+				inner = strings.Replace(inner, `\"`, `"`, -1)
+				raw = `"` + strings.Replace(inner, `"`, `\"`, -1) + `"`
+			}
+			s, err := strconv.Unquote(raw)
+			if err != nil {
+				return "", fmt.Errorf("invalid string %s: %s", p.input[start:p.pos], err)
+			}
+			return s, nil
+		}
+	}
+	return "", fmt.Errorf("unterminated string at position %d", start)
+}
+
+func (p *selectorParser) consume(s string) bool {
+	if strings.HasPrefix(p.input[p.pos:], s) {
+		p.pos += len(s)
+		return true
+	}
+	return false
+}
+
+func (p *selectorParser) skipSpace() {
+	for p.pos < len(p.input) && strings.IndexByte(" \t\n\r", p.input[p.pos]) >= 0 {
+		p.pos++
+	}
+}
@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/pwillie/prometheus-es-adapter/pkg/tracing"
+)
+
+// traceHandler records a server span named name around next, continuing the
+// trace of the traceparent header sent by Prometheus
+func traceHandler(tracer *tracing.Tracer, name string, next http.Handler) http.Handler {
+	if tracer == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracer.Start(tracing.Extract(r.Context(), r.Header), name, tracing.KindServer)
+		defer span.End()
+		span.SetString("http.method", r.Method)
+		span.SetString("http.target", r.URL.Path)
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		span.SetInt("http.status_code", int64(rec.status))
+		if rec.status >= 500 {
+			span.SetError(fmt.Errorf("%s", http.StatusText(rec.status)))
+		}
+	})
+}
@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/pwillie/prometheus-es-adapter/pkg/elasticsearch"
+	"github.com/pwillie/prometheus-es-adapter/pkg/tracing"
+	"go.uber.org/zap"
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+// testSpan is the part of an exported OTLP span checked by the tests
+type testSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+	Attributes   []struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue *string `json:"stringValue"`
+			IntValue    *string `json:"intValue"`
+		} `json:"value"`
+	} `json:"attributes"`
+	Status *struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+// attr returns the value of the string or int attribute key, "" if unset
+func (s testSpan) attr(key string) string {
+	for _, a := range s.Attributes {
+		if a.Key != key {
+			continue
+		}
+		if a.Value.StringValue != nil {
+			return *a.Value.StringValue
+		}
+		if a.Value.IntValue != nil {
+			return *a.Value.IntValue
+		}
+	}
+	return ""
+}
+
+// testCollector is an OTLP/HTTP collector recording the spans exported to it
+type testCollector struct {
+	mu    sync.Mutex
+	spans map[string]testSpan
+}
+
+func (c *testCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []testSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.spans == nil {
+		c.spans = make(map[string]testSpan)
+	}
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, s := range ss.Spans {
+				c.spans[s.Name] = s
+			}
+		}
+	}
+}
+
+// span returns the span named name, failing the test if none was exported
+func (c *testCollector) span(t *testing.T, name string) testSpan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.spans[name]
+	if !ok {
+		t.Fatalf("no %s span exported, got %v", name, c.spans)
+	}
+	return s
+}
+
+// searchServer is an Elasticsearch answering each scroll with one page of a
+// single sample of up
+func searchServer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == http.MethodDelete:
+		w.Write([]byte(`{"succeeded":true}`))
+	case r.URL.Path == "/_search/scroll":
+		w.Write([]byte(`{"_scroll_id":"s1","hits":{"total":1,"hits":[]}}`))
+	default:
+		w.Write([]byte(`{"_scroll_id":"s1","hits":{"total":1,"hits":[{"_index":"prom-metrics-1","_type":"_doc","_id":"1",` +
+			`"_source":{"label":{"__name__":"up"},"value":1,"timestamp":1000}}]}}`))
+	}
+}
+
+// newTestClient returns a client of an Elasticsearch served by handler, the
+// server must be closed
+func newTestClient(t *testing.T, handler http.Handler) (*elastic.Client, *httptest.Server) {
+	srv := httptest.NewServer(handler)
+	client, err := elastic.NewClient(elastic.SetURL(srv.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	return client, srv
+}
+
+// fakeWriter is a writeService recording the series written, failing with err,
+// and reporting dropped of their samples as not written
+type fakeWriter struct {
+	err       error
+	dropped   int
+	series    []*prompb.TimeSeries
+	metadata  []elasticsearch.MetricMetadata
+	exemplars []elasticsearch.Exemplar
+}
+
+func (f *fakeWriter) Write(series []*prompb.TimeSeries) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	f.series = append(f.series, series...)
+	written := -f.dropped
+	for _, ts := range series {
+		written += len(ts.Samples)
+	}
+	return written, nil
+}
+
+func (f *fakeWriter) WriteMetadata(md []elasticsearch.MetricMetadata) {
+	f.metadata = append(f.metadata, md...)
+}
+
+func (f *fakeWriter) WriteExemplars(ex []elasticsearch.Exemplar) {
+	f.exemplars = append(f.exemplars, ex...)
+}
+
+// encode returns the snappy compressed protobuf encoding of m
+func encode(t *testing.T, m proto.Message) []byte {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encodeRaw(b)
+}
+
+// encodeRaw returns b snappy compressed
+func encodeRaw(b []byte) []byte {
+	return snappy.Encode(nil, b)
+}
+
+func TestTraceHandlerSpans(t *testing.T) {
+	collector := &testCollector{}
+	otel := httptest.NewServer(collector)
+	defer otel.Close()
+	tracer := tracing.NewTracer(zap.NewNop(), otel.URL, "test")
+	client, es := newTestClient(t, http.HandlerFunc(searchServer))
+	defer es.Close()
+	reads := elasticsearch.NewReadService(zap.NewNop(), client, &elasticsearch.ReadConfig{
+		Alias:   "prom-metrics",
+		MaxDocs: 10,
+		Tracer:  tracer,
+	})
+
+	read := &prompb.ReadRequest{Queries: []*prompb.Query{{
+		StartTimestampMs: 0,
+		EndTimestampMs:   2000,
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}},
+	}}}
+	req := httptest.NewRequest(http.MethodPost, "/read", bytes.NewReader(encode(t, read)))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	traceHandler(tracer, "remote_read", readHandler(reads, 0, zap.NewNop())).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got read status %d, want 200: %s", rec.Code, rec.Body)
+	}
+
+	write := &prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+	}}}
+	req = httptest.NewRequest(http.MethodPost, "/write", bytes.NewReader(encode(t, write)))
+	rec = httptest.NewRecorder()
+	writes := &fakeWriter{err: elasticsearch.ErrUnavailable}
+	traceHandler(tracer, "remote_write", writeHandler(writes, 0, false)).ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got write status %d, want 503", rec.Code)
+	}
+	tracer.Close()
+
+	server := collector.span(t, "remote_read")
+	search := collector.span(t, "elasticsearch.search")
+	if server.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || server.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("got remote_read span %s/%s, want a child of the traceparent", server.TraceID, server.ParentSpanID)
+	}
+	if search.TraceID != server.TraceID || search.ParentSpanID != server.SpanID {
+		t.Errorf("got elasticsearch.search span %s/%s, want a child of remote_read %s/%s",
+			search.TraceID, search.ParentSpanID, server.TraceID, server.SpanID)
+	}
+	if server.Kind != tracing.KindServer || search.Kind != tracing.KindClient {
+		t.Errorf("got span kinds %d and %d, want server and client", server.Kind, search.Kind)
+	}
+	if got := server.attr("http.status_code"); got != "200" {
+		t.Errorf("got remote_read http.status_code %q, want 200", got)
+	}
+	for key, want := range map[string]string{
+		"es.alias":  "prom-metrics",
+		"es.index":  "prom-metrics-*",
+		"es.hits":   "1",
+		"es.series": "1",
+	} {
+		if got := search.attr(key); got != want {
+			t.Errorf("got elasticsearch.search %s %q, want %q", key, got, want)
+		}
+	}
+
+	failed := collector.span(t, "remote_write")
+	if failed.TraceID == server.TraceID || failed.ParentSpanID != "" {
+		t.Errorf("got remote_write span %s/%s, want a new trace without traceparent", failed.TraceID, failed.ParentSpanID)
+	}
+	if got := failed.attr("http.status_code"); got != "503" {
+		t.Errorf("got remote_write http.status_code %q, want 503", got)
+	}
+	if failed.Status == nil || failed.Status.Code != 2 {
+		t.Errorf("got remote_write status %+v, want an error", failed.Status)
+	}
+}
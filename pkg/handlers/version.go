@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+)
+
+// VersionInfo describes the running adapter and the cluster it writes to
+type VersionInfo struct {
+	Build                string `json:"build"`
+	Commit               string `json:"commit"`
+	GoVersion            string `json:"go_version"`
+	ElasticsearchVersion string `json:"elasticsearch_version"`
+}
+
+func versionHandler(info VersionInfo) http.HandlerFunc {
+	info.GoVersion = runtime.Version()
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(info); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
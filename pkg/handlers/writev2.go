@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/pwillie/prometheus-es-adapter/pkg/elasticsearch"
+)
+
+// writeV2Proto is the Content-Type proto parameter of remote write 2.0 requests
+const writeV2Proto = "io.prometheus.write.v2.Request"
+
+// The remote write 2.0 messages below only declare the fields the adapter
+// indexes, others such as native histograms are skipped when unmarshalling.
+
+// writeV2Request is io.prometheus.write.v2.Request, series reference their
+// label names and values by index into Symbols
+type writeV2Request struct {
+	Symbols    []string        `protobuf:"bytes,4,rep,name=symbols,proto3"`
+	Timeseries []writeV2Series `protobuf:"bytes,5,rep,name=timeseries,proto3"`
+}
+
+func (m *writeV2Request) Reset()         { *m = writeV2Request{} }
+func (m *writeV2Request) String() string { return proto.CompactTextString(m) }
+func (*writeV2Request) ProtoMessage()    {}
+
+type writeV2Series struct {
+	LabelsRefs []uint32          `protobuf:"varint,1,rep,packed,name=labels_refs,proto3"`
+	Samples    []writeV2Sample   `protobuf:"bytes,2,rep,name=samples,proto3"`
+	Exemplars  []writeV2Exemplar `protobuf:"bytes,4,rep,name=exemplars,proto3"`
+	Metadata   *writeV2Metadata  `protobuf:"bytes,5,opt,name=metadata,proto3"`
+}
+
+func (m *writeV2Series) Reset()         { *m = writeV2Series{} }
+func (m *writeV2Series) String() string { return proto.CompactTextString(m) }
+func (*writeV2Series) ProtoMessage()    {}
+
+type writeV2Sample struct {
+	Value     float64 `protobuf:"fixed64,1,opt,name=value,proto3"`
+	Timestamp int64   `protobuf:"varint,2,opt,name=timestamp,proto3"`
+}
+
+func (m *writeV2Sample) Reset()         { *m = writeV2Sample{} }
+func (m *writeV2Sample) String() string { return proto.CompactTextString(m) }
+func (*writeV2Sample) ProtoMessage()    {}
+
+type writeV2Exemplar struct {
+	LabelsRefs []uint32 `protobuf:"varint,1,rep,packed,name=labels_refs,proto3"`
+	Value      float64  `protobuf:"fixed64,2,opt,name=value,proto3"`
+	Timestamp  int64    `protobuf:"varint,3,opt,name=timestamp,proto3"`
+}
+
+func (m *writeV2Exemplar) Reset()         { *m = writeV2Exemplar{} }
+func (m *writeV2Exemplar) String() string { return proto.CompactTextString(m) }
+func (*writeV2Exemplar) ProtoMessage()    {}
+
+type writeV2Metadata struct {
+	Type    int32  `protobuf:"varint,1,opt,name=type,proto3"`
+	HelpRef uint32 `protobuf:"varint,3,opt,name=help_ref,proto3"`
+	UnitRef uint32 `protobuf:"varint,4,opt,name=unit_ref,proto3"`
+}
+
+func (m *writeV2Metadata) Reset()         { *m = writeV2Metadata{} }
+func (m *writeV2Metadata) String() string { return proto.CompactTextString(m) }
+func (*writeV2Metadata) ProtoMessage()    {}
+
+// metricTypes names the io.prometheus.write.v2.Metadata.MetricType values
+var metricTypes = []string{"unknown", "counter", "gauge", "histogram", "gaugehistogram", "summary", "info", "stateset"}
+
+// writeVersion returns the major version of the X-Prometheus-Remote-Write-Version
+// header, 0.1.0 for remote write 1.0 and 2.x for 2.0, or -1 when it is
+// missing as with older senders.  Malformed versions and versions above 2
+// are errors.
+func writeVersion(r *http.Request) (int, error) {
+	v := strings.TrimSpace(r.Header.Get("X-Prometheus-Remote-Write-Version"))
+	if v == "" {
+		return -1, nil
+	}
+	parts := strings.Split(v, ".")
+	major, err := strconv.Atoi(parts[0])
+	if err != nil || major < 0 || len(parts) > 3 {
+		return 0, fmt.Errorf("malformed X-Prometheus-Remote-Write-Version %q, expected major.minor.patch", v)
+	}
+	for _, p := range parts[1:] {
+		if n, err := strconv.Atoi(p); err != nil || n < 0 {
+			return 0, fmt.Errorf("malformed X-Prometheus-Remote-Write-Version %q, expected major.minor.patch", v)
+		}
+	}
+	if major > 2 {
+		return 0, fmt.Errorf("unsupported X-Prometheus-Remote-Write-Version %q, expected 0.1.0 or 2.x", v)
+	}
+	return major, nil
+}
+
+// isWriteV2 reports whether r is a remote write 2.0 request, identified by
+// the proto parameter of its Content-Type or else its major version
+func isWriteV2(r *http.Request, version int) bool {
+	for _, param := range strings.Split(r.Header.Get("Content-Type"), ";") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) == 2 && kv[0] == "proto" {
+			return kv[1] == writeV2Proto
+		}
+	}
+	return version == 2
+}
+
+// decodeWriteV2 unmarshals a remote write 2.0 request into v1 series, the
+// metadata of their metrics and their exemplars, if any
+func decodeWriteV2(buf []byte) (*remoteWrite, error) {
+	var req writeV2Request
+	if err := proto.Unmarshal(buf, &req); err != nil {
+		return nil, err
+	}
+	symbol := func(ref uint32) (string, error) {
+		if int(ref) >= len(req.Symbols) {
+			return "", fmt.Errorf("label reference %d out of range of %d symbols", ref, len(req.Symbols))
+		}
+		return req.Symbols[ref], nil
+	}
+	labels := func(refs []uint32) ([]*prompb.Label, error) {
+		if len(refs)%2 != 0 {
+			return nil, fmt.Errorf("odd number of label references")
+		}
+		ret := make([]*prompb.Label, 0, len(refs)/2)
+		for i := 0; i < len(refs); i += 2 {
+			name, err := symbol(refs[i])
+			if err != nil {
+				return nil, err
+			}
+			value, err := symbol(refs[i+1])
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, &prompb.Label{Name: name, Value: value})
+		}
+		return ret, nil
+	}
+	w := &remoteWrite{Series: make([]*prompb.TimeSeries, 0, len(req.Timeseries))}
+	for _, s := range req.Timeseries {
+		ls, err := labels(s.LabelsRefs)
+		if err != nil {
+			return nil, err
+		}
+		ts := &prompb.TimeSeries{
+			Labels:  ls,
+			Samples: make([]prompb.Sample, 0, len(s.Samples)),
+		}
+		for _, sample := range s.Samples {
+			ts.Samples = append(ts.Samples, prompb.Sample{Value: sample.Value, Timestamp: sample.Timestamp})
+		}
+		w.Series = append(w.Series, ts)
+		for _, e := range s.Exemplars {
+			els, err := labels(e.LabelsRefs)
+			if err != nil {
+				return nil, err
+			}
+			w.Exemplars = append(w.Exemplars, elasticsearch.Exemplar{
+				Series:    toMetric(ls),
+				Labels:    toMetric(els),
+				Value:     e.Value,
+				Timestamp: e.Timestamp,
+			})
+		}
+		if s.Metadata != nil {
+			md, err := convertMetadataV2(ts, s.Metadata, symbol)
+			if err != nil {
+				return nil, err
+			}
+			if md != nil {
+				w.Metadata = append(w.Metadata, *md)
+			}
+		}
+	}
+	return w, nil
+}
+
+// convertMetadataV2 returns the metadata of the metric ts belongs to, nil
+// when the series has no name or the metadata is empty
+func convertMetadataV2(ts *prompb.TimeSeries, m *writeV2Metadata, symbol func(uint32) (string, error)) (*elasticsearch.MetricMetadata, error) {
+	md := &elasticsearch.MetricMetadata{}
+	for _, l := range ts.Labels {
+		if l.Name == "__name__" {
+			md.Metric = l.Value
+		}
+	}
+	if int(m.Type) > 0 && int(m.Type) < len(metricTypes) {
+		md.Type = metricTypes[m.Type]
+	}
+	var err error
+	if md.Help, err = symbol(m.HelpRef); err != nil {
+		return nil, err
+	}
+	if md.Unit, err = symbol(m.UnitRef); err != nil {
+		return nil, err
+	}
+	if md.Metric == "" || (md.Type == "" && md.Help == "" && md.Unit == "") {
+		return nil, nil
+	}
+	return md, nil
+}
@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/pwillie/prometheus-es-adapter/pkg/elasticsearch"
+)
+
+// message returns the wire encoding of a length delimited field num
+func message(num uint64, payload []byte) []byte {
+	var b proto.Buffer
+	b.EncodeVarint(num<<3 | proto.WireBytes)
+	b.EncodeRawBytes(payload)
+	return b.Bytes()
+}
+
+// packed returns the wire encoding of a packed repeated varint field num
+func packed(num uint64, values ...uint64) []byte {
+	var v proto.Buffer
+	for _, n := range values {
+		v.EncodeVarint(n)
+	}
+	return message(num, v.Bytes())
+}
+
+// varint returns the wire encoding of a varint field num
+func varint(num, value uint64) []byte {
+	var b proto.Buffer
+	b.EncodeVarint(num<<3 | proto.WireVarint)
+	b.EncodeVarint(value)
+	return b.Bytes()
+}
+
+// fixed64 returns the wire encoding of a double field num
+func fixed64(num uint64, value float64) []byte {
+	var b proto.Buffer
+	b.EncodeVarint(num<<3 | proto.WireFixed64)
+	b.EncodeFixed64(math.Float64bits(value))
+	return b.Bytes()
+}
+
+// concat returns the parts appended in order
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// v2Payload is an io.prometheus.write.v2.Request encoded field by field as
+// Prometheus sends it, with an empty native histogram the adapter skips
+func v2Payload() []byte {
+	var symbols [][]byte
+	for _, s := range []string{"", "__name__", "http_requests_total", "job", "api", "Requests served", "trace_id", "abc"} {
+		symbols = append(symbols, message(4, []byte(s)))
+	}
+	series := concat(
+		packed(1, 1, 2, 3, 4),
+		message(2, concat(fixed64(1, 1.5), varint(2, 1000))),
+		message(2, concat(fixed64(1, 2), varint(2, 2000))),
+		message(3, nil),
+		message(4, concat(packed(1, 6, 7), fixed64(2, 1.5), varint(3, 1000))),
+		message(5, concat(varint(1, 1), varint(3, 5), varint(4, 0))),
+	)
+	return concat(concat(symbols...), message(5, series))
+}
+
+func TestDecodeWriteV2(t *testing.T) {
+	got, err := decodeWriteV2(v2Payload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := []*prompb.Label{{Name: "__name__", Value: "http_requests_total"}, {Name: "job", Value: "api"}}
+	want := &remoteWrite{
+		Series: []*prompb.TimeSeries{{
+			Labels:  labels,
+			Samples: []prompb.Sample{{Value: 1.5, Timestamp: 1000}, {Value: 2, Timestamp: 2000}},
+		}},
+		Metadata: []elasticsearch.MetricMetadata{{Metric: "http_requests_total", Type: "counter", Help: "Requests served"}},
+		Exemplars: []elasticsearch.Exemplar{{
+			Series:    toMetric(labels),
+			Labels:    toMetric([]*prompb.Label{{Name: "trace_id", Value: "abc"}}),
+			Value:     1.5,
+			Timestamp: 1000,
+		}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestDecodeWriteV2Metadata(t *testing.T) {
+	symbols := []string{"", "__name__", "up", "Target is up", "seconds"}
+	tests := []struct {
+		name     string
+		labels   []uint32
+		metadata *writeV2Metadata
+		want     []elasticsearch.MetricMetadata
+	}{
+		{"none", []uint32{1, 2}, nil, nil},
+		{"empty", []uint32{1, 2}, &writeV2Metadata{}, nil},
+		{"unnamed series", nil, &writeV2Metadata{Type: 2, HelpRef: 3}, nil},
+		{"gauge", []uint32{1, 2}, &writeV2Metadata{Type: 2, HelpRef: 3, UnitRef: 4},
+			[]elasticsearch.MetricMetadata{{Metric: "up", Type: "gauge", Help: "Target is up", Unit: "seconds"}}},
+		{"unknown type", []uint32{1, 2}, &writeV2Metadata{Type: 99, HelpRef: 3},
+			[]elasticsearch.MetricMetadata{{Metric: "up", Help: "Target is up"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, err := proto.Marshal(&writeV2Request{
+				Symbols:    symbols,
+				Timeseries: []writeV2Series{{LabelsRefs: test.labels, Metadata: test.metadata}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := decodeWriteV2(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.Metadata, test.want) {
+				t.Errorf("got metadata %+v, want %+v", got.Metadata, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeWriteV2Errors(t *testing.T) {
+	symbols := []string{"", "__name__", "up"}
+	tests := []struct {
+		name   string
+		series writeV2Series
+		err    string
+	}{
+		{"label ref out of range", writeV2Series{LabelsRefs: []uint32{1, 3}}, "label reference 3 out of range of 3 symbols"},
+		{"label name ref out of range", writeV2Series{LabelsRefs: []uint32{100, 2}}, "label reference 100 out of range of 3 symbols"},
+		{"odd label refs", writeV2Series{LabelsRefs: []uint32{1, 2, 1}}, "odd number of label references"},
+		{"odd exemplar label refs", writeV2Series{
+			LabelsRefs: []uint32{1, 2},
+			Exemplars:  []writeV2Exemplar{{LabelsRefs: []uint32{1}}},
+		}, "odd number of label references"},
+		{"help ref out of range", writeV2Series{
+			LabelsRefs: []uint32{1, 2},
+			Metadata:   &writeV2Metadata{Type: 1, HelpRef: 7},
+		}, "label reference 7 out of range of 3 symbols"},
+		{"unit ref out of range", writeV2Series{
+			LabelsRefs: []uint32{1, 2},
+			Metadata:   &writeV2Metadata{Type: 1, UnitRef: 3},
+		}, "label reference 3 out of range of 3 symbols"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, err := proto.Marshal(&writeV2Request{Symbols: symbols, Timeseries: []writeV2Series{test.series}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := decodeWriteV2(b); err == nil || err.Error() != test.err {
+				t.Errorf("got error %v, want %s", err, test.err)
+			}
+		})
+	}
+	if _, err := decodeWriteV2(v2Payload()[:20]); err == nil {
+		t.Error("got no error decoding a truncated request")
+	}
+}
+
+func TestWriteVersion(t *testing.T) {
+	tests := []struct {
+		header string
+		want   int
+		err    string
+	}{
+		{"", -1, ""},
+		{"0.1.0", 0, ""},
+		{" 0.1.0 ", 0, ""},
+		{"1", 1, ""},
+		{"2.0.0", 2, ""},
+		{"2.1", 2, ""},
+		{"3.0.0", 0, "unsupported"},
+		{"v2", 0, "malformed"},
+		{"2.x.0", 0, "malformed"},
+		{"2.0.0.0", 0, "malformed"},
+		{"-1.0.0", 0, "malformed"},
+		{"2.-1", 0, "malformed"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/write", nil)
+		if test.header != "" {
+			r.Header.Set("X-Prometheus-Remote-Write-Version", test.header)
+		}
+		got, err := writeVersion(r)
+		if test.err == "" && (err != nil || got != test.want) {
+			t.Errorf("got version %d and error %v for %q, want %d", got, err, test.header, test.want)
+		}
+		if test.err != "" && (err == nil || !strings.HasPrefix(err.Error(), test.err)) {
+			t.Errorf("got error %v for %q, want it %s", err, test.header, test.err)
+		}
+	}
+}
+
+func TestIsWriteV2(t *testing.T) {
+	tests := []struct {
+		contentType string
+		version     int
+		want        bool
+	}{
+		{"", -1, false},
+		{"application/x-protobuf", 0, false},
+		{"application/x-protobuf", 2, true},
+		{"application/x-protobuf;proto=io.prometheus.write.v2.Request", -1, true},
+		{"application/x-protobuf; proto=io.prometheus.write.v2.Request", 0, true},
+		{"application/x-protobuf;proto=prometheus.WriteRequest", 2, false},
+		{"application/x-protobuf;charset=utf-8", 2, true},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/write", nil)
+		r.Header.Set("Content-Type", test.contentType)
+		if got := isWriteV2(r, test.version); got != test.want {
+			t.Errorf("got %t for Content-Type %q and version %d, want %t", got, test.contentType, test.version, test.want)
+		}
+	}
+}
+
+func TestWriteVersionHeader(t *testing.T) {
+	v1 := encode(t, &prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+	}}})
+	v2 := encodeRaw(v2Payload())
+	tests := []struct {
+		name    string
+		header  string
+		body    []byte
+		dropped int
+		status  int
+		written string
+		message string
+	}{
+		{"absent", "", v1, 0, http.StatusOK, "", ""},
+		{"1.0", "0.1.0", v1, 0, http.StatusOK, "", ""},
+		{"2.0", "2.0.0", v2, 0, http.StatusOK, "2", ""},
+		{"2.0 with dropped samples", "2.0.0", v2, 1, http.StatusOK, "1", ""},
+		{"malformed", "two", v1, 0, http.StatusBadRequest, "", `malformed X-Prometheus-Remote-Write-Version "two", expected major.minor.patch`},
+		{"malformed before the body", "2.0.0-rc", []byte("not snappy"), 0, http.StatusBadRequest, "", `malformed X-Prometheus-Remote-Write-Version "2.0.0-rc"`},
+		{"incompatible", "3.0.0", v2, 0, http.StatusBadRequest, "", `unsupported X-Prometheus-Remote-Write-Version "3.0.0", expected 0.1.0 or 2.x`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writes := &fakeWriter{dropped: test.dropped}
+			req := httptest.NewRequest(http.MethodPost, "/write", bytes.NewReader(test.body))
+			if test.header != "" {
+				req.Header.Set("X-Prometheus-Remote-Write-Version", test.header)
+			}
+			rec := httptest.NewRecorder()
+			writeHandler(writes, 0, false).ServeHTTP(rec, req)
+			if rec.Code != test.status {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, test.status, rec.Body)
+			}
+			if got := rec.Header().Get("X-Prometheus-Remote-Write-Samples-Written"); got != test.written {
+				t.Errorf("got %q samples written, want %q", got, test.written)
+			}
+			if test.status != http.StatusOK {
+				if res := decodeError(t, rec); !strings.HasPrefix(res.Message, test.message) {
+					t.Errorf("got message %q, want it to start with %q", res.Message, test.message)
+				}
+				if len(writes.series) != 0 {
+					t.Errorf("got %d series written despite the header", len(writes.series))
+				}
+			}
+		})
+	}
+}
@@ -2,15 +2,50 @@ package logger
 
 import (
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
-func NewLogger(debug bool) *zap.Logger {
-	var logger *zap.Logger
-	if debug {
-		logger, _ = zap.NewDevelopment()
-	} else {
-		logger, _ = zap.NewProduction()
-	}
+// NewLogger returns a logger for the given level, one of debug, info, warn or
+// error.  The debug level uses zap's development config.  Unknown levels fall
+// back to info with a warning.
+//
+// format selects the json or console encoding, when empty it follows the
+// config chosen for the level: console for debug, json otherwise.
+func NewLogger(level, format string) *zap.Logger {
+	cfg, invalidLevel, invalidFormat := newConfig(level, format)
+	logger, _ := cfg.Build()
 	defer logger.Sync() // flushes buffer, if any
+	if invalidLevel {
+		logger.Warn("Invalid log level, defaulting to info", zap.String("level", level))
+	}
+	if invalidFormat {
+		logger.Warn("Invalid log format, using default", zap.String("format", format))
+	}
 	return logger
 }
+
+// newConfig returns the zap config for level and format, and whether either
+// was invalid and replaced by its default
+func newConfig(level, format string) (cfg zap.Config, invalidLevel, invalidFormat bool) {
+	var lvl zapcore.Level
+	invalidLevel = lvl.UnmarshalText([]byte(level)) != nil
+	if invalidLevel {
+		lvl = zapcore.InfoLevel
+	}
+
+	if lvl == zapcore.DebugLevel {
+		cfg = zap.NewDevelopmentConfig()
+	} else {
+		cfg = zap.NewProductionConfig()
+	}
+	cfg.Level = zap.NewAtomicLevelAt(lvl)
+
+	switch format {
+	case "":
+	case "json", "console":
+		cfg.Encoding = format
+	default:
+		invalidFormat = true
+	}
+	return cfg, invalidLevel, invalidFormat
+}
@@ -0,0 +1,57 @@
+package logger
+
+import (
+	"testing"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func TestLevel(t *testing.T) {
+	tests := []struct {
+		level   string
+		want    zapcore.Level
+		invalid bool
+	}{
+		{"debug", zapcore.DebugLevel, false},
+		{"info", zapcore.InfoLevel, false},
+		{"warn", zapcore.WarnLevel, false},
+		{"error", zapcore.ErrorLevel, false},
+		{"INFO", zapcore.InfoLevel, false},
+		{"", zapcore.InfoLevel, false},
+		{"verbose", zapcore.InfoLevel, true},
+	}
+	for _, test := range tests {
+		cfg, invalid, _ := newConfig(test.level, "")
+		if got := cfg.Level.Level(); got != test.want || invalid != test.invalid {
+			t.Errorf("%q: got %s, invalid %t, want %s, %t", test.level, got, invalid, test.want, test.invalid)
+		}
+		// the built logger must honour the level too
+		logger := NewLogger(test.level, "")
+		if !logger.Core().Enabled(test.want) || logger.Core().Enabled(test.want-1) {
+			t.Errorf("%q: logger not enabled from %s", test.level, test.want)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		level, format string
+		want          string
+		invalid       bool
+	}{
+		{"info", "json", "json", false},
+		{"info", "console", "console", false},
+		{"debug", "json", "json", false},
+		{"debug", "console", "console", false},
+		// the default follows the config chosen for the level
+		{"info", "", "json", false},
+		{"debug", "", "console", false},
+		{"info", "logfmt", "json", true},
+	}
+	for _, test := range tests {
+		cfg, _, invalid := newConfig(test.level, test.format)
+		if cfg.Encoding != test.want || invalid != test.invalid {
+			t.Errorf("%s %q: got %s, invalid %t, want %s, %t", test.level, test.format, cfg.Encoding, invalid, test.want, test.invalid)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+// Package tracing records spans of remote read and write requests and of
+// their Elasticsearch requests, exporting them to an OpenTelemetry collector
+// over OTLP/HTTP with JSON encoding.  Incoming W3C trace context is continued
+// so spans stitch together with those of Prometheus.
+//
+// The OpenTelemetry SDK needs a newer Go than the 1.12 this module builds with
+// and is not vendored, so this package implements only what the adapter uses:
+// spans with string and integer attributes, W3C traceparent extraction and a
+// batching OTLP/HTTP JSON exporter.
+//
+// A nil *Tracer, as used when no endpoint is configured, records nothing and
+// all of its spans are nil, which are safe to use.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// maxQueued bounds the spans waiting to be exported, later spans are
+	// dropped until the next export
+	maxQueued = 2048
+	// exportInterval is how often queued spans are exported
+	exportInterval = 5 * time.Second
+)
+
+// Span kinds of the OTLP protocol
+const (
+	KindServer = 2
+	KindClient = 3
+)
+
+// Tracer records spans and exports them in batches
+type Tracer struct {
+	logger   *zap.Logger
+	endpoint string
+	service  string
+	client   *http.Client
+
+	mu     sync.Mutex
+	queued []*Span
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewTracer returns a Tracer exporting the spans of service to the OTLP/HTTP
+// collector at endpoint, eg http://localhost:4318
+func NewTracer(logger *zap.Logger, endpoint, service string) *Tracer {
+	t := &Tracer{
+		logger:   logger,
+		endpoint: strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Close exports the spans still queued and stops exporting
+func (t *Tracer) Close() {
+	if t == nil {
+		return
+	}
+	close(t.stop)
+	<-t.done
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.export()
+		case <-t.stop:
+			t.export()
+			return
+		}
+	}
+}
+
+type contextKey struct{}
+
+// Extract returns ctx carrying the trace context of the traceparent header,
+// if valid, for the spans started from it to continue the caller's trace
+func Extract(ctx context.Context, header http.Header) context.Context {
+	// version-traceid-parentid-flags
+	parts := strings.Split(strings.TrimSpace(header.Get("traceparent")), "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return ctx
+	}
+	remote := &Span{}
+	if _, err := hex.Decode(remote.traceID[:], []byte(parts[1])); err != nil {
+		return ctx
+	}
+	if _, err := hex.Decode(remote.spanID[:], []byte(parts[2])); err != nil {
+		return ctx
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil || remote.traceID == [16]byte{} || remote.spanID == [8]byte{} {
+		return ctx
+	}
+	if flags&1 == 0 {
+		// the caller does not sample this trace, neither do its children
+		return context.WithValue(ctx, contextKey{}, (*Span)(nil))
+	}
+	return context.WithValue(ctx, contextKey{}, remote)
+}
+
+// Start starts a span named name, a child of the span of ctx if any, and
+// returns ctx carrying it
+func (t *Tracer) Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	parent, found := ctx.Value(contextKey{}).(*Span)
+	if found && parent == nil {
+		// not sampled
+		return ctx, nil
+	}
+	s := &Span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+	}
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, contextKey{}, s), s
+}
+
+// Span is a timed operation of a trace, nil spans record nothing
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    []keyValue
+	err      string
+	ended    bool
+}
+
+// SetString sets a string attribute
+func (s *Span) SetString(key, value string) {
+	if s == nil {
+		return
+	}
+	s.attrs = append(s.attrs, keyValue{Key: key, Value: anyValue{StringValue: &value}})
+}
+
+// SetInt sets an integer attribute
+func (s *Span) SetInt(key string, value int64) {
+	if s == nil {
+		return
+	}
+	i := strconv.FormatInt(value, 10)
+	s.attrs = append(s.attrs, keyValue{Key: key, Value: anyValue{IntValue: &i}})
+}
+
+// SetError marks the span failed with err, if not nil
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.err = err.Error()
+}
+
+// End ends the span and queues it for export
+func (s *Span) End() {
+	if s == nil || s.ended {
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	t := s.tracer
+	t.mu.Lock()
+	if len(t.queued) < maxQueued {
+		t.queued = append(t.queued, s)
+	}
+	t.mu.Unlock()
+}
+
+// export sends the queued spans to the collector, dropping them on failure
+func (t *Tracer) export() {
+	t.mu.Lock()
+	spans := t.queued
+	t.queued = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	body, err := json.Marshal(encode(t.service, spans))
+	if err != nil {
+		t.logger.Error("Failed to encode spans", zap.Error(err))
+		return
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.logger.Warn("Failed to export spans", zap.Int("spans", len(spans)), zap.Error(err))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		t.logger.Warn("Failed to export spans", zap.Int("spans", len(spans)), zap.Int("status", resp.StatusCode))
+	}
+}
+
+// The OTLP/HTTP JSON request, ids are hex and int64 values strings
+type (
+	exportRequest struct {
+		ResourceSpans []resourceSpans `json:"resourceSpans"`
+	}
+	resourceSpans struct {
+		Resource   resource     `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+	resource struct {
+		Attributes []keyValue `json:"attributes"`
+	}
+	scopeSpans struct {
+		Spans []spanJSON `json:"spans"`
+	}
+	spanJSON struct {
+		TraceID           string     `json:"traceId"`
+		SpanID            string     `json:"spanId"`
+		ParentSpanID      string     `json:"parentSpanId,omitempty"`
+		Name              string     `json:"name"`
+		Kind              int        `json:"kind"`
+		StartTimeUnixNano string     `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+		Attributes        []keyValue `json:"attributes,omitempty"`
+		Status            *status    `json:"status,omitempty"`
+	}
+	keyValue struct {
+		Key   string   `json:"key"`
+		Value anyValue `json:"value"`
+	}
+	anyValue struct {
+		StringValue *string `json:"stringValue,omitempty"`
+		IntValue    *string `json:"intValue,omitempty"`
+	}
+	status struct {
+		// Code 2 is error
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+// encode returns the export request of the spans of service
+func encode(service string, spans []*Span) *exportRequest {
+	out := make([]spanJSON, 0, len(spans))
+	for _, s := range spans {
+		j := spanJSON{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        s.attrs,
+		}
+		if s.parentID != [8]byte{} {
+			j.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != "" {
+			j.Status = &status{Code: 2, Message: s.err}
+		}
+		out = append(out, j)
+	}
+	return &exportRequest{ResourceSpans: []resourceSpans{{
+		Resource:   resource{Attributes: []keyValue{{Key: "service.name", Value: anyValue{StringValue: &service}}}},
+		ScopeSpans: []scopeSpans{{Spans: out}},
+	}}}
+}
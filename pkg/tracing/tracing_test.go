@@ -0,0 +1,119 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	ctx, span := tracer.Start(context.Background(), "noop", KindServer)
+	span.SetString("key", "value")
+	span.SetInt("count", 1)
+	span.End()
+	if ctx != context.Background() || span != nil {
+		t.Error("a nil tracer must not record spans")
+	}
+	tracer.Close()
+}
+
+func TestExportContinuesTrace(t *testing.T) {
+	var got exportRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("got path %s, want /v1/traces", r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer collector.Close()
+	tracer := NewTracer(zap.NewNop(), collector.URL, "test")
+
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, server := tracer.Start(Extract(context.Background(), header), "remote_read", KindServer)
+	_, client := tracer.Start(ctx, "elasticsearch.search", KindClient)
+	client.SetInt("es.hits", 3)
+	client.End()
+	server.End()
+	tracer.Close()
+
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("got %+v, want one batch of spans", got)
+	}
+	spans := got.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	search, read := spans[0], spans[1]
+	for _, s := range spans {
+		if s.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("span %s has trace id %s, want the caller's", s.Name, s.TraceID)
+		}
+	}
+	if read.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("got server span parent %s, want the caller's span", read.ParentSpanID)
+	}
+	if search.ParentSpanID != read.SpanID {
+		t.Errorf("got search span parent %s, want %s", search.ParentSpanID, read.SpanID)
+	}
+	if len(search.Attributes) != 1 || *search.Attributes[0].Value.IntValue != "3" {
+		t.Errorf("got attributes %+v, want es.hits 3", search.Attributes)
+	}
+	if _, err := hex.DecodeString(read.SpanID); err != nil || len(read.SpanID) != 16 {
+		t.Errorf("got invalid span id %q", read.SpanID)
+	}
+}
+
+func TestEncodeFieldNames(t *testing.T) {
+	span := &Span{
+		name:  "elasticsearch.search",
+		kind:  KindClient,
+		start: time.Unix(0, 1000),
+		end:   time.Unix(0, 2000),
+		err:   "timeout",
+	}
+	copy(span.traceID[:], []byte{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36})
+	copy(span.spanID[:], []byte{0x53, 0x99, 0x5c, 0x3f, 0x42, 0xcd, 0x8a, 0xd8})
+	copy(span.parentID[:], []byte{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7})
+	span.SetString("es.alias", "prom-metrics")
+	span.SetInt("es.hits", 3)
+	got, err := json.Marshal(encode("test", []*Span{span}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// field names and encodings of the OTLP/HTTP JSON protocol
+	want := `{"resourceSpans":[{` +
+		`"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"test"}}]},` +
+		`"scopeSpans":[{"spans":[{` +
+		`"traceId":"4bf92f3577b34da6a3ce929d0e0e4736",` +
+		`"spanId":"53995c3f42cd8ad8",` +
+		`"parentSpanId":"00f067aa0ba902b7",` +
+		`"name":"elasticsearch.search",` +
+		`"kind":3,` +
+		`"startTimeUnixNano":"1000",` +
+		`"endTimeUnixNano":"2000",` +
+		`"attributes":[{"key":"es.alias","value":{"stringValue":"prom-metrics"}},{"key":"es.hits","value":{"intValue":"3"}}],` +
+		`"status":{"code":2,"message":"timeout"}` +
+		`}]}]}]}`
+	if string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestExtractUnsampled(t *testing.T) {
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	tracer := &Tracer{}
+	if _, span := tracer.Start(Extract(context.Background(), header), "remote_write", KindServer); span != nil {
+		t.Error("got a span for a trace the caller does not sample")
+	}
+}